@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
 	sys "syscall"
 
 	"github.com/Leantar/fimserver/modules/config"
+	"github.com/Leantar/fimserver/modules/export"
+	"github.com/Leantar/fimserver/modules/metrics"
+	"github.com/Leantar/fimserver/modules/notifier"
 	"github.com/Leantar/fimserver/modules/preparation"
+	"github.com/Leantar/fimserver/modules/report"
+	"github.com/Leantar/fimserver/modules/syslog"
+	"github.com/Leantar/fimserver/modules/tracing"
 	"github.com/Leantar/fimserver/repository"
 	"github.com/Leantar/fimserver/server"
 	"github.com/rs/zerolog"
@@ -17,11 +25,22 @@ import (
 type Config struct {
 	Server     server.Config     `yaml:"server"`
 	Repository repository.Config `yaml:"repository"`
+	Notifier   notifier.Config   `yaml:"notifier"`
+	Syslog     syslog.Config     `yaml:"syslog"`
+	Metrics    metrics.Config    `yaml:"metrics"`
+	Tracing    tracing.Config    `yaml:"tracing"`
+	Report     report.Config     `yaml:"report"`
 }
 
 var (
-	configPath = flag.String("config", "config.yaml", "Specify a path to load the config from")
-	setupMode  = flag.Bool("setup", false, "Prepare the database of the application")
+	configPath    = flag.String("config", "config.yaml", "Specify a path to load the config from")
+	setupMode     = flag.Bool("setup", false, "Prepare the database of the application")
+	reconcileMode = flag.Bool("reconcile", false, "Apply the bootstrap file to an existing database and print what changed")
+	dryRun        = flag.Bool("dry-run", false, "Only print what reconcile mode would change")
+	bootstrapPath = flag.String("bootstrap", "", "Specify a bootstrap file declaring policies and endpoints. Defaults to the built-in one")
+	exportMode    = flag.String("export", "", "Export all alerts in the given format (json, cef or ocsf) and exit")
+	exportPath    = flag.String("export-file", "", "Specify a file to write exported alerts to. Defaults to stdout")
+	verifyMode    = flag.Bool("verify-chain", false, "Verify the hash chain over alerts and audit entries and print every break")
 )
 
 func main() {
@@ -43,6 +62,21 @@ func main() {
 		if err != nil {
 			log.Fatal().Caller().Err(err).Msg("failed to run preparation")
 		}
+	} else if *reconcileMode {
+		err := reconcile(conf)
+		if err != nil {
+			log.Fatal().Caller().Err(err).Msg("failed to reconcile")
+		}
+	} else if *verifyMode {
+		err := verifyChain(conf)
+		if err != nil {
+			log.Fatal().Caller().Err(err).Msg("failed to verify chain")
+		}
+	} else if *exportMode != "" {
+		err := exportAlerts(conf)
+		if err != nil {
+			log.Fatal().Caller().Err(err).Msg("failed to export alerts")
+		}
 	} else {
 		err := run(conf)
 		if err != nil {
@@ -56,8 +90,43 @@ func run(conf Config) error {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, sys.SIGINT, sys.SIGTERM)
 
+	shutdownTracing, err := tracing.Setup(conf.Tracing)
+	if err != nil {
+		return err
+	}
+
 	repo := repository.New(conf.Repository)
-	srv := server.New(repo, conf.Server)
+	err = repo.CheckSchema(context.Background())
+	if err != nil {
+		return err
+	}
+
+	n, err := notifier.New(conf.Notifier, repo.Notifications())
+	if err != nil {
+		return err
+	}
+	fwd, err := syslog.New(conf.Syslog)
+	if err != nil {
+		return err
+	}
+	srv := server.New(repo, n, fwd, conf.Server)
+	reports, err := report.New(conf.Report, repo.Reports(), n)
+	if err != nil {
+		return err
+	}
+
+	metrics.RegisterAgentStates(repo.Endpoints().CountByBaselineState)
+	metricsSrv := metrics.NewServer(conf.Metrics)
+
+	go n.Run()
+	go fwd.Run()
+	go reports.Run()
+
+	go func() {
+		if err := metricsSrv.Run(); err != nil {
+			log.Fatal().Caller().Err(err).Msg("metrics listener failed to run")
+		}
+	}()
 
 	go func() {
 		if err := srv.Run(); err != nil {
@@ -67,12 +136,98 @@ func run(conf Config) error {
 
 	<-quit
 	srv.Stop()
-	return nil
+	metricsSrv.Stop()
+	reports.Stop()
+	n.Stop()
+	fwd.Stop()
+
+	return shutdownTracing(context.Background())
 }
 
-// Run the setup mode. This creates all required casbin rules, an admin user and all relations inside the database.
+// Run the setup mode. This creates all relations inside the database and applies the bootstrap file.
 func setup(conf Config) error {
+	b, err := preparation.LoadBootstrap(*bootstrapPath)
+	if err != nil {
+		return err
+	}
+
 	repo := repository.New(conf.Repository)
 
-	return preparation.Setup(repo)
+	changes, err := preparation.Setup(repo, b)
+	if err != nil {
+		return err
+	}
+
+	printChanges(changes)
+
+	return nil
+}
+
+// Run the reconcile mode. This applies the bootstrap file to an existing database and prints what changed.
+func reconcile(conf Config) error {
+	b, err := preparation.LoadBootstrap(*bootstrapPath)
+	if err != nil {
+		return err
+	}
+
+	repo := repository.New(conf.Repository)
+
+	changes, err := preparation.Reconcile(repo, b, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	printChanges(changes)
+
+	return nil
+}
+
+func printChanges(changes []preparation.Change) {
+	if len(changes) == 0 {
+		fmt.Println("database already matches the bootstrap file")
+		return
+	}
+
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+}
+
+// Run the export mode. This writes all stored alerts in the requested format.
+func exportAlerts(conf Config) error {
+	repo := repository.New(conf.Repository)
+
+	out := os.Stdout
+	if *exportPath != "" {
+		f, err := os.Create(*exportPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	return export.Alerts(repo, out, *exportMode)
+}
+
+// Run the verify chain mode. This checks the stored alerts and audit entries against the chain and its checkpoints.
+func verifyChain(conf Config) error {
+	repo := repository.New(conf.Repository)
+
+	report, err := server.CheckChain(context.Background(), repo, conf.Server)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d links, %d checkpoints, %d links after the last checkpoint\n",
+		report.Links, report.Checkpoints, report.UncheckpointedLinks)
+	for _, b := range report.Breaks {
+		fmt.Printf("link %d (%s %d): %s\n", b.LinkID, b.Source, b.RowID, b.Reason)
+	}
+
+	if len(report.Breaks) != 0 {
+		return fmt.Errorf("chain has %d breaks", len(report.Breaks))
+	}
+
+	return nil
 }
@@ -3,9 +3,40 @@ package models
 type Alert struct {
 	ID         uint64
 	Kind       string
+	Severity   string
 	Difference string
-	IssuedAt   int64
-	Path       string
-	Modified   int64
-	AgentID    uint64
+	// The field changes described by Difference
+	Differences []Difference
+	IssuedAt    int64
+	Path        string
+	Modified    int64
+	AgentID     uint64
+}
+
+// Difference is a change of a single field of a file. Before is empty if only the new value is known.
+type Difference struct {
+	Field  string
+	Before string
+	After  string
+}
+
+// AlertFilter restricts the alerts returned by a query. Empty fields match every alert.
+type AlertFilter struct {
+	AgentIDs   []uint64
+	Kinds      []string
+	Severities []string
+	// Only alerts with a greater ID are returned
+	AfterID    uint64
+	PathPrefix string
+	// Shell style pattern, where * matches any sequence of characters including / and ? matches a single character
+	PathGlob string
+	// Inclusive lower and exclusive upper bound of issued_at. Zero means unbounded
+	IssuedFrom  int64
+	IssuedUntil int64
+}
+
+// AlertCursor is the position of the last alert of a page in the issued_at, id order
+type AlertCursor struct {
+	IssuedAt int64
+	ID       uint64
 }
@@ -0,0 +1,9 @@
+package models
+
+// BaselineApproval is the vote of one approver for letting an agent update its baseline
+type BaselineApproval struct {
+	ID        uint64
+	AgentID   uint64
+	Approver  string
+	CreatedAt int64
+}
@@ -0,0 +1,25 @@
+package models
+
+// AuditEntry records a privileged call, whether it succeeded or not
+type AuditEntry struct {
+	ID     uint64
+	Actor  string
+	Action string
+	Target string
+	// The request as JSON
+	Parameters string
+	// "OK", "DISABLED" for calls of disabled endpoints or the name of the gRPC status code the call failed with
+	Result        string
+	RemoteAddress string
+	CreatedAt     int64
+}
+
+// AuditFilter selects audit entries. Empty fields match everything.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Target string
+	Result string
+	From   int64
+	Until  int64
+}
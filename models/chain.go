@@ -0,0 +1,43 @@
+package models
+
+// ChainLink chains a stored alert or audit entry to all links before it. Removal links allow the alerts of an agent
+// that were chained before them to be missing.
+type ChainLink struct {
+	ID     uint64
+	Source string
+	// The ID of the alert or audit entry. 0 for removals
+	RowID uint64
+	// The agent of an alert or removal
+	AgentID uint64
+	// The hash over the content of the row. Empty for removals
+	RowHash string
+	// The hash over the row hash and the hash of the previous link
+	Hash string
+}
+
+// ChainCheckpoint is a signature over the hash of a link, made with the key of the server certificate
+type ChainCheckpoint struct {
+	ID     uint64
+	LinkID uint64
+	Hash   string
+	// PEM encoded certificate of the key that made the signature
+	Certificate string
+	Signature   []byte
+	CreatedAt   int64
+}
+
+// ChainBreak describes a link or row that doesn't match the chain
+type ChainBreak struct {
+	LinkID uint64
+	Source string
+	RowID  uint64
+	Reason string
+}
+
+type ChainReport struct {
+	Links       uint64
+	Checkpoints uint64
+	// Links after the last checkpoint. Their rows could have been changed together with the chain.
+	UncheckpointedLinks uint64
+	Breaks              []ChainBreak
+}
@@ -8,4 +8,15 @@ type Endpoint struct {
 	HasBaseline       bool
 	BaselineIsCurrent bool
 	WatchedPaths      []string
+	LastScan          int64
+	LastSeen          int64
+	RemoteAddress     string
+	// A silent agent alert was raised and the agent wasn't seen since
+	IsSilent bool
+	// Disabled endpoints are rejected during authentication
+	Disabled bool
+	// SHA-256 hashes of the accepted certificates or their public keys. Any certificate is accepted if empty
+	CertPins []string
+	// Identifies the endpoint by a SAN URI such as a SPIFFE ID instead of the CommonName
+	URIIdentity string
 }
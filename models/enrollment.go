@@ -0,0 +1,9 @@
+package models
+
+// EnrollmentToken lets an agent obtain its first certificate. Only a hash of the token is stored.
+type EnrollmentToken struct {
+	ID         uint64
+	TokenHash  string
+	ExpiresAt  int64
+	EndpointID uint64
+}
@@ -0,0 +1,53 @@
+package models
+
+import "sort"
+
+// HostFacts are reported by an agent about the host it runs on
+type HostFacts struct {
+	ID           uint64
+	Hostname     string
+	OsRelease    string
+	Kernel       string
+	AgentVersion string
+	IPAddresses  []string
+	// When the agent first reported these facts
+	ReportedAt int64
+	AgentID    uint64
+}
+
+// Equal reports whether both describe the same host state, regardless of when and for which agent they were reported.
+// The IP addresses are compared as a set.
+func (h HostFacts) Equal(other HostFacts) bool {
+	if h.Hostname != other.Hostname || h.OsRelease != other.OsRelease || h.Kernel != other.Kernel ||
+		h.AgentVersion != other.AgentVersion {
+		return false
+	}
+
+	a, b := SortedIPAddresses(h.IPAddresses), SortedIPAddresses(other.IPAddresses)
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SortedIPAddresses returns a sorted copy of addresses without duplicates
+func SortedIPAddresses(addresses []string) []string {
+	sorted := append(make([]string, 0, len(addresses)), addresses...)
+	sort.Strings(sorted)
+
+	unique := sorted[:0]
+	for i, addr := range sorted {
+		if i == 0 || addr != sorted[i-1] {
+			unique = append(unique, addr)
+		}
+	}
+
+	return unique
+}
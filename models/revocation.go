@@ -0,0 +1,11 @@
+package models
+
+// Revocation is a client certificate that was revoked through the server
+type Revocation struct {
+	ID uint64
+	// Lowercase hex without separators or leading zeros
+	Serial    string
+	Reason    string
+	RevokedBy string
+	RevokedAt int64
+}
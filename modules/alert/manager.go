@@ -9,9 +9,18 @@ import (
 )
 
 const (
-	KindCreate = "CREATE"
-	KindChange = "CHANGE"
-	KindDelete = "DELETE"
+	KindCreate    = "CREATE"
+	KindChange    = "CHANGE"
+	KindDelete    = "DELETE"
+	KindTimestomp = "TIMESTOMP"
+	// The agent hasn't called the server for too long. These alerts have no path
+	KindSilent = "SILENT"
+)
+
+const (
+	SeverityLow    = "LOW"
+	SeverityMedium = "MEDIUM"
+	SeverityHigh   = "HIGH"
 )
 
 type Manager struct {
@@ -39,6 +48,7 @@ func NewManager(baseline []models.FsObject, agentID uint64) *Manager {
 
 func (m *Manager) CheckForAlert(obj models.FsObject) {
 	baseLen := len(m.baseline)
+	now := time.Now().Unix()
 
 	i := sort.Search(baseLen, func(i int) bool {
 		return m.baseline[i].Path >= obj.Path
@@ -47,26 +57,32 @@ func (m *Manager) CheckForAlert(obj models.FsObject) {
 	// Check if object exists in baseline
 	if i < baseLen && m.baseline[i].Path == obj.Path {
 		if !m.equal(obj, m.baseline[i]) {
-			m.insert(models.Alert{
-				Kind:       KindChange,
-				Difference: GetDifference(m.baseline[i], obj),
-				IssuedAt:   time.Now().Unix(),
-				Path:       obj.Path,
-				Modified:   obj.Modified,
-				AgentID:    m.agentID,
-			})
+			al := models.Alert{
+				Kind:     KindChange,
+				Severity: SeverityOf(KindChange),
+				IssuedAt: now,
+				Path:     obj.Path,
+				Modified: obj.Modified,
+				AgentID:  m.agentID,
+			}
+			al.Difference, al.Differences = GetDifference(m.baseline[i], obj)
+			ApplyTimestampAnomaly(&al, m.baseline[i], obj, now)
+			m.insert(al)
 		}
 
 		// Remove element from baseline to be able to check for DELETE events afterwards
 		m.baseline = append(m.baseline[:i], m.baseline[i+1:]...)
 	} else {
-		m.insert(models.Alert{
+		al := models.Alert{
 			Kind:     KindCreate,
-			IssuedAt: time.Now().Unix(),
+			Severity: SeverityOf(KindCreate),
+			IssuedAt: now,
 			Path:     obj.Path,
 			Modified: obj.Modified,
 			AgentID:  m.agentID,
-		})
+		}
+		ApplyTimestampAnomaly(&al, models.FsObject{}, obj, now)
+		m.insert(al)
 	}
 }
 
@@ -76,6 +92,7 @@ func (m *Manager) Result() []models.Alert {
 	for _, obj := range m.baseline {
 		m.insert(models.Alert{
 			Kind:     KindDelete,
+			Severity: SeverityOf(KindDelete),
 			IssuedAt: time.Now().Unix(),
 			Path:     obj.Path,
 			AgentID:  m.agentID,
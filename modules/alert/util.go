@@ -6,18 +6,84 @@ import (
 	"github.com/Leantar/fimserver/models"
 )
 
-func GetDifference(obj1, obj2 models.FsObject) (difference string) {
+// Timestamps up to this many seconds ahead of the server clock are tolerated to allow for clock skew
+const maxClockSkew = 300
+
+// GetDifference describes the first field in which obj2 differs from obj1, both as text and as structured difference.
+// Both are empty if the objects are equal.
+func GetDifference(obj1, obj2 models.FsObject) (string, []models.Difference) {
 	if obj1.Hash != obj2.Hash {
-		difference = fmt.Sprintf("hash: %s -> %s", obj1.Hash, obj2.Hash)
+		return describe("hash", FieldHash, obj1.Hash, obj2.Hash)
 	} else if obj1.Uid != obj2.Uid || obj1.Gid != obj2.Gid {
-		difference = fmt.Sprintf("owner: %d:%d -> %d:%d", obj1.Uid, obj1.Gid, obj2.Uid, obj2.Gid)
+		return describe("owner", FieldOwner, fmt.Sprintf("%d:%d", obj1.Uid, obj1.Gid), fmt.Sprintf("%d:%d", obj2.Uid, obj2.Gid))
 	} else if obj1.Mode != obj2.Mode {
-		difference = fmt.Sprintf("mode: %s -> %s", obj1.ParseMode(), obj2.ParseMode())
+		return describe("mode", FieldMode, obj1.ParseMode(), obj2.ParseMode())
 	} else if obj1.Created != obj2.Created {
-		difference = fmt.Sprintf("creation time: %d -> %d", obj1.Created, obj2.Created)
+		return describe("creation time", FieldCreated, fmt.Sprint(obj1.Created), fmt.Sprint(obj2.Created))
 	} else if obj1.Modified != obj2.Modified {
-		difference = fmt.Sprintf("modified: %d -> %d", obj1.Modified, obj2.Modified)
+		return describe("modified", FieldModified, fmt.Sprint(obj1.Modified), fmt.Sprint(obj2.Modified))
+	}
+
+	return "", nil
+}
+
+// GetTimestampAnomaly checks obj2 for timestamp behaviour that indicates timestomping.
+// obj1 is the baseline version of the object and may be empty for objects that are not part of the baseline.
+// Both results are empty if the timestamps look plausible.
+func GetTimestampAnomaly(obj1, obj2 models.FsObject, now int64) (string, []models.Difference) {
+	if obj2.Modified < obj1.Modified {
+		return describe("modified moved backwards", FieldModified, fmt.Sprint(obj1.Modified), fmt.Sprint(obj2.Modified))
+	} else if obj2.Created < obj1.Created {
+		return describe("creation time moved backwards", FieldCreated, fmt.Sprint(obj1.Created), fmt.Sprint(obj2.Created))
+	} else if obj2.Modified > now+maxClockSkew {
+		after := fmt.Sprint(obj2.Modified)
+		return "modified lies in the future: " + after, []models.Difference{{Field: FieldModified, After: after}}
+	}
+
+	return "", nil
+}
+
+// ApplyTimestampAnomaly turns al into a timestomping alert if obj2 shows suspicious timestamps.
+// Content, owner or mode changes found in the original alert are kept in the difference.
+func ApplyTimestampAnomaly(al *models.Alert, obj1, obj2 models.FsObject, now int64) {
+	anomaly, diffs := GetTimestampAnomaly(obj1, obj2, now)
+	if anomaly == "" {
+		return
 	}
 
-	return
+	if al.Kind == KindChange && (obj1.Hash != obj2.Hash || obj1.Uid != obj2.Uid || obj1.Gid != obj2.Gid || obj1.Mode != obj2.Mode) {
+		anomaly = fmt.Sprintf("%s; %s", anomaly, al.Difference)
+		diffs = append(diffs, al.Differences...)
+	}
+
+	al.Kind = KindTimestomp
+	al.Severity = SeverityOf(KindTimestomp)
+	al.Difference = anomaly
+	al.Differences = diffs
 }
+
+// describe renders a field change as "<description>: <before> -> <after>"
+func describe(description, field, before, after string) (string, []models.Difference) {
+	text := fmt.Sprintf("%s: %s -> %s", description, before, after)
+	return text, []models.Difference{{Field: field, Before: before, After: after}}
+}
+
+// SeverityOf returns the severity that is assigned to alerts of the given kind
+func SeverityOf(kind string) string {
+	switch kind {
+	case KindTimestomp, KindSilent:
+		return SeverityHigh
+	case KindCreate:
+		return SeverityLow
+	default:
+		return SeverityMedium
+	}
+}
+
+const (
+	FieldHash     = "hash"
+	FieldOwner    = "owner"
+	FieldMode     = "mode"
+	FieldCreated  = "created"
+	FieldModified = "modified"
+)
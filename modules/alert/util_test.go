@@ -0,0 +1,147 @@
+package alert
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Leantar/fimserver/models"
+)
+
+func TestGetDifference(t *testing.T) {
+	base := models.FsObject{Path: "/etc/passwd", Hash: "aa", Created: 10, Modified: 20, Uid: 0, Gid: 0, Mode: 0644}
+
+	tests := []struct {
+		name  string
+		obj   func(models.FsObject) models.FsObject
+		text  string
+		diffs []models.Difference
+	}{
+		{
+			name:  "equal",
+			obj:   func(o models.FsObject) models.FsObject { return o },
+			text:  "",
+			diffs: nil,
+		},
+		{
+			name:  "hash",
+			obj:   func(o models.FsObject) models.FsObject { o.Hash = "bb"; o.Uid = 1; return o },
+			text:  "hash: aa -> bb",
+			diffs: []models.Difference{{Field: FieldHash, Before: "aa", After: "bb"}},
+		},
+		{
+			name:  "owner",
+			obj:   func(o models.FsObject) models.FsObject { o.Uid = 1000; o.Gid = 100; return o },
+			text:  "owner: 0:0 -> 1000:100",
+			diffs: []models.Difference{{Field: FieldOwner, Before: "0:0", After: "1000:100"}},
+		},
+		{
+			name:  "creation time",
+			obj:   func(o models.FsObject) models.FsObject { o.Created = 11; return o },
+			text:  "creation time: 10 -> 11",
+			diffs: []models.Difference{{Field: FieldCreated, Before: "10", After: "11"}},
+		},
+		{
+			name:  "modified",
+			obj:   func(o models.FsObject) models.FsObject { o.Modified = 21; return o },
+			text:  "modified: 20 -> 21",
+			diffs: []models.Difference{{Field: FieldModified, Before: "20", After: "21"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, diffs := GetDifference(base, tt.obj(base))
+			if text != tt.text {
+				t.Errorf("text = %q, want %q", text, tt.text)
+			}
+			if !reflect.DeepEqual(diffs, tt.diffs) {
+				t.Errorf("diffs = %+v, want %+v", diffs, tt.diffs)
+			}
+		})
+	}
+}
+
+func TestGetDifferenceKeepsSeparatorsInValues(t *testing.T) {
+	// Values used to be split on these separators when the differences were parsed from the text
+	before := models.FsObject{Hash: "a; b"}
+	after := models.FsObject{Hash: "c -> d"}
+
+	_, diffs := GetDifference(before, after)
+
+	want := []models.Difference{{Field: FieldHash, Before: "a; b", After: "c -> d"}}
+	if !reflect.DeepEqual(diffs, want) {
+		t.Errorf("diffs = %+v, want %+v", diffs, want)
+	}
+}
+
+func TestApplyTimestampAnomaly(t *testing.T) {
+	const now = 1000
+	base := models.FsObject{Hash: "aa", Created: 10, Modified: 20}
+
+	tests := []struct {
+		name     string
+		kind     string
+		obj      models.FsObject
+		wantKind string
+		text     string
+		diffs    []models.Difference
+	}{
+		{
+			name:     "plausible",
+			kind:     KindChange,
+			obj:      models.FsObject{Hash: "aa", Created: 10, Modified: 30},
+			wantKind: KindChange,
+			text:     "modified: 20 -> 30",
+			diffs:    []models.Difference{{Field: FieldModified, Before: "20", After: "30"}},
+		},
+		{
+			name:     "modified moved backwards",
+			kind:     KindChange,
+			obj:      models.FsObject{Hash: "aa", Created: 10, Modified: 15},
+			wantKind: KindTimestomp,
+			text:     "modified moved backwards: 20 -> 15",
+			diffs:    []models.Difference{{Field: FieldModified, Before: "20", After: "15"}},
+		},
+		{
+			name:     "content change is kept",
+			kind:     KindChange,
+			obj:      models.FsObject{Hash: "bb", Created: 5, Modified: 20},
+			wantKind: KindTimestomp,
+			text:     "creation time moved backwards: 10 -> 5; hash: aa -> bb",
+			diffs: []models.Difference{
+				{Field: FieldCreated, Before: "10", After: "5"},
+				{Field: FieldHash, Before: "aa", After: "bb"},
+			},
+		},
+		{
+			name:     "modified lies in the future",
+			kind:     KindChange,
+			obj:      models.FsObject{Hash: "aa", Created: 10, Modified: now + maxClockSkew + 1},
+			wantKind: KindTimestomp,
+			text:     "modified lies in the future: 1301",
+			diffs:    []models.Difference{{Field: FieldModified, After: "1301"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			al := models.Alert{Kind: tt.kind, Severity: SeverityOf(tt.kind)}
+			al.Difference, al.Differences = GetDifference(base, tt.obj)
+
+			ApplyTimestampAnomaly(&al, base, tt.obj, now)
+
+			if al.Kind != tt.wantKind {
+				t.Errorf("kind = %s, want %s", al.Kind, tt.wantKind)
+			}
+			if al.Severity != SeverityOf(tt.wantKind) {
+				t.Errorf("severity = %s, want %s", al.Severity, SeverityOf(tt.wantKind))
+			}
+			if al.Difference != tt.text {
+				t.Errorf("difference = %q, want %q", al.Difference, tt.text)
+			}
+			if !reflect.DeepEqual(al.Differences, tt.diffs) {
+				t.Errorf("differences = %+v, want %+v", al.Differences, tt.diffs)
+			}
+		})
+	}
+}
@@ -10,12 +10,15 @@ import (
 type RuleRepository interface {
 	Create(ctx context.Context, line Rule) error
 	GetAll(ctx context.Context) ([]Rule, error)
+	GetFiltered(ctx context.Context, filter Filter) ([]Rule, error)
 	Delete(ctx context.Context, line Rule) error
+	DeleteFiltered(ctx context.Context, filter Filter) error
 	DeleteAll(ctx context.Context) error
 }
 
 type Adapter struct {
-	repo RuleRepository
+	repo     RuleRepository
+	filtered bool
 }
 
 type Rule struct {
@@ -28,6 +31,17 @@ type Rule struct {
 	V5    string
 }
 
+// Filter selects rules whose fields match any of the given values. Empty fields match every rule.
+type Filter struct {
+	PType []string
+	V0    []string
+	V1    []string
+	V2    []string
+	V3    []string
+	V4    []string
+	V5    []string
+}
+
 func NewAdapter(repo RuleRepository) *Adapter {
 	return &Adapter{
 		repo: repo,
@@ -44,10 +58,47 @@ func (a *Adapter) LoadPolicy(model model.Model) error {
 		loadPolicyLine(line, model)
 	}
 
+	a.filtered = false
+
 	return nil
 }
 
+// LoadFilteredPolicy only loads the rules matching filter, which must be a Filter
+func (a *Adapter) LoadFilteredPolicy(model model.Model, filter interface{}) error {
+	var f Filter
+	switch v := filter.(type) {
+	case Filter:
+		f = v
+	case *Filter:
+		f = *v
+	default:
+		return errors.New("invalid filter type")
+	}
+
+	lines, err := a.repo.GetFiltered(context.Background(), f)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		loadPolicyLine(line, model)
+	}
+
+	a.filtered = true
+
+	return nil
+}
+
+func (a *Adapter) IsFiltered() bool {
+	return a.filtered
+}
+
 func (a *Adapter) SavePolicy(model model.Model) error {
+	// Saving would delete all rules that weren't loaded
+	if a.filtered {
+		return errors.New("cannot save a filtered policy")
+	}
+
 	err := a.repo.DeleteAll(context.Background())
 	if err != nil {
 		return err
@@ -88,8 +139,22 @@ func (a *Adapter) RemovePolicy(_ string, ptype string, rule []string) error {
 	return nil
 }
 
-func (a *Adapter) RemoveFilteredPolicy(_ string, _ string, _ int, _ ...string) error {
-	return errors.New("not implemented")
+// RemoveFilteredPolicy removes the rules whose fields starting at fieldIndex match fieldValues. Empty values match every rule.
+func (a *Adapter) RemoveFilteredPolicy(_ string, ptype string, fieldIndex int, fieldValues ...string) error {
+	if fieldIndex < 0 || fieldIndex+len(fieldValues) > 6 {
+		return errors.New("invalid field index")
+	}
+
+	filter := Filter{PType: []string{ptype}}
+	fields := []*[]string{&filter.V0, &filter.V1, &filter.V2, &filter.V3, &filter.V4, &filter.V5}
+
+	for i, value := range fieldValues {
+		if value != "" {
+			*fields[fieldIndex+i] = []string{value}
+		}
+	}
+
+	return a.repo.DeleteFiltered(context.Background(), filter)
 }
 
 func savePolicyLine(ptype string, rule []string) (line Rule) {
@@ -0,0 +1,208 @@
+package casbin
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/casbin/casbin/v2/model"
+)
+
+const testModel = `
+[request_definition]
+r = sub, obj
+
+[policy_definition]
+p = sub_rule, obj
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = eval(p.sub_rule) && r.obj == p.obj`
+
+// testRepo keeps the rules in memory and records the filters of deletions
+type testRepo struct {
+	rules   []Rule
+	deleted []Filter
+}
+
+func (r *testRepo) Create(_ context.Context, line Rule) error {
+	r.rules = append(r.rules, line)
+	return nil
+}
+
+func (r *testRepo) GetAll(context.Context) ([]Rule, error) { return r.rules, nil }
+
+func (r *testRepo) GetFiltered(_ context.Context, filter Filter) ([]Rule, error) {
+	var rules []Rule
+	for _, rule := range r.rules {
+		if matches(filter.V1, rule.V1) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+func (r *testRepo) Delete(_ context.Context, line Rule) error {
+	for i, rule := range r.rules {
+		if rule == line {
+			r.rules = append(r.rules[:i], r.rules[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (r *testRepo) DeleteFiltered(_ context.Context, filter Filter) error {
+	r.deleted = append(r.deleted, filter)
+	return nil
+}
+
+func (r *testRepo) DeleteAll(context.Context) error {
+	r.rules = nil
+	return nil
+}
+
+func matches(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func newTestModel(t *testing.T) model.Model {
+	m, err := model.NewModelFromString(testModel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func newTestRepo() *testRepo {
+	return &testRepo{rules: []Rule{
+		{PType: "p", V0: `r.sub.Kind == "agent"`, V1: "CreateBaseline"},
+		{PType: "p", V0: `r.sub.Kind == "client"`, V1: "GetAgents"},
+	}}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	a := NewAdapter(newTestRepo())
+	m := newTestModel(t)
+
+	if err := a.LoadPolicy(m); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{{`r.sub.Kind == "agent"`, "CreateBaseline"}, {`r.sub.Kind == "client"`, "GetAgents"}}
+	if got := m.GetPolicy("p", "p"); !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded policy = %v, want %v", got, want)
+	}
+	if a.IsFiltered() {
+		t.Error("complete policy is reported as filtered")
+	}
+}
+
+func TestFilteredPolicyIsNotSaved(t *testing.T) {
+	repo := newTestRepo()
+	a := NewAdapter(repo)
+	m := newTestModel(t)
+
+	if err := a.LoadFilteredPolicy(m, &Filter{V1: []string{"GetAgents"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{{`r.sub.Kind == "client"`, "GetAgents"}}
+	if got := m.GetPolicy("p", "p"); !reflect.DeepEqual(got, want) {
+		t.Errorf("loaded policy = %v, want %v", got, want)
+	}
+	if !a.IsFiltered() {
+		t.Error("filtered policy isn't reported as filtered")
+	}
+
+	if err := a.SavePolicy(m); err == nil {
+		t.Error("filtered policy was saved")
+	}
+	if len(repo.rules) != 2 {
+		t.Errorf("saving a filtered policy left %d rules, want 2", len(repo.rules))
+	}
+
+	if err := a.LoadFilteredPolicy(m, "GetAgents"); err == nil {
+		t.Error("filter of an invalid type was accepted")
+	}
+}
+
+func TestSavePolicy(t *testing.T) {
+	repo := newTestRepo()
+	a := NewAdapter(repo)
+	m := newTestModel(t)
+
+	if err := a.LoadPolicy(m); err != nil {
+		t.Fatal(err)
+	}
+	m.AddPolicy("p", "p", []string{`r.sub.Kind == "client"`, "GetAlerts"})
+
+	if err := a.SavePolicy(m); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo.rules) != 3 {
+		t.Errorf("saved %d rules, want 3", len(repo.rules))
+	}
+}
+
+func TestRemoveFilteredPolicy(t *testing.T) {
+	repo := newTestRepo()
+	a := NewAdapter(repo)
+
+	if err := a.RemoveFilteredPolicy("p", "p", 1, "GetAgents"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RemoveFilteredPolicy("p", "p", 0, "", "GetAgents"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Filter{
+		{PType: []string{"p"}, V1: []string{"GetAgents"}},
+		{PType: []string{"p"}, V1: []string{"GetAgents"}},
+	}
+	if !reflect.DeepEqual(repo.deleted, want) {
+		t.Errorf("deleted filters = %+v, want %+v", repo.deleted, want)
+	}
+
+	for _, index := range []int{-1, 6} {
+		if err := a.RemoveFilteredPolicy("p", "p", index, "GetAgents"); err == nil {
+			t.Errorf("field index %d was accepted", index)
+		}
+	}
+	if err := a.RemoveFilteredPolicy("p", "p", 4, "a", "b", "c"); err == nil {
+		t.Error("values past the last field were accepted")
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	changes := make(chan struct{})
+	w := NewWatcher(changes)
+	defer w.Close()
+
+	updates := make(chan struct{}, 1)
+	if err := w.SetUpdateCallback(func(string) { updates <- struct{}{} }); err != nil {
+		t.Fatal(err)
+	}
+
+	changes <- struct{}{}
+
+	select {
+	case <-updates:
+	case <-time.After(time.Second):
+		t.Fatal("change of the rules didn't call the update callback")
+	}
+
+	// Closing twice doesn't panic
+	w.Close()
+}
@@ -0,0 +1,67 @@
+package casbin
+
+import (
+	"sync"
+)
+
+// Watcher reloads the policy whenever the rules change. The changes are signalled by the repository, so changes of
+// other server instances and manual edits of the rules table are noticed as well.
+type Watcher struct {
+	changes  <-chan struct{}
+	quit     chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	callback func(string)
+}
+
+func NewWatcher(changes <-chan struct{}) *Watcher {
+	w := &Watcher{
+		changes: changes,
+		quit:    make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w
+}
+
+func (w *Watcher) run() {
+	for {
+		select {
+		case <-w.quit:
+			return
+		case _, ok := <-w.changes:
+			if !ok {
+				return
+			}
+
+			w.mu.Lock()
+			callback := w.callback
+			w.mu.Unlock()
+
+			if callback != nil {
+				callback("")
+			}
+		}
+	}
+}
+
+func (w *Watcher) SetUpdateCallback(callback func(string)) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.callback = callback
+
+	return nil
+}
+
+// Update does nothing, because every change of the rules table is signalled by the database
+func (w *Watcher) Update() error {
+	return nil
+}
+
+func (w *Watcher) Close() {
+	w.once.Do(func() {
+		close(w.quit)
+	})
+}
@@ -0,0 +1,82 @@
+// Package chain defines the hashes that make alerts and audit entries tamper-evident. Every stored row is chained to
+// all rows before it, so changing or deleting a row breaks the chain unless all following hashes are recomputed.
+// Signed checkpoints prevent that for the part of the chain they cover.
+package chain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+
+	"github.com/Leantar/fimserver/models"
+)
+
+const (
+	SourceAlert   = "alert"
+	SourceAudit   = "audit"
+	SourceRemoval = "removal"
+)
+
+// AlertHash hashes all columns of an alert. The differences are preceded by their count, so that they can't be moved
+// into the following columns.
+func AlertHash(a models.Alert) string {
+	fields := []string{
+		strconv.FormatUint(a.ID, 10),
+		a.Kind,
+		a.Severity,
+		a.Difference,
+		strconv.Itoa(len(a.Differences)),
+	}
+	for _, d := range a.Differences {
+		fields = append(fields, d.Field, d.Before, d.After)
+	}
+	fields = append(fields,
+		strconv.FormatInt(a.IssuedAt, 10),
+		a.Path,
+		strconv.FormatInt(a.Modified, 10),
+		strconv.FormatUint(a.AgentID, 10),
+	)
+
+	return hashFields(fields...)
+}
+
+// AuditHash hashes all columns of an audit entry
+func AuditHash(e models.AuditEntry) string {
+	return hashFields(
+		strconv.FormatUint(e.ID, 10),
+		e.Actor,
+		e.Action,
+		e.Target,
+		e.Parameters,
+		e.Result,
+		e.RemoteAddress,
+		strconv.FormatInt(e.CreatedAt, 10),
+	)
+}
+
+// LinkHash chains a link to the hash of the previous link, which is empty for the first one
+func LinkHash(prev string, l models.ChainLink) string {
+	return hashFields(
+		prev,
+		l.Source,
+		strconv.FormatUint(l.RowID, 10),
+		strconv.FormatUint(l.AgentID, 10),
+		l.RowHash,
+	)
+}
+
+// CheckpointMessage is what the server signs for a checkpoint
+func CheckpointMessage(linkID uint64, linkHash string) []byte {
+	return []byte(fmt.Sprintf("fimserver chain checkpoint %d %s", linkID, linkHash))
+}
+
+// hashFields prefixes every field with its length, so that no two different lists of fields hash the same
+func hashFields(fields ...string) string {
+	h := sha256.New()
+	for _, f := range fields {
+		_, _ = fmt.Fprintf(h, "%d:%s", len(f), f)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
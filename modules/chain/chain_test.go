@@ -0,0 +1,89 @@
+package chain
+
+import (
+	"testing"
+
+	"github.com/Leantar/fimserver/models"
+)
+
+func TestHashFieldsSeparatesFields(t *testing.T) {
+	tests := []struct {
+		a, b []string
+	}{
+		{a: []string{"ab", "c"}, b: []string{"a", "bc"}},
+		{a: []string{"1:a"}, b: []string{"1", "a"}},
+		{a: []string{"", "a"}, b: []string{"a", ""}},
+		{a: []string{"a"}, b: []string{"a", ""}},
+	}
+
+	for _, tt := range tests {
+		if hashFields(tt.a...) == hashFields(tt.b...) {
+			t.Errorf("%q and %q hash the same", tt.a, tt.b)
+		}
+	}
+
+	if hashFields("a", "b") != hashFields("a", "b") {
+		t.Error("equal fields hash differently")
+	}
+}
+
+func TestLinkHash(t *testing.T) {
+	link := models.ChainLink{Source: SourceAlert, RowID: 1, AgentID: 2, RowHash: "abc"}
+	first := LinkHash("", link)
+
+	if LinkHash("", link) != first {
+		t.Error("link hash isn't deterministic")
+	}
+	if LinkHash(first, link) == first {
+		t.Error("link hash doesn't depend on the previous hash")
+	}
+
+	// The link's own ID isn't hashed, only what it refers to
+	withID := link
+	withID.ID = 7
+	if LinkHash("", withID) != first {
+		t.Error("link hash depends on the link ID")
+	}
+
+	for name, changed := range map[string]models.ChainLink{
+		"source":   {Source: SourceAudit, RowID: 1, AgentID: 2, RowHash: "abc"},
+		"row id":   {Source: SourceAlert, RowID: 3, AgentID: 2, RowHash: "abc"},
+		"agent id": {Source: SourceAlert, RowID: 1, AgentID: 3, RowHash: "abc"},
+		"row hash": {Source: SourceAlert, RowID: 1, AgentID: 2, RowHash: "abd"},
+	} {
+		if LinkHash("", changed) == first {
+			t.Errorf("link hash doesn't depend on the %s", name)
+		}
+	}
+}
+
+func TestAlertHashCoversDifferences(t *testing.T) {
+	al := models.Alert{
+		ID:          1,
+		Kind:        "CHANGE",
+		Severity:    "MEDIUM",
+		Difference:  "hash: aa -> bb",
+		Differences: []models.Difference{{Field: "hash", Before: "aa", After: "bb"}},
+		Path:        "/etc/passwd",
+		AgentID:     2,
+	}
+	hash := AlertHash(al)
+
+	changed := al
+	changed.Differences = []models.Difference{{Field: "hash", Before: "aa", After: "cc"}}
+	if AlertHash(changed) == hash {
+		t.Error("alert hash doesn't depend on the differences")
+	}
+
+	changed.Differences = nil
+	if AlertHash(changed) == hash {
+		t.Error("alert hash doesn't depend on the number of differences")
+	}
+
+	// Alerts read back from the database have an empty instead of a nil slice
+	empty := changed
+	empty.Differences = []models.Difference{}
+	if AlertHash(empty) != AlertHash(changed) {
+		t.Error("empty and missing differences hash differently")
+	}
+}
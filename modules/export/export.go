@@ -0,0 +1,55 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/Leantar/fimserver/modules/format"
+	"github.com/Leantar/fimserver/repository"
+)
+
+// Alerts writes the alerts of all agents to w, one rendered alert per line
+func Alerts(repo *repository.PgRepository, w io.Writer, formatName string) error {
+	ctx := context.Background()
+
+	formatter, err := format.Get(formatName)
+	if err != nil {
+		return err
+	}
+
+	agents, err := repo.Endpoints().GetAgents(ctx)
+	if err != nil {
+		if repo.IsEmptyResultSetError(err) {
+			return nil
+		}
+		return fmt.Errorf("export: %w", err)
+	}
+
+	bw := bufio.NewWriter(w)
+
+	for _, agent := range agents {
+		alerts, err := repo.Alerts().GetAllByAgent(ctx, agent.ID)
+		if err != nil {
+			if repo.IsEmptyResultSetError(err) {
+				continue
+			}
+			return fmt.Errorf("export: %w", err)
+		}
+
+		for _, al := range alerts {
+			line, err := formatter(al, agent.Name)
+			if err != nil {
+				return fmt.Errorf("export: %w", err)
+			}
+
+			_, err = bw.Write(append(line, '\n'))
+			if err != nil {
+				return fmt.Errorf("export: %w", err)
+			}
+		}
+	}
+
+	return bw.Flush()
+}
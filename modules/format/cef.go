@@ -0,0 +1,105 @@
+package format
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/alert"
+)
+
+const (
+	cefVendor  = "Leantar"
+	cefProduct = "fimserver"
+	cefVersion = "1.0"
+)
+
+var cefNames = map[string]string{
+	alert.KindCreate:    "File created",
+	alert.KindChange:    "File changed",
+	alert.KindDelete:    "File deleted",
+	alert.KindTimestomp: "File timestamps manipulated",
+	alert.KindSilent:    "Agent went silent",
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+// FormatCEF renders an alert as an ArcSight Common Event Format line
+func FormatCEF(al models.Alert, agentName string) ([]byte, error) {
+	name, ok := cefNames[al.Kind]
+	if !ok {
+		name = al.Kind
+	}
+
+	var ext []string
+	add := func(key, value string) {
+		ext = append(ext, key+"="+cefExtensionEscaper.Replace(value))
+	}
+
+	add("externalId", fmt.Sprint(al.ID))
+	add("rt", fmt.Sprint(al.IssuedAt*1000))
+	add("dhost", agentName)
+	// SILENT alerts have no path, and filepath.Base would turn it into "."
+	if al.Path != "" {
+		add("filePath", al.Path)
+		add("fname", filepath.Base(al.Path))
+	}
+	if al.Modified != 0 {
+		add("fileModificationTime", fmt.Sprint(al.Modified*1000))
+	}
+	if al.Difference != "" {
+		add("msg", al.Difference)
+	}
+
+	for _, diff := range al.Differences {
+		switch diff.Field {
+		case alert.FieldHash:
+			add("oldFileHash", diff.Before)
+			add("fileHash", diff.After)
+		case alert.FieldMode:
+			add("oldFilePermission", diff.Before)
+			add("filePermission", diff.After)
+		case alert.FieldOwner:
+			add("cs1Label", "oldOwner")
+			add("cs1", diff.Before)
+			add("cs2Label", "owner")
+			add("cs2", diff.After)
+		case alert.FieldCreated:
+			if diff.Before != "" {
+				add("oldFileCreateTime", fmt.Sprint(parseMillis(diff.Before)))
+			}
+			add("fileCreateTime", fmt.Sprint(parseMillis(diff.After)))
+		case alert.FieldModified:
+			if diff.Before != "" {
+				add("oldFileModificationTime", fmt.Sprint(parseMillis(diff.Before)))
+			}
+		}
+	}
+
+	line := fmt.Sprintf("CEF:0|%s|%s|%s|%s|%s|%d|%s",
+		cefHeaderEscaper.Replace(cefVendor),
+		cefHeaderEscaper.Replace(cefProduct),
+		cefHeaderEscaper.Replace(cefVersion),
+		cefHeaderEscaper.Replace(al.Kind),
+		cefHeaderEscaper.Replace(name),
+		cefSeverity(al.Severity),
+		strings.Join(ext, " "),
+	)
+
+	return []byte(line), nil
+}
+
+func cefSeverity(severity string) int {
+	switch severity {
+	case alert.SeverityHigh:
+		return 9
+	case alert.SeverityMedium:
+		return 6
+	default:
+		return 3
+	}
+}
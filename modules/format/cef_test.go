@@ -0,0 +1,96 @@
+package format
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/alert"
+)
+
+func TestFormatCEFEscapesExtensionValues(t *testing.T) {
+	al := models.Alert{
+		ID:       7,
+		Kind:     alert.KindChange,
+		Severity: alert.SeverityMedium,
+		// A crafted file name must not be able to add fields or lines
+		Path:       "/tmp/a=b\\c\nrt=0",
+		Difference: "hash: aa -> bb",
+		IssuedAt:   1,
+	}
+
+	b, err := FormatCEF(al, "agent|1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := string(b)
+
+	if strings.Contains(line, "\n") {
+		t.Errorf("line contains a newline: %q", line)
+	}
+	if !strings.Contains(line, `filePath=/tmp/a\=b\\c\nrt\=0`) {
+		t.Errorf("path isn't escaped: %q", line)
+	}
+	// Extension values only need = and \ escaped, so the pipe stays as it is
+	if !strings.Contains(line, "dhost=agent|1") {
+		t.Errorf("agent name is changed: %q", line)
+	}
+}
+
+func TestFormatCEFEscapesHeaderFields(t *testing.T) {
+	al := models.Alert{Kind: `X|Y\Z`, Severity: alert.SeverityLow}
+
+	b, err := FormatCEF(al, "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `CEF:0|Leantar|fimserver|1.0|X\|Y\\Z|X\|Y\\Z|3|`
+	if !strings.HasPrefix(string(b), want) {
+		t.Errorf("header = %q, want prefix %q", b, want)
+	}
+}
+
+func TestFormatCEFMapsDifferences(t *testing.T) {
+	al := models.Alert{
+		Kind:       alert.KindChange,
+		Severity:   alert.SeverityMedium,
+		Path:       "/etc/shadow",
+		Difference: "owner: 0:0 -> 1000:1000",
+		Differences: []models.Difference{
+			{Field: alert.FieldHash, Before: "aa", After: "bb"},
+			{Field: alert.FieldOwner, Before: "0:0", After: "1000:1000"},
+		},
+	}
+
+	b, err := FormatCEF(al, "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := string(b)
+
+	for _, field := range []string{
+		"oldFileHash=aa",
+		"fileHash=bb",
+		"cs1Label=oldOwner cs1=0:0",
+		"cs2Label=owner cs2=1000:1000",
+		"fname=shadow",
+	} {
+		if !strings.Contains(line, field) {
+			t.Errorf("%q is missing in %q", field, line)
+		}
+	}
+}
+
+func TestFormatCEFWithoutPath(t *testing.T) {
+	al := models.Alert{Kind: alert.KindSilent, Severity: alert.SeverityHigh, Difference: "last seen: 1 from 10.0.0.1"}
+
+	b, err := FormatCEF(al, "agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(b), "fname=") || strings.Contains(string(b), "filePath=") {
+		t.Errorf("alert without path has file fields: %q", b)
+	}
+}
@@ -0,0 +1,88 @@
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/Leantar/fimserver/models"
+)
+
+const (
+	JSON = "json"
+	CEF  = "cef"
+	OCSF = "ocsf"
+)
+
+// Formatter renders an alert of the named agent
+type Formatter func(al models.Alert, agentName string) ([]byte, error)
+
+// Get returns the formatter with the given name. JSON is used if name is empty.
+func Get(name string) (Formatter, error) {
+	switch name {
+	case "", JSON:
+		return FormatJSON, nil
+	case CEF:
+		return FormatCEF, nil
+	case OCSF:
+		return FormatOCSF, nil
+	default:
+		return nil, fmt.Errorf("format: unknown format '%s'", name)
+	}
+}
+
+// ContentType returns the MIME type of the rendered alerts of the named format
+func ContentType(name string) string {
+	if name == CEF {
+		return "text/plain"
+	}
+
+	return "application/json"
+}
+
+type jsonAlert struct {
+	ID          uint64           `json:"id"`
+	Agent       string           `json:"agent"`
+	Kind        string           `json:"kind"`
+	Severity    string           `json:"severity"`
+	Difference  string           `json:"difference"`
+	Differences []jsonDifference `json:"differences"`
+	Path        string           `json:"path"`
+	IssuedAt    int64            `json:"issued_at"`
+	Modified    int64            `json:"modified"`
+}
+
+type jsonDifference struct {
+	Field  string `json:"field"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after"`
+}
+
+func FormatJSON(al models.Alert, agentName string) ([]byte, error) {
+	diffs := make([]jsonDifference, 0)
+	for _, diff := range al.Differences {
+		diffs = append(diffs, jsonDifference(diff))
+	}
+
+	return json.Marshal(jsonAlert{
+		ID:          al.ID,
+		Agent:       agentName,
+		Kind:        al.Kind,
+		Severity:    al.Severity,
+		Difference:  al.Difference,
+		Differences: diffs,
+		Path:        al.Path,
+		IssuedAt:    al.IssuedAt,
+		Modified:    al.Modified,
+	})
+}
+
+// parseMillis converts a timestamp in seconds as found in alert differences to milliseconds
+func parseMillis(seconds string) int64 {
+	ts, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return ts * 1000
+}
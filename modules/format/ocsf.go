@@ -0,0 +1,186 @@
+package format
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/alert"
+)
+
+// Identifiers of the OCSF File System Activity class
+const (
+	ocsfVersion               = "1.0.0"
+	ocsfCategorySystem        = 1
+	ocsfClassFileActivity     = 1001
+	ocsfActivityCreate        = 1
+	ocsfActivityUpdate        = 3
+	ocsfActivityDelete        = 4
+	ocsfActivitySetAttributes = 6
+	ocsfActivitySetSecurity   = 7
+	ocsfActivityOther         = 99
+	ocsfFileTypeRegular       = 1
+	ocsfHashSHA256            = 3
+)
+
+type ocsfEvent struct {
+	ActivityID  int          `json:"activity_id"`
+	CategoryUID int          `json:"category_uid"`
+	ClassUID    int          `json:"class_uid"`
+	TypeUID     int          `json:"type_uid"`
+	SeverityID  int          `json:"severity_id"`
+	Severity    string       `json:"severity"`
+	Time        int64        `json:"time"`
+	Message     string       `json:"message,omitempty"`
+	FileDiff    string       `json:"file_diff,omitempty"`
+	File        ocsfFile     `json:"file"`
+	FileResult  *ocsfFile    `json:"file_result,omitempty"`
+	Device      ocsfDevice   `json:"device"`
+	Metadata    ocsfMetadata `json:"metadata"`
+	Unmapped    ocsfUnmapped `json:"unmapped"`
+}
+
+type ocsfFile struct {
+	Name         string     `json:"name"`
+	Path         string     `json:"path"`
+	TypeID       int        `json:"type_id"`
+	ModifiedTime int64      `json:"modified_time,omitempty"`
+	CreatedTime  int64      `json:"created_time,omitempty"`
+	Hashes       []ocsfHash `json:"hashes,omitempty"`
+	Owner        string     `json:"owner,omitempty"`
+	Attributes   string     `json:"attributes,omitempty"`
+}
+
+type ocsfHash struct {
+	AlgorithmID int    `json:"algorithm_id"`
+	Value       string `json:"value"`
+}
+
+type ocsfDevice struct {
+	Hostname string `json:"hostname"`
+	TypeID   int    `json:"type_id"`
+}
+
+type ocsfMetadata struct {
+	UID     string      `json:"uid"`
+	Version string      `json:"version"`
+	Product ocsfProduct `json:"product"`
+}
+
+type ocsfProduct struct {
+	Name       string `json:"name"`
+	VendorName string `json:"vendor_name"`
+	Version    string `json:"version"`
+}
+
+type ocsfUnmapped struct {
+	Kind string `json:"kind"`
+}
+
+// FormatOCSF renders an alert as an OCSF File System Activity event
+func FormatOCSF(al models.Alert, agentName string) ([]byte, error) {
+	severityID, severity := ocsfSeverity(al.Severity)
+	file := ocsfFile{
+		Path:         al.Path,
+		TypeID:       ocsfFileTypeRegular,
+		ModifiedTime: al.Modified * 1000,
+	}
+	if al.Path != "" {
+		file.Name = filepath.Base(al.Path)
+	}
+
+	event := ocsfEvent{
+		CategoryUID: ocsfCategorySystem,
+		ClassUID:    ocsfClassFileActivity,
+		SeverityID:  severityID,
+		Severity:    severity,
+		Time:        al.IssuedAt * 1000,
+		Message:     al.Difference,
+		FileDiff:    al.Difference,
+		Device: ocsfDevice{
+			Hostname: agentName,
+			TypeID:   0,
+		},
+		Metadata: ocsfMetadata{
+			UID:     strconv.FormatUint(al.ID, 10),
+			Version: ocsfVersion,
+			Product: ocsfProduct{
+				Name:       cefProduct,
+				VendorName: cefVendor,
+				Version:    cefVersion,
+			},
+		},
+		Unmapped: ocsfUnmapped{
+			Kind: al.Kind,
+		},
+	}
+
+	switch al.Kind {
+	case alert.KindCreate:
+		event.ActivityID = ocsfActivityCreate
+	case alert.KindDelete:
+		event.ActivityID = ocsfActivityDelete
+	case alert.KindTimestomp:
+		event.ActivityID = ocsfActivitySetAttributes
+	case alert.KindSilent:
+		event.ActivityID = ocsfActivityOther
+	default:
+		event.ActivityID = ocsfActivityUpdate
+	}
+
+	if len(al.Differences) > 0 {
+		// file describes the object before and file_result after the change
+		result := file
+		for _, diff := range al.Differences {
+			switch diff.Field {
+			case alert.FieldHash:
+				file.Hashes = []ocsfHash{{AlgorithmID: ocsfHashSHA256, Value: diff.Before}}
+				result.Hashes = []ocsfHash{{AlgorithmID: ocsfHashSHA256, Value: diff.After}}
+			case alert.FieldOwner:
+				file.Owner = diff.Before
+				result.Owner = diff.After
+				if al.Kind == alert.KindChange {
+					event.ActivityID = ocsfActivitySetSecurity
+				}
+			case alert.FieldMode:
+				file.Attributes = diff.Before
+				result.Attributes = diff.After
+				if al.Kind == alert.KindChange {
+					event.ActivityID = ocsfActivitySetSecurity
+				}
+			case alert.FieldCreated:
+				file.CreatedTime = parseMillis(diff.Before)
+				result.CreatedTime = parseMillis(diff.After)
+				if al.Kind == alert.KindChange {
+					event.ActivityID = ocsfActivitySetAttributes
+				}
+			case alert.FieldModified:
+				file.ModifiedTime = parseMillis(diff.Before)
+				result.ModifiedTime = parseMillis(diff.After)
+				if al.Kind == alert.KindChange {
+					event.ActivityID = ocsfActivitySetAttributes
+				}
+			}
+		}
+		event.File = file
+		event.FileResult = &result
+	} else {
+		event.File = file
+	}
+
+	event.TypeUID = event.ClassUID*100 + event.ActivityID
+
+	return json.Marshal(event)
+}
+
+func ocsfSeverity(severity string) (int, string) {
+	switch severity {
+	case alert.SeverityHigh:
+		return 4, "High"
+	case alert.SeverityMedium:
+		return 3, "Medium"
+	default:
+		return 2, "Low"
+	}
+}
@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+const namespace = "fim"
+
+var (
+	RPCs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rpcs_total",
+		Help:      "Number of handled RPCs by method and status code.",
+	}, []string{"method", "code"})
+
+	AuthenticationFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authentication_failures_total",
+		Help:      "Number of requests that failed authentication.",
+	})
+
+	AuthorizationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authorization_failures_total",
+		Help:      "Number of requests that were denied by the casbin policy by method.",
+	}, []string{"method"})
+
+	AlertsCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "alerts_created_total",
+		Help:      "Number of stored alerts by kind.",
+	}, []string{"kind"})
+
+	BaselineUploadSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "baseline_upload_objects",
+		Help:      "Number of fs objects per uploaded baseline by operation.",
+		Buckets:   prometheus.ExponentialBuckets(100, 4, 8),
+	}, []string{"operation"})
+
+	BaselineUploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "baseline_upload_duration_seconds",
+		Help:      "Duration of baseline uploads by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"operation"})
+
+	CompareDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "fs_status_compare_duration_seconds",
+		Help:      "Time spent comparing a reported fs status with the baseline.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+
+	QueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Latency of database queries by repository method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+)
+
+// ObserveQuery records the latency of a repository method. It is meant to be deferred at the start of the method.
+func ObserveQuery(method string, start time.Time) {
+	QueryDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// RegisterAgentStates exports the number of agents in each baseline state. count is called on every scrape.
+func RegisterAgentStates(count func(ctx context.Context) (map[string]uint64, error)) {
+	prometheus.MustRegister(&agentStateCollector{count: count})
+}
+
+type agentStateCollector struct {
+	count func(ctx context.Context) (map[string]uint64, error)
+}
+
+var agentStatesDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "agents"),
+	"Number of agents by baseline state.",
+	[]string{"state"}, nil,
+)
+
+func (c *agentStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- agentStatesDesc
+}
+
+func (c *agentStateCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	states, err := c.count(ctx)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to count agent states")
+		ch <- prometheus.NewInvalidMetric(agentStatesDesc, err)
+		return
+	}
+
+	for state, n := range states {
+		ch <- prometheus.MustNewConstMetric(agentStatesDesc, prometheus.GaugeValue, float64(n), state)
+	}
+}
+
+type Config struct {
+	Host string `yaml:"host"`
+	// The metrics listener is disabled if no port is configured
+	Port int64 `yaml:"port"`
+}
+
+type Server struct {
+	srv  *http.Server
+	conf Config
+}
+
+func NewServer(conf Config) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return &Server{
+		srv: &http.Server{
+			Addr:    net.JoinHostPort(conf.Host, strconv.FormatInt(conf.Port, 10)),
+			Handler: mux,
+		},
+		conf: conf,
+	}
+}
+
+func (s *Server) Run() error {
+	if s.conf.Port == 0 {
+		log.Info().Msg("no metrics port configured. metrics listener is disabled")
+		return nil
+	}
+
+	log.Info().Msgf("serving metrics on: %s", s.srv.Addr)
+	err := s.srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *Server) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_ = s.srv.Shutdown(ctx)
+}
@@ -0,0 +1,279 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/format"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	pollInterval   = 5 * time.Second
+	requestTimeout = 10 * time.Second
+	initialBackoff = 5 * time.Second
+	maxBackoff     = time.Hour
+	batchSize      = 10
+	// Claimed messages are hidden from other instances for this duration. It outlasts a batch in which every request
+	// times out, so that no message is claimed again while it is still being sent
+	leaseDuration      = 2 * batchSize * requestTimeout
+	defaultMaxAttempts = 20
+)
+
+type OutboxRepository interface {
+	Create(ctx context.Context, msg Message) error
+	Claim(ctx context.Context, now, leaseUntil int64, limit int) ([]Message, error)
+	Reschedule(ctx context.Context, id uint64, attempts uint32, nextAttempt int64) error
+	Delete(ctx context.Context, id uint64) error
+}
+
+type Config struct {
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+	// Messages are dropped after this many failed deliveries. Defaults to 20
+	MaxAttempts uint32 `yaml:"max_attempts"`
+}
+
+type WebhookConfig struct {
+	Name   string `yaml:"name"`
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
+	// One of json, cef or ocsf. Defaults to json
+	Format string `yaml:"format"`
+	// Only alerts of these agents are sent. All agents match if empty
+	Agents []string `yaml:"agents"`
+	// Only alerts of these kinds are sent. All kinds match if empty
+	Kinds []string `yaml:"kinds"`
+	// Send digest reports to this webhook
+	Digests bool `yaml:"digests"`
+}
+
+// Message is a single pending delivery of a payload to a webhook
+type Message struct {
+	ID          uint64
+	Webhook     string
+	Payload     []byte
+	ContentType string
+	Attempts    uint32
+	NextAttempt int64
+}
+
+type Notifier struct {
+	repo        OutboxRepository
+	webhooks    map[string]WebhookConfig
+	formatters  map[string]format.Formatter
+	maxAttempts uint32
+	client      *http.Client
+	quit        chan struct{}
+}
+
+func New(conf Config, repo OutboxRepository) (*Notifier, error) {
+	webhooks := make(map[string]WebhookConfig)
+	formatters := make(map[string]format.Formatter)
+	for _, wh := range conf.Webhooks {
+		formatter, err := format.Get(wh.Format)
+		if err != nil {
+			return nil, fmt.Errorf("notifier: webhook '%s': %w", wh.Name, err)
+		}
+
+		webhooks[wh.Name] = wh
+		formatters[wh.Name] = formatter
+	}
+
+	if conf.MaxAttempts == 0 {
+		conf.MaxAttempts = defaultMaxAttempts
+	}
+
+	return &Notifier{
+		repo:        repo,
+		webhooks:    webhooks,
+		formatters:  formatters,
+		maxAttempts: conf.MaxAttempts,
+		client:      &http.Client{Timeout: requestTimeout},
+		quit:        make(chan struct{}),
+	}, nil
+}
+
+// AlertMessages returns a message for every webhook that is interested in the alert. The caller stores them in the
+// transaction that stores the alert, and Run delivers them asynchronously.
+func (n *Notifier) AlertMessages(al models.Alert, agentName string) ([]Message, error) {
+	msgs := make([]Message, 0)
+	for _, wh := range n.webhooks {
+		if !contains(wh.Agents, agentName) || !contains(wh.Kinds, al.Kind) {
+			continue
+		}
+
+		payload, err := n.formatters[wh.Name](al, agentName)
+		if err != nil {
+			return nil, fmt.Errorf("notifier: %w", err)
+		}
+
+		msgs = append(msgs, Message{
+			Webhook:     wh.Name,
+			Payload:     payload,
+			ContentType: format.ContentType(wh.Format),
+			NextAttempt: time.Now().Unix(),
+		})
+	}
+
+	return msgs, nil
+}
+
+// NotifyDigest stores a message with a JSON encoded digest report for every webhook that accepts digests
+func (n *Notifier) NotifyDigest(ctx context.Context, payload []byte) error {
+	for _, wh := range n.webhooks {
+		if !wh.Digests {
+			continue
+		}
+
+		err := n.repo.Create(ctx, Message{
+			Webhook:     wh.Name,
+			Payload:     payload,
+			ContentType: "application/json",
+			NextAttempt: time.Now().Unix(),
+		})
+		if err != nil {
+			return fmt.Errorf("notifier: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Run delivers pending messages until Stop is called
+func (n *Notifier) Run() {
+	if len(n.webhooks) == 0 {
+		log.Info().Msg("no webhooks configured. notifier is disabled")
+		return
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-ticker.C:
+			n.deliverPending()
+		}
+	}
+}
+
+func (n *Notifier) Stop() {
+	close(n.quit)
+}
+
+func (n *Notifier) deliverPending() {
+	ctx := context.Background()
+	now := time.Now()
+
+	msgs, err := n.repo.Claim(ctx, now.Unix(), now.Add(leaseDuration).Unix(), batchSize)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to claim notifications")
+		return
+	}
+
+	for _, msg := range msgs {
+		err = n.deliver(ctx, msg)
+		if err != nil {
+			log.Error().Caller().Err(err).Msg("failed to update notification")
+		}
+	}
+}
+
+// deliver sends a claimed message and deletes it on success. Failed messages are rescheduled with backoff until they
+// reach the maximum number of attempts
+func (n *Notifier) deliver(ctx context.Context, msg Message) error {
+	wh, ok := n.webhooks[msg.Webhook]
+	if !ok {
+		log.Warn().Msgf("dropping notification %d for unknown webhook '%s'", msg.ID, msg.Webhook)
+		return n.repo.Delete(ctx, msg.ID)
+	}
+
+	sendErr := n.send(ctx, wh, msg)
+	if sendErr == nil {
+		return n.repo.Delete(ctx, msg.ID)
+	}
+
+	attempts := msg.Attempts + 1
+	if attempts >= n.maxAttempts {
+		log.Error().Err(sendErr).Msgf("dropping notification %d for webhook '%s' after %d failed attempts", msg.ID, wh.Name, attempts)
+		return n.repo.Delete(ctx, msg.ID)
+	}
+
+	log.Warn().Err(sendErr).Msgf("failed to deliver notification %d to webhook '%s'", msg.ID, wh.Name)
+
+	return n.repo.Reschedule(ctx, msg.ID, attempts, time.Now().Add(backoff(msg.Attempts)).Unix())
+}
+
+func (n *Notifier) send(ctx context.Context, wh WebhookConfig, msg Message) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(msg.Payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", msg.ContentType)
+	req.Header.Set("X-Fim-Delivery", strconv.FormatUint(msg.ID, 10))
+	if wh.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Fim-Timestamp", timestamp)
+		req.Header.Set("X-Fim-Signature", "sha256="+sign(timestamp, msg.Payload, wh.Secret))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// sign returns the HMAC of the timestamp and the payload, separated by a dot. Receivers reject old timestamps, so that a
+// captured request can't be replayed
+func sign(timestamp string, payload []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func backoff(attempts uint32) time.Duration {
+	delay := initialBackoff
+	for i := uint32(0); i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > maxBackoff {
+		return maxBackoff
+	}
+
+	return delay
+}
+
+func contains(filter []string, value string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+
+	for _, f := range filter {
+		if f == value {
+			return true
+		}
+	}
+
+	return false
+}
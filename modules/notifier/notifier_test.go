@@ -0,0 +1,152 @@
+package notifier
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testOutbox records what the notifier does with the messages it claimed
+type testOutbox struct {
+	pending     []Message
+	leaseUntil  int64
+	limit       int
+	deleted     []uint64
+	rescheduled map[uint64]uint32
+}
+
+func (o *testOutbox) Create(context.Context, Message) error { return nil }
+
+func (o *testOutbox) Claim(_ context.Context, _, leaseUntil int64, limit int) ([]Message, error) {
+	o.leaseUntil = leaseUntil
+	o.limit = limit
+	return o.pending, nil
+}
+
+func (o *testOutbox) Reschedule(_ context.Context, id uint64, attempts uint32, _ int64) error {
+	o.rescheduled[id] = attempts
+	return nil
+}
+
+func (o *testOutbox) Delete(_ context.Context, id uint64) error {
+	o.deleted = append(o.deleted, id)
+	return nil
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts uint32
+		want     time.Duration
+	}{
+		{attempts: 0, want: initialBackoff},
+		{attempts: 1, want: 2 * initialBackoff},
+		{attempts: 3, want: 8 * initialBackoff},
+		{attempts: 10, want: maxBackoff},
+		{attempts: 1 << 31, want: maxBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	payload := []byte(`{"id":1}`)
+	sig := sign("1650000000", payload, "secret")
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1650000000." + string(payload)))
+	if want := hex.EncodeToString(mac.Sum(nil)); sig != want {
+		t.Errorf("sign() = %s, want %s", sig, want)
+	}
+
+	if sign("1650000001", payload, "secret") == sig {
+		t.Error("signature doesn't depend on the timestamp")
+	}
+	if sign("1650000000", payload, "other") == sig {
+		t.Error("signature doesn't depend on the secret")
+	}
+}
+
+func TestLeaseOutlastsBatch(t *testing.T) {
+	if leaseDuration <= batchSize*requestTimeout {
+		t.Errorf("lease of %s is shorter than a batch of %d timed out requests", leaseDuration, batchSize)
+	}
+}
+
+func TestDeliverPending(t *testing.T) {
+	var requests []*http.Request
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r)
+		bodies = append(bodies, string(body))
+
+		if string(body) == "fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	n, err := New(Config{
+		Webhooks:    []WebhookConfig{{Name: "siem", URL: srv.URL, Secret: "secret"}},
+		MaxAttempts: 3,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outbox := &testOutbox{
+		pending: []Message{
+			{ID: 1, Webhook: "siem", Payload: []byte("ok"), ContentType: "application/json"},
+			{ID: 2, Webhook: "siem", Payload: []byte("fail"), ContentType: "application/json", Attempts: 0},
+			{ID: 3, Webhook: "siem", Payload: []byte("fail"), ContentType: "application/json", Attempts: 2},
+			{ID: 4, Webhook: "removed", Payload: []byte("ok"), ContentType: "application/json"},
+		},
+		rescheduled: make(map[uint64]uint32),
+	}
+	n.repo = outbox
+
+	before := time.Now()
+	n.deliverPending()
+
+	if outbox.limit != batchSize {
+		t.Errorf("claimed %d messages, want %d", outbox.limit, batchSize)
+	}
+	if outbox.leaseUntil < before.Add(leaseDuration).Unix() {
+		t.Errorf("lease ends at %d, before %s from now", outbox.leaseUntil, leaseDuration)
+	}
+
+	// Successful, exhausted and orphaned messages are removed. The others are retried
+	wantDeleted := []uint64{1, 3, 4}
+	if len(outbox.deleted) != len(wantDeleted) {
+		t.Fatalf("deleted %v, want %v", outbox.deleted, wantDeleted)
+	}
+	for i, id := range wantDeleted {
+		if outbox.deleted[i] != id {
+			t.Fatalf("deleted %v, want %v", outbox.deleted, wantDeleted)
+		}
+	}
+	if len(outbox.rescheduled) != 1 || outbox.rescheduled[2] != 1 {
+		t.Errorf("rescheduled %v, want message 2 with 1 attempt", outbox.rescheduled)
+	}
+
+	if len(requests) != 3 {
+		t.Fatalf("sent %d requests, want 3", len(requests))
+	}
+	for i, r := range requests {
+		timestamp := r.Header.Get("X-Fim-Timestamp")
+		want := "sha256=" + sign(timestamp, []byte(bodies[i]), "secret")
+		if timestamp == "" || r.Header.Get("X-Fim-Signature") != want {
+			t.Errorf("request %d has timestamp %q and signature %q, want %q", i, timestamp, r.Header.Get("X-Fim-Signature"), want)
+		}
+	}
+}
@@ -2,158 +2,441 @@ package preparation
 
 import (
 	"context"
+	_ "embed"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/Leantar/fimserver/models"
 	casbinadapter "github.com/Leantar/fimserver/modules/casbin"
+	"github.com/Leantar/fimserver/modules/config"
+	"github.com/Leantar/fimserver/modules/validation"
 	"github.com/Leantar/fimserver/repository"
 	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
 )
 
-func Setup(repo *repository.PgRepository) error {
-	err := repo.ApplySchema()
-	if err != nil {
-		return fmt.Errorf("schema: %w", err)
+//go:embed bootstrap.yaml
+var defaultBootstrap []byte
+
+const (
+	ActionAdd    = "+"
+	ActionRemove = "-"
+	ActionUpdate = "~"
+)
+
+// Bootstrap declares the casbin policy and endpoints. Sections that are omitted are not managed.
+// Endpoints that exist in the database but aren't declared are left alone.
+type Bootstrap struct {
+	Policies []PolicyConfig `yaml:"policies"`
+	Clients  []ClientConfig `yaml:"clients"`
+	Agents   []AgentConfig  `yaml:"agents"`
+}
+
+type PolicyConfig struct {
+	SubjectRule string   `yaml:"subject_rule"`
+	Rpcs        []string `yaml:"rpcs"`
+}
+
+type ClientConfig struct {
+	Name        string   `yaml:"name"`
+	Roles       []string `yaml:"roles"`
+	Credentials `yaml:",inline"`
+}
+
+type AgentConfig struct {
+	Name         string   `yaml:"name"`
+	WatchedPaths []string `yaml:"watched_paths"`
+	Credentials  `yaml:",inline"`
+}
+
+// Credentials are only managed if declared, so that pins set by enrollment or at runtime aren't removed
+type Credentials struct {
+	CertPins    []string `yaml:"cert_pins"`
+	URIIdentity *string  `yaml:"uri_identity"`
+}
+
+// Change describes a difference between the bootstrap file and the database that was applied
+type Change struct {
+	Action string
+	Kind   string
+	Name   string
+	Detail string
+}
+
+func (c Change) String() string {
+	if c.Detail == "" {
+		return fmt.Sprintf("%s %s '%s'", c.Action, c.Kind, c.Name)
 	}
 
-	err = createCasbinPolicy(repo)
-	if err != nil {
-		return fmt.Errorf("schema: %w", err)
+	return fmt.Sprintf("%s %s '%s': %s", c.Action, c.Kind, c.Name, c.Detail)
+}
+
+// LoadBootstrap reads and validates the bootstrap file at path. The built-in default is used if path is empty.
+func LoadBootstrap(path string) (Bootstrap, error) {
+	var b Bootstrap
+
+	if path == "" {
+		err := yaml.Unmarshal(defaultBootstrap, &b)
+		if err != nil {
+			return Bootstrap{}, fmt.Errorf("bootstrap: %w", err)
+		}
+	} else {
+		err := config.FromYamlFile(path, &b)
+		if err != nil {
+			return Bootstrap{}, fmt.Errorf("bootstrap: %w", err)
+		}
+	}
+
+	for _, p := range b.Policies {
+		for _, rpc := range p.Rpcs {
+			err := validation.PolicyRule(p.SubjectRule, rpc)
+			if err != nil {
+				return Bootstrap{}, fmt.Errorf("bootstrap: policy '%s': %w", p.SubjectRule, err)
+			}
+		}
+	}
+
+	for i := range b.Clients {
+		err := b.Clients[i].Credentials.normalize()
+		if err != nil {
+			return Bootstrap{}, fmt.Errorf("bootstrap: client '%s': %w", b.Clients[i].Name, err)
+		}
+	}
+	for i := range b.Agents {
+		err := b.Agents[i].Credentials.normalize()
+		if err != nil {
+			return Bootstrap{}, fmt.Errorf("bootstrap: agent '%s': %w", b.Agents[i].Name, err)
+		}
 	}
 
-	err = createAdminUser(repo)
+	names := make(map[string]bool)
+	for _, name := range b.endpointNames() {
+		if name == "" {
+			return Bootstrap{}, errors.New("bootstrap: endpoint name must not be empty")
+		}
+		if names[name] {
+			return Bootstrap{}, fmt.Errorf("bootstrap: endpoint '%s' is declared more than once", name)
+		}
+		names[name] = true
+	}
+
+	return b, nil
+}
+
+func (c *Credentials) normalize() error {
+	for i, pin := range c.CertPins {
+		normalized, err := validation.NormalizeCertPin(pin)
+		if err != nil {
+			return err
+		}
+		c.CertPins[i] = normalized
+	}
+
+	if c.URIIdentity != nil && *c.URIIdentity != "" {
+		return validation.URIIdentity(*c.URIIdentity)
+	}
+
+	return nil
+}
+
+// apply returns the credentials of ep with the declared ones replaced
+func (c Credentials) apply(ep models.Endpoint) ([]string, string) {
+	pins := ep.CertPins
+	if pins == nil {
+		pins = []string{}
+	}
+	if c.CertPins != nil {
+		pins = c.CertPins
+	}
+
+	uri := ep.URIIdentity
+	if c.URIIdentity != nil {
+		uri = *c.URIIdentity
+	}
+
+	return pins, uri
+}
+
+func (b Bootstrap) endpointNames() []string {
+	names := make([]string, 0, len(b.Clients)+len(b.Agents))
+	for _, c := range b.Clients {
+		names = append(names, c.Name)
+	}
+	for _, a := range b.Agents {
+		names = append(names, a.Name)
+	}
+
+	return names
+}
+
+// Setup creates all relations inside the database and applies the bootstrap file
+func Setup(repo *repository.PgRepository, b Bootstrap) ([]Change, error) {
+	changes, err := Reconcile(repo, b, false)
 	if err != nil {
-		return fmt.Errorf("schema: %w", err)
+		return nil, err
 	}
 
 	log.Info().Msg("finished setup. please restart without setup mode")
 
-	return nil
+	return changes, nil
 }
 
-func createCasbinPolicy(repo *repository.PgRepository) error {
+// errDryRun rolls back the transaction of a dry run
+var errDryRun = errors.New("dry run")
+
+// Reconcile migrates the schema, makes the database match the bootstrap file and returns the changes. Nothing is
+// written if dryRun is set. All changes are made in one transaction, so a failure leaves the database as it was.
+// Running servers pick up policy changes through their casbin watcher.
+func Reconcile(repo *repository.PgRepository, b Bootstrap, dryRun bool) ([]Change, error) {
 	ctx := context.Background()
+	changes := make([]Change, 0)
+
+	err := repo.InTx(ctx, func(tx *repository.PgTx) error {
+		// A dry run migrates too, because the bootstrap file can only be compared with the current schema. The
+		// migrations are rolled back with everything else.
+		migrations, err := tx.Migrate(ctx)
+		if err != nil {
+			return fmt.Errorf("schema: %w", err)
+		}
+		for _, name := range migrations {
+			changes = append(changes, Change{Action: ActionAdd, Kind: "migration", Name: name})
+		}
+
+		if b.Policies != nil {
+			c, err := reconcilePolicies(ctx, tx, b.Policies, dryRun)
+			if err != nil {
+				return fmt.Errorf("policies: %w", err)
+			}
+			changes = append(changes, c...)
+		}
+
+		for _, client := range b.Clients {
+			c, err := reconcileClient(ctx, tx, client, dryRun)
+			if err != nil {
+				return fmt.Errorf("client '%s': %w", client.Name, err)
+			}
+			changes = append(changes, c...)
+		}
+
+		for _, agent := range b.Agents {
+			c, err := reconcileAgent(ctx, tx, agent, dryRun)
+			if err != nil {
+				return fmt.Errorf("agent '%s': %w", agent.Name, err)
+			}
+			changes = append(changes, c...)
+		}
+
+		if dryRun {
+			return errDryRun
+		}
 
-	err := repo.Rules().Create(ctx, casbinadapter.Rule{
-		PType: "p",
-		V0:    "r.sub.Kind == \"agent\"",
-		V1:    "GetStartupInfo",
+		return nil
 	})
-	if err != nil {
-		return err
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
 	}
 
-	err = repo.Rules().Create(context.Background(), casbinadapter.Rule{
-		PType: "p",
-		V0:    "r.sub.Kind == \"agent\" && r.sub.HasBaseline == false",
-		V1:    "CreateBaseline",
-	})
-	if err != nil {
-		return err
+	return changes, nil
+}
+
+func reconcilePolicies(ctx context.Context, repo *repository.PgTx, policies []PolicyConfig, dryRun bool) ([]Change, error) {
+	changes := make([]Change, 0)
+
+	current, err := repo.Rules().GetAll(ctx)
+	if err != nil && !repo.IsEmptyResultSetError(err) {
+		return nil, err
 	}
 
-	err = repo.Rules().Create(context.Background(), casbinadapter.Rule{
-		PType: "p",
-		V0:    "r.sub.Kind == \"agent\" && r.sub.HasBaseline == true && r.sub.BaselineIsCurrent == false",
-		V1:    "UpdateBaseline",
-	})
-	if err != nil {
-		return err
+	desired := make(map[casbinadapter.Rule]bool)
+	for _, p := range policies {
+		for _, rpc := range p.Rpcs {
+			desired[casbinadapter.Rule{PType: "p", V0: p.SubjectRule, V1: rpc}] = true
+		}
 	}
 
-	err = repo.Rules().Create(context.Background(), casbinadapter.Rule{
-		PType: "p",
-		V0:    "r.sub.Kind == \"agent\"",
-		V1:    "ReportFsStatus",
-	})
-	if err != nil {
-		return err
+	existing := make(map[casbinadapter.Rule]bool)
+	for _, rule := range current {
+		existing[rule] = true
+		if rule.PType != "p" || desired[rule] {
+			continue
+		}
+
+		changes = append(changes, Change{Action: ActionRemove, Kind: "policy", Name: rule.V1, Detail: rule.V0})
+		if !dryRun {
+			err := repo.Rules().Delete(ctx, rule)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	err = repo.Rules().Create(context.Background(), casbinadapter.Rule{
-		PType: "p",
-		V0:    "r.sub.Kind == \"agent\"",
-		V1:    "ReportFsEvent",
-	})
-	if err != nil {
-		return err
+	for _, p := range policies {
+		for _, rpc := range p.Rpcs {
+			rule := casbinadapter.Rule{PType: "p", V0: p.SubjectRule, V1: rpc}
+			if existing[rule] {
+				continue
+			}
+			// Prevents duplicates within the file from being created twice
+			existing[rule] = true
+
+			changes = append(changes, Change{Action: ActionAdd, Kind: "policy", Name: rpc, Detail: p.SubjectRule})
+			if !dryRun {
+				err := repo.Rules().Create(ctx, rule)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
 	}
 
-	err = repo.Rules().Create(context.Background(), casbinadapter.Rule{
-		PType: "p",
-		V0:    "r.sub.Kind == \"client\" && \"viewer\" in r.sub.Roles",
-		V1:    "GetAgents",
-	})
-	if err != nil {
-		return err
+	return changes, nil
+}
+
+func reconcileClient(ctx context.Context, repo *repository.PgTx, client ClientConfig, dryRun bool) ([]Change, error) {
+	roles := client.Roles
+	if roles == nil {
+		roles = []string{}
 	}
 
-	err = repo.Rules().Create(context.Background(), casbinadapter.Rule{
-		PType: "p",
-		V0:    "r.sub.Kind == \"client\" && \"viewer\" in r.sub.Roles",
-		V1:    "GetAlertsByAgent",
-	})
+	ep, err := repo.Endpoints().GetByName(ctx, client.Name)
+	if repo.IsEmptyResultSetError(err) {
+		pins, uri := client.apply(models.Endpoint{})
+		change := Change{Action: ActionAdd, Kind: "client", Name: client.Name, Detail: fmt.Sprintf("roles %v", roles)}
+		if !dryRun {
+			err = repo.Endpoints().Create(ctx, models.Endpoint{
+				Name:              client.Name,
+				Kind:              "client",
+				Roles:             roles,
+				HasBaseline:       false,
+				BaselineIsCurrent: false,
+				WatchedPaths:      []string{},
+				CertPins:          pins,
+				URIIdentity:       uri,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return []Change{change}, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = repo.Rules().Create(context.Background(), casbinadapter.Rule{
-		PType: "p",
-		V0:    "r.sub.Kind == \"client\" && \"approver\" in r.sub.Roles",
-		V1:    "CreateBaselineUpdateApproval",
-	})
-	if err != nil {
-		return err
+	if ep.Kind != "client" {
+		return nil, fmt.Errorf("endpoint exists as %s", ep.Kind)
 	}
 
-	err = repo.Rules().Create(context.Background(), casbinadapter.Rule{
-		PType: "p",
-		V0:    "r.sub.Kind == \"client\" && \"user_admin\" in r.sub.Roles",
-		V1:    "CreateAgentEndpoint",
-	})
+	changes, err := reconcileCredentials(ctx, repo, "client", ep, client.Credentials, dryRun)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = repo.Rules().Create(context.Background(), casbinadapter.Rule{
-		PType: "p",
-		V0:    "r.sub.Kind == \"client\" && \"user_admin\" in r.sub.Roles",
-		V1:    "CreateClientEndpoint",
-	})
+	if sameSet(ep.Roles, roles) {
+		return changes, nil
+	}
+
+	changes = append(changes, Change{Action: ActionUpdate, Kind: "client", Name: client.Name, Detail: fmt.Sprintf("roles %v -> %v", ep.Roles, roles)})
+	if !dryRun {
+		err = repo.Endpoints().UpdateRoles(ctx, ep.ID, roles)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return changes, nil
+}
+
+func reconcileAgent(ctx context.Context, repo *repository.PgTx, agent AgentConfig, dryRun bool) ([]Change, error) {
+	paths := agent.WatchedPaths
+	if paths == nil {
+		paths = []string{}
+	}
+
+	ep, err := repo.Endpoints().GetByName(ctx, agent.Name)
+	if repo.IsEmptyResultSetError(err) {
+		pins, uri := agent.apply(models.Endpoint{})
+		change := Change{Action: ActionAdd, Kind: "agent", Name: agent.Name, Detail: fmt.Sprintf("watched paths %v", paths)}
+		if !dryRun {
+			err = repo.Endpoints().Create(ctx, models.Endpoint{
+				Name:              agent.Name,
+				Kind:              "agent",
+				Roles:             []string{},
+				HasBaseline:       false,
+				BaselineIsCurrent: false,
+				WatchedPaths:      paths,
+				CertPins:          pins,
+				URIIdentity:       uri,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return []Change{change}, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = repo.Rules().Create(context.Background(), casbinadapter.Rule{
-		PType: "p",
-		V0:    "r.sub.Kind == \"client\" && \"user_admin\" in r.sub.Roles",
-		V1:    "DeleteEndpoint",
-	})
+	if ep.Kind != "agent" {
+		return nil, fmt.Errorf("endpoint exists as %s", ep.Kind)
+	}
+
+	changes, err := reconcileCredentials(ctx, repo, "agent", ep, agent.Credentials, dryRun)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = repo.Rules().Create(context.Background(), casbinadapter.Rule{
-		PType: "p",
-		V0:    "r.sub.Kind == \"client\" && \"user_admin\" in r.sub.Roles",
-		V1:    "UpdateEndpointWatchedPaths",
-	})
+	if sameSet(ep.WatchedPaths, paths) {
+		return changes, nil
+	}
+
+	changes = append(changes, Change{Action: ActionUpdate, Kind: "agent", Name: agent.Name, Detail: fmt.Sprintf("watched paths %v -> %v", ep.WatchedPaths, paths)})
+	if !dryRun {
+		err = repo.Endpoints().UpdateWatchedPaths(ctx, ep.ID, paths)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return changes, nil
+}
+
+func reconcileCredentials(ctx context.Context, repo *repository.PgTx, kind string, ep models.Endpoint, creds Credentials, dryRun bool) ([]Change, error) {
+	pins, uri := creds.apply(ep)
+
+	changes := make([]Change, 0)
+	if !sameSet(ep.CertPins, pins) {
+		changes = append(changes, Change{Action: ActionUpdate, Kind: kind, Name: ep.Name, Detail: fmt.Sprintf("%d cert pins -> %d", len(ep.CertPins), len(pins))})
+	}
+	if ep.URIIdentity != uri {
+		changes = append(changes, Change{Action: ActionUpdate, Kind: kind, Name: ep.Name, Detail: fmt.Sprintf("uri identity '%s' -> '%s'", ep.URIIdentity, uri)})
+	}
+
+	if len(changes) == 0 || dryRun {
+		return changes, nil
+	}
+
+	err := repo.Endpoints().UpdateCredentials(ctx, ep.ID, pins, uri)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return changes, nil
 }
 
-func createAdminUser(repo *repository.PgRepository) error {
-	ctx := context.Background()
+// sameSet reports whether a and b contain the same strings, regardless of their order
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
 
-	return repo.Endpoints().Create(ctx, models.Endpoint{
-		Name:              "admin",
-		Kind:              "client",
-		Roles:             []string{"viewer", "approver", "user_admin"},
-		HasBaseline:       false,
-		BaselineIsCurrent: false,
-		WatchedPaths:      []string{},
-	})
+	sa := append([]string(nil), a...)
+	sb := append([]string(nil), b...)
+	sort.Strings(sa)
+	sort.Strings(sb)
+
+	return strings.Join(sa, "\x00") == strings.Join(sb, "\x00")
 }
@@ -0,0 +1,144 @@
+package preparation
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Leantar/fimserver/models"
+)
+
+const testPin = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func writeBootstrap(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "bootstrap.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDefaultBootstrap(t *testing.T) {
+	b, err := LoadBootstrap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Policies) == 0 {
+		t.Error("default bootstrap declares no policies")
+	}
+}
+
+func TestLoadBootstrap(t *testing.T) {
+	path := writeBootstrap(t, `
+policies:
+    - subject_rule: 'r.sub.Kind == "agent"'
+      rpcs: [GetStartupInfo]
+clients:
+    - name: admin
+      roles: [user_admin]
+      cert_pins: ['`+strings.ToUpper(testPin)+`']
+agents:
+    - name: web01
+      watched_paths: [/etc]
+      uri_identity: spiffe://example.org/agent/web01
+`)
+
+	b, err := LoadBootstrap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := b.Clients[0].CertPins; !reflect.DeepEqual(got, []string{testPin}) {
+		t.Errorf("cert pins = %v, want them normalized", got)
+	}
+	if got := b.endpointNames(); !reflect.DeepEqual(got, []string{"admin", "web01"}) {
+		t.Errorf("endpoint names = %v", got)
+	}
+}
+
+func TestLoadBootstrapRejectsInvalidFiles(t *testing.T) {
+	tests := map[string]string{
+		"unknown rpc": `
+policies:
+    - subject_rule: 'r.sub.Kind == "agent"'
+      rpcs: [DropDatabase]`,
+		"invalid subject rule": `
+policies:
+    - subject_rule: 'r.sub.Name == "admin"'
+      rpcs: [GetAgents]`,
+		"invalid pin": `
+clients:
+    - name: admin
+      cert_pins: [abc]`,
+		"relative uri identity": `
+agents:
+    - name: web01
+      uri_identity: agent/web01`,
+		"empty name": `
+clients:
+    - roles: [viewer]`,
+		"duplicate name": `
+clients:
+    - name: web01
+agents:
+    - name: web01`,
+	}
+
+	for name, content := range tests {
+		if _, err := LoadBootstrap(writeBootstrap(t, content)); err == nil {
+			t.Errorf("%s: bootstrap file was accepted", name)
+		}
+	}
+}
+
+func TestCredentialsApply(t *testing.T) {
+	ep := models.Endpoint{CertPins: []string{testPin}, URIIdentity: "spiffe://example.org/agent/web01"}
+
+	// Undeclared credentials are kept
+	pins, uri := Credentials{}.apply(ep)
+	if !reflect.DeepEqual(pins, ep.CertPins) || uri != ep.URIIdentity {
+		t.Errorf("apply() = %v, %q, want the credentials of the endpoint", pins, uri)
+	}
+
+	// Declared credentials replace them, even if empty
+	empty := ""
+	pins, uri = Credentials{CertPins: []string{}, URIIdentity: &empty}.apply(ep)
+	if len(pins) != 0 || uri != "" {
+		t.Errorf("apply() = %v, %q, want no credentials", pins, uri)
+	}
+
+	// Pins are never nil, because the column is not nullable
+	if pins, _ := (Credentials{}).apply(models.Endpoint{}); pins == nil {
+		t.Error("apply() returned nil pins")
+	}
+}
+
+func TestSameSet(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want bool
+	}{
+		{a: nil, b: []string{}, want: true},
+		{a: []string{"/etc", "/bin"}, b: []string{"/bin", "/etc"}, want: true},
+		{a: []string{"/etc"}, b: []string{"/bin"}},
+		{a: []string{"/etc", "/etc"}, b: []string{"/etc"}},
+		{a: []string{"a\x00b"}, b: []string{"a", "b"}},
+	}
+
+	for _, tt := range tests {
+		if got := sameSet(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameSet(%q, %q) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestChangeString(t *testing.T) {
+	if got := (Change{Action: ActionAdd, Kind: "agent", Name: "web01"}).String(); got != "+ agent 'web01'" {
+		t.Errorf("String() = %s", got)
+	}
+	if got := (Change{Action: ActionUpdate, Kind: "client", Name: "admin", Detail: "roles [] -> [viewer]"}).String(); got != "~ client 'admin': roles [] -> [viewer]" {
+		t.Errorf("String() = %s", got)
+	}
+}
@@ -0,0 +1,357 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	IntervalDaily  = "daily"
+	IntervalWeekly = "weekly"
+
+	defaultStaleAfter = 24
+	topPathsLimit     = 10
+	generateTimeout   = 5 * time.Minute
+)
+
+type Repository interface {
+	GetAgents(ctx context.Context) ([]models.Endpoint, error)
+	GetPendingApprovalAgentIDs(ctx context.Context) (map[uint64]bool, error)
+	CountAlertsBetween(ctx context.Context, agentIDs []uint64, from, to int64) ([]AlertCount, error)
+	GetTopPathsBetween(ctx context.Context, agentIDs []uint64, from, to int64, limit int) ([]PathCount, error)
+	ClaimDigest(ctx context.Context, group string, periodEnd, now int64) (bool, error)
+	ReleaseDigest(ctx context.Context, group string, periodEnd int64) error
+	IsEmptyResultSetError(err error) bool
+}
+
+type Notifier interface {
+	NotifyDigest(ctx context.Context, payload []byte) error
+}
+
+type Config struct {
+	// One of daily or weekly. Reports are disabled if empty
+	Interval  string `yaml:"interval"`
+	Directory string `yaml:"directory"`
+	// Agents without a scan for this many hours are reported as stale
+	StaleAfter int64 `yaml:"stale_after"`
+	// Send digests to the webhooks that accept them
+	Notify bool `yaml:"notify"`
+	// A single group containing all agents is used if no groups are configured
+	Groups []GroupConfig `yaml:"groups"`
+}
+
+type GroupConfig struct {
+	Name   string   `yaml:"name"`
+	Agents []string `yaml:"agents"`
+}
+
+type AlertCount struct {
+	Kind     string `json:"kind"`
+	Severity string `json:"severity"`
+	Count    uint64 `json:"count"`
+}
+
+type PathCount struct {
+	Path  string `json:"path"`
+	Count uint64 `json:"count"`
+}
+
+type StaleAgent struct {
+	Name     string `json:"name"`
+	LastScan int64  `json:"last_scan"`
+}
+
+type Digest struct {
+	Group            string       `json:"group"`
+	From             int64        `json:"from"`
+	To               int64        `json:"to"`
+	TotalAlerts      uint64       `json:"total_alerts"`
+	Alerts           []AlertCount `json:"alerts"`
+	StaleAgents      []StaleAgent `json:"stale_agents"`
+	PendingApprovals []string     `json:"pending_approvals"`
+	TopPaths         []PathCount  `json:"top_paths"`
+}
+
+type Generator struct {
+	conf     Config
+	repo     Repository
+	notifier Notifier
+	quit     chan struct{}
+}
+
+func New(conf Config, repo Repository, notifier Notifier) (*Generator, error) {
+	switch conf.Interval {
+	case "", IntervalDaily, IntervalWeekly:
+	default:
+		return nil, fmt.Errorf("report: unknown interval '%s'", conf.Interval)
+	}
+
+	if conf.Interval != "" {
+		if conf.Directory == "" {
+			return nil, fmt.Errorf("report: no directory configured")
+		}
+
+		err := os.MkdirAll(conf.Directory, 0o750)
+		if err != nil {
+			return nil, fmt.Errorf("report: %w", err)
+		}
+	}
+
+	if conf.StaleAfter == 0 {
+		conf.StaleAfter = defaultStaleAfter
+	}
+
+	if len(conf.Groups) == 0 {
+		conf.Groups = []GroupConfig{{Name: "all"}}
+	}
+
+	names := make(map[string]bool)
+	for _, group := range conf.Groups {
+		err := validateGroupName(group.Name)
+		if err != nil {
+			return nil, fmt.Errorf("report: %w", err)
+		}
+		if names[group.Name] {
+			return nil, fmt.Errorf("report: group '%s' is configured twice", group.Name)
+		}
+		names[group.Name] = true
+	}
+
+	return &Generator{
+		conf:     conf,
+		repo:     repo,
+		notifier: notifier,
+		quit:     make(chan struct{}),
+	}, nil
+}
+
+// Run generates a digest at the end of every interval until Stop is called
+func (g *Generator) Run() {
+	if g.conf.Interval == "" {
+		log.Info().Msg("no report interval configured. digest reports are disabled")
+		return
+	}
+
+	for {
+		now := time.Now()
+		next := g.nextRun(now)
+		timer := time.NewTimer(next.Sub(now))
+
+		select {
+		case <-g.quit:
+			timer.Stop()
+			return
+		case <-timer.C:
+			err := g.Generate(g.previousRun(next), next)
+			if err != nil {
+				log.Error().Caller().Err(err).Msg("failed to generate digest reports")
+			}
+		}
+	}
+}
+
+func (g *Generator) Stop() {
+	close(g.quit)
+}
+
+// Generate builds, writes and optionally sends the digests of all groups for the given period. A group that fails
+// doesn't keep the other groups from getting their digests.
+func (g *Generator) Generate(from, to time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), generateTimeout)
+	defer cancel()
+
+	agents, err := g.repo.GetAgents(ctx)
+	if err != nil && !g.repo.IsEmptyResultSetError(err) {
+		return fmt.Errorf("report: %w", err)
+	}
+
+	failed := 0
+	for _, group := range g.conf.Groups {
+		err := g.generateGroup(ctx, group, filterAgents(agents, group.Agents), from, to)
+		if err != nil {
+			failed++
+			log.Error().Caller().Err(err).Msgf("failed to generate digest report for group '%s'", group.Name)
+			continue
+		}
+
+		log.Info().Msgf("generated digest report for group '%s'", group.Name)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("report: %d of %d groups failed", failed, len(g.conf.Groups))
+	}
+
+	return nil
+}
+
+// generateGroup claims the digest first, so that only one of several server instances generates and sends it
+func (g *Generator) generateGroup(ctx context.Context, group GroupConfig, agents []models.Endpoint, from, to time.Time) (err error) {
+	claimed, err := g.repo.ClaimDigest(ctx, group.Name, to.Unix(), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		log.Info().Msgf("digest report for group '%s' was already generated", group.Name)
+		return nil
+	}
+
+	defer func() {
+		if err != nil {
+			releaseErr := g.repo.ReleaseDigest(ctx, group.Name, to.Unix())
+			if releaseErr != nil {
+				log.Error().Caller().Err(releaseErr).Msgf("failed to release digest report for group '%s'", group.Name)
+			}
+		}
+	}()
+
+	digest, err := g.build(ctx, group, agents, from, to)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(digest)
+	if err != nil {
+		return err
+	}
+
+	err = g.write(digest, payload)
+	if err != nil {
+		return err
+	}
+
+	if g.conf.Notify {
+		return g.notifier.NotifyDigest(ctx, payload)
+	}
+
+	return nil
+}
+
+func (g *Generator) build(ctx context.Context, group GroupConfig, agents []models.Endpoint, from, to time.Time) (Digest, error) {
+	digest := Digest{
+		Group:            group.Name,
+		From:             from.Unix(),
+		To:               to.Unix(),
+		Alerts:           make([]AlertCount, 0),
+		StaleAgents:      make([]StaleAgent, 0),
+		PendingApprovals: make([]string, 0),
+		TopPaths:         make([]PathCount, 0),
+	}
+
+	if len(agents) == 0 {
+		return digest, nil
+	}
+
+	pending, err := g.repo.GetPendingApprovalAgentIDs(ctx)
+	if err != nil {
+		return Digest{}, err
+	}
+
+	staleBefore := to.Add(-time.Duration(g.conf.StaleAfter) * time.Hour).Unix()
+	agentIDs := make([]uint64, len(agents))
+
+	for i, agent := range agents {
+		agentIDs[i] = agent.ID
+
+		if agent.LastScan < staleBefore {
+			digest.StaleAgents = append(digest.StaleAgents, StaleAgent{Name: agent.Name, LastScan: agent.LastScan})
+		}
+		if pending[agent.ID] {
+			digest.PendingApprovals = append(digest.PendingApprovals, agent.Name)
+		}
+	}
+
+	counts, err := g.repo.CountAlertsBetween(ctx, agentIDs, from.Unix(), to.Unix())
+	if err != nil {
+		return Digest{}, err
+	}
+	digest.Alerts = counts
+	for _, c := range counts {
+		digest.TotalAlerts += c.Count
+	}
+
+	paths, err := g.repo.GetTopPathsBetween(ctx, agentIDs, from.Unix(), to.Unix(), topPathsLimit)
+	if err != nil {
+		return Digest{}, err
+	}
+	digest.TopPaths = paths
+
+	return digest, nil
+}
+
+func (g *Generator) write(digest Digest, payload []byte) error {
+	name := fmt.Sprintf("%s-%s", digest.Group, time.Unix(digest.To, 0).Format("2006-01-02"))
+	base := filepath.Join(g.conf.Directory, name)
+
+	err := ioutil.WriteFile(base+".json", payload, 0o640)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(base+".html", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return htmlTemplate.Execute(f, digest)
+}
+
+// validateGroupName rejects names that would place the report files outside of the report directory
+func validateGroupName(name string) error {
+	if name == "" {
+		return fmt.Errorf("group without a name")
+	}
+	if name == "." || strings.Contains(name, "..") || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid group name '%s'", name)
+	}
+
+	return nil
+}
+
+// nextRun returns the next midnight for daily reports or the next monday at midnight for weekly reports
+func (g *Generator) nextRun(now time.Time) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+
+	if g.conf.Interval == IntervalWeekly {
+		for next.Weekday() != time.Monday {
+			next = next.AddDate(0, 0, 1)
+		}
+	}
+
+	return next
+}
+
+func (g *Generator) previousRun(next time.Time) time.Time {
+	if g.conf.Interval == IntervalWeekly {
+		return next.AddDate(0, 0, -7)
+	}
+
+	return next.AddDate(0, 0, -1)
+}
+
+func filterAgents(agents []models.Endpoint, names []string) []models.Endpoint {
+	if len(names) == 0 {
+		return agents
+	}
+
+	filtered := make([]models.Endpoint, 0)
+	for _, agent := range agents {
+		for _, name := range names {
+			if agent.Name == name {
+				filtered = append(filtered, agent)
+				break
+			}
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,244 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Leantar/fimserver/models"
+)
+
+// testRepo serves fixed report data and keeps the claimed digests in memory
+type testRepo struct {
+	agents  []models.Endpoint
+	pending map[uint64]bool
+	counts  []AlertCount
+	paths   []PathCount
+	// Alert counts fail with this error if set
+	countErr error
+	// The agent IDs the alerts were counted for
+	countedIDs []uint64
+	claims     map[string]bool
+}
+
+func (r *testRepo) GetAgents(context.Context) ([]models.Endpoint, error) { return r.agents, nil }
+func (r *testRepo) IsEmptyResultSetError(error) bool                     { return false }
+
+func (r *testRepo) GetPendingApprovalAgentIDs(context.Context) (map[uint64]bool, error) {
+	return r.pending, nil
+}
+
+func (r *testRepo) CountAlertsBetween(_ context.Context, agentIDs []uint64, _, _ int64) ([]AlertCount, error) {
+	r.countedIDs = agentIDs
+	return r.counts, r.countErr
+}
+
+func (r *testRepo) GetTopPathsBetween(context.Context, []uint64, int64, int64, int) ([]PathCount, error) {
+	return r.paths, nil
+}
+
+func (r *testRepo) ClaimDigest(_ context.Context, group string, periodEnd, _ int64) (bool, error) {
+	key := fmt.Sprintf("%s@%d", group, periodEnd)
+	if r.claims[key] {
+		return false, nil
+	}
+	r.claims[key] = true
+	return true, nil
+}
+
+func (r *testRepo) ReleaseDigest(_ context.Context, group string, periodEnd int64) error {
+	delete(r.claims, fmt.Sprintf("%s@%d", group, periodEnd))
+	return nil
+}
+
+type testNotifier struct {
+	payloads [][]byte
+}
+
+func (n *testNotifier) NotifyDigest(_ context.Context, payload []byte) error {
+	n.payloads = append(n.payloads, payload)
+	return nil
+}
+
+func newTestRepo() *testRepo {
+	return &testRepo{
+		agents: []models.Endpoint{
+			{ID: 1, Name: "web", LastScan: time.Date(2022, 5, 1, 23, 0, 0, 0, time.UTC).Unix()},
+			{ID: 2, Name: "db", LastScan: time.Date(2022, 4, 28, 0, 0, 0, 0, time.UTC).Unix()},
+			{ID: 3, Name: "mail"},
+		},
+		pending: map[uint64]bool{2: true},
+		counts: []AlertCount{
+			{Kind: "CHANGE", Severity: "MEDIUM", Count: 3},
+			{Kind: "CREATE", Severity: "LOW", Count: 2},
+		},
+		paths:  []PathCount{{Path: "/etc/passwd", Count: 3}},
+		claims: make(map[string]bool),
+	}
+}
+
+func TestNewRejectsGroupNames(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "../etc", "a/b", `a\b`, "x..y"} {
+		_, err := New(Config{Groups: []GroupConfig{{Name: name}}}, newTestRepo(), &testNotifier{})
+		if err == nil {
+			t.Errorf("group name %q was accepted", name)
+		}
+	}
+
+	_, err := New(Config{Groups: []GroupConfig{{Name: "web"}, {Name: "web"}}}, newTestRepo(), &testNotifier{})
+	if err == nil {
+		t.Error("duplicate group names were accepted")
+	}
+
+	_, err = New(Config{Groups: []GroupConfig{{Name: "web-servers"}, {Name: "db_1.prod"}}}, newTestRepo(), &testNotifier{})
+	if err != nil {
+		t.Errorf("valid group names were rejected: %v", err)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	repo := newTestRepo()
+	g, err := New(Config{}, repo, &testNotifier{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 1)
+
+	digest, err := g.build(context.Background(), GroupConfig{Name: "all"}, filterAgents(repo.agents, []string{"web", "db"}), from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Digest{
+		Group:            "all",
+		From:             from.Unix(),
+		To:               to.Unix(),
+		TotalAlerts:      5,
+		Alerts:           repo.counts,
+		StaleAgents:      []StaleAgent{{Name: "db", LastScan: repo.agents[1].LastScan}},
+		PendingApprovals: []string{"db"},
+		TopPaths:         repo.paths,
+	}
+	if !reflect.DeepEqual(digest, want) {
+		t.Errorf("digest = %+v, want %+v", digest, want)
+	}
+	if !reflect.DeepEqual(repo.countedIDs, []uint64{1, 2}) {
+		t.Errorf("alerts were counted for agents %v, want [1 2]", repo.countedIDs)
+	}
+}
+
+func TestBuildWithoutAgents(t *testing.T) {
+	g, err := New(Config{}, newTestRepo(), &testNotifier{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := g.build(context.Background(), GroupConfig{Name: "empty"}, nil, time.Unix(0, 0), time.Unix(86400, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Empty lists are encoded as [] instead of null
+	b, err := json.Marshal(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"group":"empty","from":0,"to":86400,"total_alerts":0,"alerts":[],"stale_agents":[],"pending_approvals":[],"top_paths":[]}`
+	if string(b) != want {
+		t.Errorf("digest = %s, want %s", b, want)
+	}
+}
+
+func TestGenerateClaimsDigests(t *testing.T) {
+	repo := newTestRepo()
+	notifier := &testNotifier{}
+	dir := t.TempDir()
+
+	g, err := New(Config{Interval: IntervalDaily, Directory: dir, Notify: true}, repo, notifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 1)
+
+	err = g.Generate(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Files are named after the local date of the end of the period
+	date := time.Unix(to.Unix(), 0).Format("2006-01-02")
+	for _, ext := range []string{".json", ".html"} {
+		if _, err := ioutil.ReadFile(filepath.Join(dir, "all-"+date+ext)); err != nil {
+			t.Errorf("report file wasn't written: %v", err)
+		}
+	}
+
+	// Another instance, or the same one again, finds the digest claimed
+	err = g.Generate(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notifier.payloads) != 1 {
+		t.Errorf("digest was sent %d times, want once", len(notifier.payloads))
+	}
+}
+
+func TestGenerateReleasesFailedDigests(t *testing.T) {
+	repo := newTestRepo()
+	repo.countErr = errors.New("database is down")
+	notifier := &testNotifier{}
+
+	g, err := New(Config{Interval: IntervalDaily, Directory: t.TempDir(), Notify: true}, repo, notifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 1)
+
+	if err := g.Generate(from, to); err == nil {
+		t.Fatal("failed digest didn't return an error")
+	}
+	if len(repo.claims) != 0 {
+		t.Errorf("failed digest is still claimed: %v", repo.claims)
+	}
+
+	repo.countErr = nil
+	if err := g.Generate(from, to); err != nil {
+		t.Fatal(err)
+	}
+	if len(notifier.payloads) != 1 {
+		t.Errorf("digest was sent %d times after the retry, want once", len(notifier.payloads))
+	}
+}
+
+func TestNextRun(t *testing.T) {
+	// 2022-05-04 is a wednesday
+	now := time.Date(2022, 5, 4, 13, 30, 0, 0, time.UTC)
+
+	daily := &Generator{conf: Config{Interval: IntervalDaily}}
+	if got, want := daily.nextRun(now), time.Date(2022, 5, 5, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("daily nextRun = %s, want %s", got, want)
+	}
+	if got, want := daily.previousRun(daily.nextRun(now)), time.Date(2022, 5, 4, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("daily previousRun = %s, want %s", got, want)
+	}
+
+	weekly := &Generator{conf: Config{Interval: IntervalWeekly}}
+	if got, want := weekly.nextRun(now), time.Date(2022, 5, 9, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("weekly nextRun = %s, want %s", got, want)
+	}
+	if got, want := weekly.previousRun(weekly.nextRun(now)), time.Date(2022, 5, 2, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("weekly previousRun = %s, want %s", got, want)
+	}
+}
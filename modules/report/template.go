@@ -0,0 +1,66 @@
+package report
+
+import (
+	"html/template"
+	"time"
+)
+
+var htmlTemplate = template.Must(template.New("digest").Funcs(template.FuncMap{
+	"time": func(ts int64) string {
+		if ts == 0 {
+			return "never"
+		}
+		return time.Unix(ts, 0).Format("2006-01-02 15:04:05")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>FIM digest {{.Group}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>FIM digest for group {{.Group}}</h1>
+<p>{{time .From}} to {{time .To}}</p>
+
+<h2>New alerts ({{.TotalAlerts}})</h2>
+{{if .Alerts}}
+<table>
+<tr><th>Kind</th><th>Severity</th><th>Count</th></tr>
+{{range .Alerts}}<tr><td>{{.Kind}}</td><td>{{.Severity}}</td><td>{{.Count}}</td></tr>
+{{end}}
+</table>
+{{else}}<p>No new alerts.</p>{{end}}
+
+<h2>Agents with stale scans</h2>
+{{if .StaleAgents}}
+<table>
+<tr><th>Agent</th><th>Last scan</th></tr>
+{{range .StaleAgents}}<tr><td>{{.Name}}</td><td>{{time .LastScan}}</td></tr>
+{{end}}
+</table>
+{{else}}<p>All agents scanned recently.</p>{{end}}
+
+<h2>Pending baseline approvals</h2>
+{{if .PendingApprovals}}
+<ul>
+{{range .PendingApprovals}}<li>{{.}}</li>
+{{end}}
+</ul>
+{{else}}<p>No pending approvals.</p>{{end}}
+
+<h2>Top changed paths</h2>
+{{if .TopPaths}}
+<table>
+<tr><th>Path</th><th>Alerts</th></tr>
+{{range .TopPaths}}<tr><td>{{.Path}}</td><td>{{.Count}}</td></tr>
+{{end}}
+</table>
+{{else}}<p>No changed paths.</p>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,50 @@
+package risk
+
+import (
+	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/alert"
+)
+
+const (
+	weightLow             = 1
+	weightMedium          = 3
+	weightHigh            = 10
+	weightPendingApproval = 25
+	// Every hour without a scan adds one point up to this limit
+	maxStalenessScore = 48
+)
+
+// Score calculates the risk of an agent. Higher scores indicate agents that need more attention.
+// counts maps the severity of the agent's open alerts to the number of open alerts with that severity.
+// pendingApproval tells whether the agent's baseline update has approvals, but fewer than required.
+func Score(agent models.Endpoint, counts map[string]uint64, pendingApproval bool, now int64) uint64 {
+	var score uint64
+
+	score += counts[alert.SeverityLow] * weightLow
+	score += counts[alert.SeverityMedium] * weightMedium
+	score += counts[alert.SeverityHigh] * weightHigh
+
+	if pendingApproval {
+		score += weightPendingApproval
+	}
+
+	score += stalenessScore(agent.LastScan, now)
+
+	return score
+}
+
+func stalenessScore(lastScan, now int64) uint64 {
+	if lastScan == 0 {
+		return maxStalenessScore
+	}
+
+	hours := (now - lastScan) / 3600
+	if hours < 0 {
+		return 0
+	}
+	if hours > maxStalenessScore {
+		return maxStalenessScore
+	}
+
+	return uint64(hours)
+}
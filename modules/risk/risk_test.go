@@ -0,0 +1,61 @@
+package risk
+
+import (
+	"testing"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/alert"
+)
+
+func TestScore(t *testing.T) {
+	const now = 1650000000
+	scanned := models.Endpoint{Name: "agent1", LastScan: now}
+
+	tests := []struct {
+		name    string
+		agent   models.Endpoint
+		counts  map[string]uint64
+		pending bool
+		want    uint64
+	}{
+		{name: "quiet agent", agent: scanned, want: 0},
+		{
+			name:   "open alerts",
+			agent:  scanned,
+			counts: map[string]uint64{alert.SeverityLow: 2, alert.SeverityMedium: 1, alert.SeverityHigh: 3},
+			want:   2*weightLow + weightMedium + 3*weightHigh,
+		},
+		{name: "unknown severity", agent: scanned, counts: map[string]uint64{"CRITICAL": 5}, want: 0},
+		{name: "pending approval", agent: scanned, pending: true, want: weightPendingApproval},
+		{name: "stale scan", agent: models.Endpoint{LastScan: now - 5*3600 - 1}, want: 5},
+		{name: "never scanned", agent: models.Endpoint{}, want: maxStalenessScore},
+		{name: "scan long ago", agent: models.Endpoint{LastScan: now - 1000*3600}, want: maxStalenessScore},
+		{name: "scan in the future", agent: models.Endpoint{LastScan: now + 3600}, want: 0},
+		{
+			name:    "everything",
+			agent:   models.Endpoint{},
+			counts:  map[string]uint64{alert.SeverityHigh: 1},
+			pending: true,
+			want:    weightHigh + weightPendingApproval + maxStalenessScore,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := Score(tt.agent, tt.counts, tt.pending, now); got != tt.want {
+			t.Errorf("%s: Score() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestScoreOrdersBySeverity(t *testing.T) {
+	const now = 1650000000
+	agent := models.Endpoint{LastScan: now}
+
+	low := Score(agent, map[string]uint64{alert.SeverityLow: 1}, false, now)
+	medium := Score(agent, map[string]uint64{alert.SeverityMedium: 1}, false, now)
+	high := Score(agent, map[string]uint64{alert.SeverityHigh: 1}, false, now)
+
+	if !(low < medium && medium < high) {
+		t.Errorf("scores of a low, medium and high alert are %d, %d and %d", low, medium, high)
+	}
+}
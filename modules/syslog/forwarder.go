@@ -0,0 +1,310 @@
+package syslog
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/alert"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	queueSize    = 1000
+	writeTimeout = 5 * time.Second
+	// Private enterprise number reserved for documentation by RFC 5612. It is used if none is configured
+	defaultEnterpriseID = 32473
+	timestampFormat     = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// Syslog severities as defined by RFC 5424
+const (
+	severityCritical = 2
+	severityWarning  = 4
+	severityNotice   = 5
+)
+
+var facilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"daemon":   3,
+	"auth":     4,
+	"authpriv": 10,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+type Config struct {
+	// One of udp, tcp or tls. Forwarding is disabled if no address is configured
+	Network      string `yaml:"network"`
+	Address      string `yaml:"address"`
+	Facility     string `yaml:"facility"`
+	AppName      string `yaml:"app_name"`
+	EnterpriseID int    `yaml:"enterprise_id"`
+	// CA used to verify the syslog server when using tls. The system roots are used if empty
+	CaFile string `yaml:"ca_file"`
+}
+
+type Forwarder struct {
+	conf      Config
+	facility  int
+	hostname  string
+	tlsConfig *tls.Config
+	conn      net.Conn
+	messages  chan string
+	quit      chan struct{}
+}
+
+func New(conf Config) (*Forwarder, error) {
+	f := &Forwarder{
+		conf:     conf,
+		messages: make(chan string, queueSize),
+		quit:     make(chan struct{}),
+	}
+
+	if conf.Address == "" {
+		return f, nil
+	}
+
+	if conf.Facility == "" {
+		conf.Facility = "local0"
+	}
+	facility, ok := facilities[conf.Facility]
+	if !ok {
+		return nil, fmt.Errorf("syslog: unknown facility '%s'", conf.Facility)
+	}
+	f.facility = facility
+
+	if conf.AppName == "" {
+		conf.AppName = "fimserver"
+	}
+	if conf.EnterpriseID == 0 {
+		conf.EnterpriseID = defaultEnterpriseID
+	}
+
+	switch conf.Network {
+	case "udp", "tcp":
+	case "tls":
+		tlsConfig, err := createTLSConfig(conf.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("syslog: %w", err)
+		}
+		f.tlsConfig = tlsConfig
+	default:
+		return nil, fmt.Errorf("syslog: unknown network '%s'", conf.Network)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	f.hostname = hostname
+	f.conf = conf
+
+	return f, nil
+}
+
+// Run sends queued messages until Stop is called
+func (f *Forwarder) Run() {
+	if !f.enabled() {
+		log.Info().Msg("no syslog address configured. syslog forwarding is disabled")
+		return
+	}
+
+	for {
+		select {
+		case <-f.quit:
+			if f.conn != nil {
+				f.conn.Close()
+			}
+			return
+		case msg := <-f.messages:
+			f.send(msg)
+		}
+	}
+}
+
+func (f *Forwarder) Stop() {
+	close(f.quit)
+}
+
+// ForwardAlert queues a message for a newly created alert
+func (f *Forwarder) ForwardAlert(al models.Alert, agentName string) {
+	sd := structuredData(f.sdID("fimAlert"),
+		"id", fmt.Sprint(al.ID),
+		"agent", agentName,
+		"kind", al.Kind,
+		"severity", al.Severity,
+		"path", al.Path,
+		"difference", al.Difference,
+		"issuedAt", fmt.Sprint(al.IssuedAt),
+		"modified", fmt.Sprint(al.Modified),
+	)
+	msg := fmt.Sprintf("%s alert for '%s' on agent '%s'", al.Kind, al.Path, agentName)
+
+	f.enqueue(alertSeverity(al.Severity), "ALERT", sd, msg)
+}
+
+// ForwardAction queues a message for a privileged action that was performed by actor
+func (f *Forwarder) ForwardAction(actor, action, target string) {
+	sd := structuredData(f.sdID("fimAudit"),
+		"actor", actor,
+		"action", action,
+		"target", target,
+	)
+	msg := fmt.Sprintf("'%s' performed %s on '%s'", actor, action, target)
+
+	f.enqueue(severityNotice, "AUDIT", sd, msg)
+}
+
+// ForwardRejection queues a message for a known endpoint that was refused access
+func (f *Forwarder) ForwardRejection(endpoint, reason string) {
+	sd := structuredData(f.sdID("fimReject"),
+		"endpoint", endpoint,
+		"reason", reason,
+	)
+	msg := fmt.Sprintf("rejected '%s': %s", endpoint, reason)
+
+	f.enqueue(severityWarning, "REJECT", sd, msg)
+}
+
+func (f *Forwarder) enabled() bool {
+	return f.conf.Address != ""
+}
+
+func (f *Forwarder) sdID(name string) string {
+	return fmt.Sprintf("%s@%d", name, f.conf.EnterpriseID)
+}
+
+func (f *Forwarder) enqueue(severity int, msgID, sd, msg string) {
+	if !f.enabled() {
+		return
+	}
+
+	line := fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		f.facility*8+severity,
+		time.Now().Format(timestampFormat),
+		f.hostname,
+		f.conf.AppName,
+		os.Getpid(),
+		msgID,
+		sd,
+		msg,
+	)
+
+	select {
+	case f.messages <- line:
+	default:
+		log.Warn().Msg("syslog queue is full. dropping message")
+	}
+}
+
+func (f *Forwarder) send(msg string) {
+	// Retry once with a fresh connection because stream connections may have been closed by the peer
+	for attempt := 0; attempt < 2; attempt++ {
+		if f.conn == nil {
+			conn, err := f.dial()
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to connect to syslog server")
+				return
+			}
+			f.conn = conn
+		}
+
+		err := f.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err == nil {
+			_, err = f.conn.Write(f.frame(msg))
+		}
+		if err == nil {
+			return
+		}
+
+		log.Warn().Err(err).Msg("failed to send syslog message")
+		f.conn.Close()
+		f.conn = nil
+	}
+}
+
+func (f *Forwarder) dial() (net.Conn, error) {
+	if f.conf.Network == "tls" {
+		dialer := &net.Dialer{Timeout: writeTimeout}
+		return tls.DialWithDialer(dialer, "tcp", f.conf.Address, f.tlsConfig)
+	}
+
+	return net.DialTimeout(f.conf.Network, f.conf.Address, writeTimeout)
+}
+
+// frame applies the octet counting framing of RFC 5425 to messages sent over stream connections
+func (f *Forwarder) frame(msg string) []byte {
+	if f.conf.Network == "udp" {
+		return []byte(msg)
+	}
+
+	return []byte(fmt.Sprintf("%d %s", len(msg), msg))
+}
+
+func alertSeverity(severity string) int {
+	switch severity {
+	case alert.SeverityHigh:
+		return severityCritical
+	case alert.SeverityMedium:
+		return severityWarning
+	default:
+		return severityNotice
+	}
+}
+
+// structuredData builds a single SD-ELEMENT from alternating parameter names and values
+func structuredData(id string, params ...string) string {
+	var sb strings.Builder
+
+	sb.WriteByte('[')
+	sb.WriteString(id)
+	for i := 0; i+1 < len(params); i += 2 {
+		sb.WriteString(fmt.Sprintf(" %s=\"%s\"", params[i], escapeParamValue(params[i+1])))
+	}
+	sb.WriteByte(']')
+
+	return sb.String()
+}
+
+func escapeParamValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+func createTLSConfig(caPath string) (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caPath == "" {
+		return conf, nil
+	}
+
+	caBytes, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	ok := pool.AppendCertsFromPEM(caBytes)
+	if !ok {
+		return nil, errors.New("couldn't parse ca file")
+	}
+	conf.RootCAs = pool
+
+	return conf, nil
+}
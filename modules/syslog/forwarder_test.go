@@ -0,0 +1,55 @@
+package syslog
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestStructuredData(t *testing.T) {
+	tests := []struct {
+		name   string
+		params []string
+		want   string
+	}{
+		{
+			name:   "plain",
+			params: []string{"agent", "web01", "kind", "CHANGE"},
+			want:   `[fimAlert@32473 agent="web01" kind="CHANGE"]`,
+		},
+		{
+			name:   "escaped",
+			params: []string{"path", `/tmp/"a"]\b`},
+			want:   `[fimAlert@32473 path="/tmp/\"a\"\]\\b"]`,
+		},
+		{
+			name:   "odd parameter is dropped",
+			params: []string{"agent", "web01", "kind"},
+			want:   `[fimAlert@32473 agent="web01"]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := structuredData("fimAlert@32473", tt.params...)
+			if got != tt.want {
+				t.Errorf("structuredData() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFrame(t *testing.T) {
+	msg := "<13>1 - - - - - - line one\nline two"
+
+	udp := &Forwarder{conf: Config{Network: "udp"}}
+	if got := string(udp.frame(msg)); got != msg {
+		t.Errorf("udp frame = %q, want %q", got, msg)
+	}
+
+	// Octet counting keeps a newline in the message from ending the frame
+	tcp := &Forwarder{conf: Config{Network: "tcp"}}
+	want := fmt.Sprintf("%d %s", len(msg), msg)
+	if got := string(tcp.frame(msg)); got != want {
+		t.Errorf("tcp frame = %q, want %q", got, want)
+	}
+}
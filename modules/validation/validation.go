@@ -0,0 +1,134 @@
+// Package validation checks the policy rules and credentials that admins declare, both at runtime and in the bootstrap
+// file.
+package validation
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/Knetic/govaluate"
+	"github.com/Leantar/fimproto/proto"
+	"github.com/casbin/casbin/v2/util"
+)
+
+// The columns of the rules table hold at most 100 characters
+const maxPolicyRuleLength = 100
+
+// Subject is what subject rules are evaluated against as r.sub
+type Subject struct {
+	Kind              string
+	Roles             []interface{}
+	HasBaseline       bool
+	BaselineIsCurrent bool
+}
+
+// Subjects that subject rules are evaluated against during validation, to make sure they evaluate to a boolean
+var sampleSubjects = []Subject{
+	{Kind: "agent", Roles: []interface{}{}, HasBaseline: false, BaselineIsCurrent: false},
+	{Kind: "agent", Roles: []interface{}{}, HasBaseline: true, BaselineIsCurrent: true},
+	{Kind: "client", Roles: []interface{}{"viewer", "approver", "user_admin", "auditor"}},
+}
+
+// PolicyRule checks that rpc is a method of the Fim service and that subjectRule is a valid subject rule
+func PolicyRule(subjectRule, rpc string) error {
+	if !isFimRPC(rpc) {
+		return fmt.Errorf("unknown rpc '%s'", rpc)
+	}
+
+	return subjectRuleValid(subjectRule)
+}
+
+// subjectRuleValid checks that rule is a boolean govaluate expression that only accesses fields of the Subject given
+// as r.sub, as used by eval(p.sub_rule) in the casbin model
+func subjectRuleValid(rule string) error {
+	if rule == "" {
+		return errors.New("subject rule must not be empty")
+	}
+	if len(rule) > maxPolicyRuleLength {
+		return fmt.Errorf("subject rule must not be longer than %d characters", maxPolicyRuleLength)
+	}
+
+	// casbin escapes r.sub to r_sub before passing the rule to govaluate
+	expr, err := govaluate.NewEvaluableExpression(util.EscapeAssertion(rule))
+	if err != nil {
+		return fmt.Errorf("invalid subject rule: %w", err)
+	}
+
+	subType := reflect.TypeOf(Subject{})
+
+	for _, token := range expr.Tokens() {
+		switch token.Kind {
+		case govaluate.VARIABLE:
+			return fmt.Errorf("unknown variable '%v'", token.Value)
+		case govaluate.FUNCTION:
+			return errors.New("functions are not supported")
+		case govaluate.ACCESSOR:
+			path, _ := token.Value.([]string)
+			if len(path) != 2 || path[0] != "r_sub" {
+				return fmt.Errorf("only fields of r.sub can be accessed")
+			}
+			if _, ok := subType.FieldByName(path[1]); !ok {
+				return fmt.Errorf("r.sub has no field '%s'", path[1])
+			}
+		}
+	}
+
+	for _, sub := range sampleSubjects {
+		result, err := expr.Evaluate(map[string]interface{}{"r_sub": sub})
+		if err != nil {
+			return fmt.Errorf("failed to evaluate subject rule: %w", err)
+		}
+		if _, ok := result.(bool); !ok {
+			return errors.New("subject rule must evaluate to a boolean")
+		}
+	}
+
+	return nil
+}
+
+// isFimRPC reports whether name is a method of the Fim service
+func isFimRPC(name string) bool {
+	for _, m := range proto.Fim_ServiceDesc.Methods {
+		if m.MethodName == name {
+			return true
+		}
+	}
+
+	for _, s := range proto.Fim_ServiceDesc.Streams {
+		if s.StreamName == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NormalizeCertPin accepts a SHA-256 hash in hex, optionally separated by colons as openssl prints fingerprints
+func NormalizeCertPin(pin string) (string, error) {
+	pin = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(pin), ":", ""))
+
+	b, err := hex.DecodeString(pin)
+	if err != nil || len(b) != sha256.Size {
+		return "", errors.New("pin must be a SHA-256 hash in hex")
+	}
+
+	return pin, nil
+}
+
+// URIIdentity checks that uri is an absolute URI like spiffe://example.org/agent/web01
+func URIIdentity(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return errors.New("uri identity must be an absolute URI")
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPolicyRule(t *testing.T) {
+	tests := []struct {
+		rule  string
+		rpc   string
+		valid bool
+	}{
+		{rule: `r.sub.Kind == "agent"`, rpc: "CreateBaseline", valid: true},
+		{rule: `r.sub.Kind == "client" && "viewer" IN r.sub.Roles`, rpc: "GetAgents", valid: true},
+		{rule: `r.sub.Kind == "agent" && !r.sub.HasBaseline`, rpc: "CreateBaseline", valid: true},
+		{rule: `r.sub.Kind == "agent"`, rpc: "DropDatabase"},
+		{rule: `r.sub.Kind == "agent"`, rpc: ""},
+		{rule: "", rpc: "GetAgents"},
+		{rule: `r.sub.Kind == "` + strings.Repeat("a", maxPolicyRuleLength) + `"`, rpc: "GetAgents"},
+		{rule: `r.sub.Kind ==`, rpc: "GetAgents"},
+		{rule: `r.sub.Name == "admin"`, rpc: "GetAgents"},
+		{rule: `r.obj == "GetAgents"`, rpc: "GetAgents"},
+		{rule: `admin`, rpc: "GetAgents"},
+		{rule: `r.sub.Kind`, rpc: "GetAgents"},
+		{rule: `r.sub.Roles`, rpc: "GetAgents"},
+	}
+
+	for _, tt := range tests {
+		err := PolicyRule(tt.rule, tt.rpc)
+		if tt.valid && err != nil {
+			t.Errorf("PolicyRule(%q, %q) = %v, want nil", tt.rule, tt.rpc, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("PolicyRule(%q, %q) was accepted", tt.rule, tt.rpc)
+		}
+	}
+}
+
+func TestNormalizeCertPin(t *testing.T) {
+	const pin = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+	colons := make([]string, 0, len(pin)/2)
+	for i := 0; i < len(pin); i += 2 {
+		colons = append(colons, strings.ToUpper(pin[i:i+2]))
+	}
+
+	for _, in := range []string{pin, strings.ToUpper(pin), " " + pin + "\n", strings.Join(colons, ":")} {
+		got, err := NormalizeCertPin(in)
+		if err != nil {
+			t.Errorf("NormalizeCertPin(%q) returned %v", in, err)
+		} else if got != pin {
+			t.Errorf("NormalizeCertPin(%q) = %s, want %s", in, got, pin)
+		}
+	}
+
+	for _, in := range []string{"", pin[:62], pin + "00", "zz" + pin[2:]} {
+		if _, err := NormalizeCertPin(in); err == nil {
+			t.Errorf("NormalizeCertPin(%q) was accepted", in)
+		}
+	}
+}
+
+func TestURIIdentity(t *testing.T) {
+	for _, uri := range []string{"spiffe://example.org/agent/web01", "https://example.org"} {
+		if err := URIIdentity(uri); err != nil {
+			t.Errorf("URIIdentity(%q) = %v, want nil", uri, err)
+		}
+	}
+
+	for _, uri := range []string{"", "web01", "/agent/web01", "spiffe:agent", "://example.org"} {
+		if err := URIIdentity(uri); err == nil {
+			t.Errorf("URIIdentity(%q) was accepted", uri)
+		}
+	}
+}
@@ -4,24 +4,75 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 
 	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/chain"
+	"github.com/Leantar/fimserver/modules/notifier"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 type PgAlertRepository struct {
 	db *sqlx.DB
 }
 
-func (a *PgAlertRepository) Create(ctx context.Context, al models.Alert) (err error) {
-	const query = "INSERT INTO alerts(kind, difference, issued_at, path, modified, fk_agent_id) VALUES($1,$2,$3,$4,$5,$6)"
+// Create stores the alert together with its chain link and the notifications that messages returns for it, so that
+// no alert is stored without its notifications. The chain is locked before the ID is assigned, so alerts are committed
+// in the order of their IDs. Subscribers that resume after an ID therefore can't miss an alert that commits later with
+// a lower one.
+func (a *PgAlertRepository) Create(ctx context.Context, al models.Alert, messages func(models.Alert) ([]notifier.Message, error)) (id uint64, err error) {
+	ctx, done := instrument(ctx, "PgAlertRepository.Create")
+	defer done()
 
-	_, err = a.db.ExecContext(ctx, query, al.Kind, al.Difference, al.IssuedAt, al.Path, al.Modified, al.AgentID)
+	const query = "INSERT INTO alerts(kind, severity, difference, differences, issued_at, path, modified, fk_agent_id) VALUES($1,$2,$3,$4,$5,$6,$7,$8) RETURNING id"
 
-	return
+	err = withTx(ctx, a.db, func(tx *sqlx.Tx) error {
+		err := lockChain(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		err = tx.GetContext(ctx, &al.ID, query, al.Kind, al.Severity, al.Difference, toDBDifferences(al.Differences), al.IssuedAt, al.Path, al.Modified, al.AgentID)
+		if err != nil {
+			return err
+		}
+
+		_, err = appendChainLink(ctx, tx, models.ChainLink{
+			Source:  chain.SourceAlert,
+			RowID:   al.ID,
+			AgentID: al.AgentID,
+			RowHash: chain.AlertHash(al),
+		})
+		if err != nil {
+			return err
+		}
+
+		msgs, err := messages(al)
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range msgs {
+			err = insertNotification(ctx, tx, msg)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return al.ID, nil
 }
 
 func (a *PgAlertRepository) GetAllByAgent(ctx context.Context, agentID uint64) ([]models.Alert, error) {
+	ctx, done := instrument(ctx, "PgAlertRepository.GetAllByAgent")
+	defer done()
+
 	const query = "SELECT * from alerts WHERE fk_agent_id = $1"
 	alerts := make(dbAlerts, 0)
 
@@ -37,7 +88,90 @@ func (a *PgAlertRepository) GetAllByAgent(ctx context.Context, agentID uint64) (
 	return alerts.toAlerts(), nil
 }
 
+// The placeholders are filled by alertFilterArgs
+const alertFilterCondition = `(cardinality($1::BIGINT[]) = 0 OR fk_agent_id = ANY($1))
+		AND (cardinality($2::TEXT[]) = 0 OR kind = ANY($2))
+		AND (cardinality($3::TEXT[]) = 0 OR severity = ANY($3))
+		AND id > $4
+		AND path LIKE $5 ESCAPE '\'
+		AND path LIKE $6 ESCAPE '\'
+		AND ($7::BIGINT = 0 OR issued_at >= $7)
+		AND ($8::BIGINT = 0 OR issued_at < $8)`
+
+func alertFilterArgs(filter models.AlertFilter) []interface{} {
+	return []interface{}{
+		pq.Array(toInt64s(filter.AgentIDs)),
+		pq.Array(filter.Kinds),
+		pq.Array(filter.Severities),
+		filter.AfterID,
+		escapeLike(filter.PathPrefix) + "%",
+		globToLike(filter.PathGlob),
+		filter.IssuedFrom,
+		filter.IssuedUntil,
+	}
+}
+
+func (a *PgAlertRepository) GetByFilter(ctx context.Context, filter models.AlertFilter, limit int) ([]models.Alert, error) {
+	ctx, done := instrument(ctx, "PgAlertRepository.GetByFilter")
+	defer done()
+
+	const query = "SELECT * FROM alerts WHERE " + alertFilterCondition + " ORDER BY id ASC LIMIT $9"
+	alerts := make(dbAlerts, 0)
+
+	err := a.db.SelectContext(ctx, &alerts, query, append(alertFilterArgs(filter), limit)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return alerts.toAlerts(), nil
+}
+
+// GetPage returns up to limit alerts ordered by issued_at and id that follow the cursor. The first page is returned if cursor is nil.
+func (a *PgAlertRepository) GetPage(ctx context.Context, filter models.AlertFilter, cursor *models.AlertCursor, descending bool, limit int) ([]models.Alert, error) {
+	ctx, done := instrument(ctx, "PgAlertRepository.GetPage")
+	defer done()
+
+	order, cmp := "ASC", ">"
+	if descending {
+		order, cmp = "DESC", "<"
+	}
+
+	args := alertFilterArgs(filter)
+	query := "SELECT * FROM alerts WHERE " + alertFilterCondition
+
+	if cursor != nil {
+		query += fmt.Sprintf(" AND (issued_at, id) %s ($%d, $%d)", cmp, len(args)+1, len(args)+2)
+		args = append(args, cursor.IssuedAt, cursor.ID)
+	}
+
+	query += fmt.Sprintf(" ORDER BY issued_at %s, id %s LIMIT $%d", order, order, len(args)+1)
+	args = append(args, limit)
+
+	alerts := make(dbAlerts, 0)
+
+	err := a.db.SelectContext(ctx, &alerts, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return alerts.toAlerts(), nil
+}
+
+func (a *PgAlertRepository) GetLatestID(ctx context.Context) (id uint64, err error) {
+	ctx, done := instrument(ctx, "PgAlertRepository.GetLatestID")
+	defer done()
+
+	const query = "SELECT COALESCE(MAX(id), 0) FROM alerts"
+
+	err = a.db.GetContext(ctx, &id, query)
+
+	return
+}
+
 func (a *PgAlertRepository) GetLatestByPathAndAgent(ctx context.Context, path string, agentID uint64) (models.Alert, error) {
+	ctx, done := instrument(ctx, "PgAlertRepository.GetLatestByPathAndAgent")
+	defer done()
+
 	const query = "SELECT * from alerts WHERE path = $1 AND fk_agent_id = $2 ORDER BY issued_at DESC LIMIT 1"
 	var alert dbAlert
 
@@ -52,10 +186,84 @@ func (a *PgAlertRepository) GetLatestByPathAndAgent(ctx context.Context, path st
 	return alert.toAlert(), nil
 }
 
-func (a *PgAlertRepository) DeleteAll(ctx context.Context, agentID uint64) (err error) {
+// CountOpenBySeverity counts the open alerts of every agent. An alert is open until a later alert for the same path
+// supersedes it or a baseline update removes it.
+func (a *PgAlertRepository) CountOpenBySeverity(ctx context.Context) (map[uint64]map[string]uint64, error) {
+	ctx, done := instrument(ctx, "PgAlertRepository.CountOpenBySeverity")
+	defer done()
+
+	const query = `SELECT fk_agent_id, severity, COUNT(*) AS count FROM (
+			SELECT DISTINCT ON (fk_agent_id, path) fk_agent_id, severity FROM alerts ORDER BY fk_agent_id, path, id DESC
+		) AS open_alerts
+		GROUP BY fk_agent_id, severity`
+	rows := make([]dbSeverityCount, 0)
+
+	err := a.db.SelectContext(ctx, &rows, query)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[uint64]map[string]uint64)
+	for _, row := range rows {
+		if counts[row.AgentID] == nil {
+			counts[row.AgentID] = make(map[string]uint64)
+		}
+		counts[row.AgentID][row.Severity] = row.Count
+	}
+
+	return counts, nil
+}
+
+// GetByIDs returns the alerts that still exist out of ids
+func (a *PgAlertRepository) GetByIDs(ctx context.Context, ids []uint64) ([]models.Alert, error) {
+	ctx, done := instrument(ctx, "PgAlertRepository.GetByIDs")
+	defer done()
+
+	const query = "SELECT * FROM alerts WHERE id = ANY($1)"
+	alerts := make(dbAlerts, 0)
+
+	err := a.db.SelectContext(ctx, &alerts, query, pq.Array(toInt64s(ids)))
+	if err != nil {
+		return nil, err
+	}
+
+	return alerts.toAlerts(), nil
+}
+
+// DeleteAll deletes the alerts of the agent and appends a removal link, which allows them to be missing from the chain.
+// The checkpoint returned by sign for the link is stored in the same transaction.
+func (a *PgAlertRepository) DeleteAll(ctx context.Context, agentID uint64, sign func(models.ChainLink) (models.ChainCheckpoint, error)) (err error) {
+	ctx, done := instrument(ctx, "PgAlertRepository.DeleteAll")
+	defer done()
+
 	const query = "DELETE FROM alerts WHERE fk_agent_id = $1"
 
-	_, err = a.db.ExecContext(ctx, query, agentID)
+	err = withTx(ctx, a.db, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, query, agentID)
+		if err != nil {
+			return err
+		}
+
+		deleted, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if deleted == 0 {
+			return nil
+		}
+
+		link, err := appendChainLink(ctx, tx, models.ChainLink{Source: chain.SourceRemoval, AgentID: agentID})
+		if err != nil {
+			return err
+		}
+
+		cp, err := sign(link)
+		if err != nil {
+			return err
+		}
+
+		return insertCheckpoint(ctx, tx, cp)
+	})
 
 	return
 }
@@ -0,0 +1,136 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/jmoiron/sqlx"
+)
+
+type PgBaselineApprovalRepository struct {
+	db *sqlx.DB
+}
+
+// Approve adds the approval and returns how many distinct approvers, other than excluded, approved the agent. Once
+// they reach the quorum, the agent may update its baseline and its approvals are deleted. The agent row is locked, so
+// concurrent approvals are counted one after another. An approver that already approved the agent is ignored.
+func (b *PgBaselineApprovalRepository) Approve(ctx context.Context, approval models.BaselineApproval, excluded string, quorum int) (approvers int, err error) {
+	ctx, done := instrument(ctx, "PgBaselineApprovalRepository.Approve")
+	defer done()
+
+	const lockQuery = "SELECT baseline_is_current FROM endpoints WHERE id = $1 FOR UPDATE"
+	const insertQuery = `INSERT INTO baseline_approvals(fk_agent_id, approver, created_at) VALUES($1,$2,$3)
+		ON CONFLICT (fk_agent_id, approver) DO NOTHING`
+	const countQuery = "SELECT COUNT(*) FROM baseline_approvals WHERE fk_agent_id = $1 AND approver <> $2"
+	const allowQuery = "UPDATE endpoints SET baseline_is_current = false WHERE id = $1"
+	const deleteQuery = "DELETE FROM baseline_approvals WHERE fk_agent_id = $1"
+
+	err = withTx(ctx, b.db, func(tx *sqlx.Tx) error {
+		var baselineIsCurrent bool
+		err := tx.GetContext(ctx, &baselineIsCurrent, lockQuery, approval.AgentID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return errEmptyResultSet
+			}
+			return err
+		}
+
+		// A concurrent approval already reached the quorum
+		if !baselineIsCurrent {
+			approvers = quorum
+			return nil
+		}
+
+		_, err = tx.ExecContext(ctx, insertQuery, approval.AgentID, approval.Approver, approval.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		err = tx.GetContext(ctx, &approvers, countQuery, approval.AgentID, excluded)
+		if err != nil {
+			return err
+		}
+
+		if approvers < quorum {
+			return nil
+		}
+
+		_, err = tx.ExecContext(ctx, allowQuery, approval.AgentID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, deleteQuery, approval.AgentID)
+		return err
+	})
+
+	return
+}
+
+func (b *PgBaselineApprovalRepository) GetByAgent(ctx context.Context, agentID uint64) ([]models.BaselineApproval, error) {
+	ctx, done := instrument(ctx, "PgBaselineApprovalRepository.GetByAgent")
+	defer done()
+
+	const query = "SELECT * FROM baseline_approvals WHERE fk_agent_id = $1 ORDER BY id"
+	approvals := make(dbBaselineApprovals, 0)
+
+	err := b.db.SelectContext(ctx, &approvals, query, agentID)
+	if err != nil {
+		return nil, err
+	}
+
+	return approvals.toBaselineApprovals(), nil
+}
+
+func (b *PgBaselineApprovalRepository) GetAll(ctx context.Context) ([]models.BaselineApproval, error) {
+	ctx, done := instrument(ctx, "PgBaselineApprovalRepository.GetAll")
+	defer done()
+
+	const query = "SELECT * FROM baseline_approvals ORDER BY fk_agent_id, id"
+	approvals := make(dbBaselineApprovals, 0)
+
+	err := b.db.SelectContext(ctx, &approvals, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(approvals) == 0 {
+		return nil, errEmptyResultSet
+	}
+
+	return approvals.toBaselineApprovals(), nil
+}
+
+// GetPendingAgentIDs returns the agents that have approvals. Approvals are deleted once they reach the quorum, so these
+// agents are waiting for more approvers.
+func (b *PgBaselineApprovalRepository) GetPendingAgentIDs(ctx context.Context) (map[uint64]bool, error) {
+	ctx, done := instrument(ctx, "PgBaselineApprovalRepository.GetPendingAgentIDs")
+	defer done()
+
+	const query = "SELECT DISTINCT fk_agent_id FROM baseline_approvals"
+	ids := make([]int64, 0)
+
+	err := b.db.SelectContext(ctx, &ids, query)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		pending[uint64(id)] = true
+	}
+
+	return pending, nil
+}
+
+func (b *PgBaselineApprovalRepository) DeleteByAgent(ctx context.Context, agentID uint64) (err error) {
+	ctx, done := instrument(ctx, "PgBaselineApprovalRepository.DeleteByAgent")
+	defer done()
+
+	const query = "DELETE FROM baseline_approvals WHERE fk_agent_id = $1"
+
+	_, err = b.db.ExecContext(ctx, query, agentID)
+
+	return
+}
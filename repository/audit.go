@@ -0,0 +1,105 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/chain"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+type PgAuditRepository struct {
+	db *sqlx.DB
+}
+
+// Create stores the entry together with its chain link
+func (a *PgAuditRepository) Create(ctx context.Context, entry models.AuditEntry) (err error) {
+	ctx, done := instrument(ctx, "PgAuditRepository.Create")
+	defer done()
+
+	const query = `INSERT INTO audit_log(actor, action, target, parameters, result, remote_address, created_at)
+		VALUES($1,$2,$3,$4,$5,$6,$7) RETURNING id`
+
+	err = withTx(ctx, a.db, func(tx *sqlx.Tx) error {
+		err := tx.GetContext(ctx, &entry.ID, query, entry.Actor, entry.Action, entry.Target, entry.Parameters,
+			entry.Result, entry.RemoteAddress, entry.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		_, err = appendChainLink(ctx, tx, models.ChainLink{
+			Source:  chain.SourceAudit,
+			RowID:   entry.ID,
+			RowHash: chain.AuditHash(entry),
+		})
+
+		return err
+	})
+
+	return
+}
+
+// GetLatestByTarget returns the newest successful call of one of the actions on target
+func (a *PgAuditRepository) GetLatestByTarget(ctx context.Context, target string, actions []string) (models.AuditEntry, error) {
+	ctx, done := instrument(ctx, "PgAuditRepository.GetLatestByTarget")
+	defer done()
+
+	const query = `SELECT * FROM audit_log WHERE target = $1 AND action = ANY($2) AND result = 'OK'
+		ORDER BY id DESC LIMIT 1`
+	var entry dbAuditEntry
+
+	err := a.db.GetContext(ctx, &entry, query, target, pq.Array(actions))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.AuditEntry{}, errEmptyResultSet
+		}
+		return models.AuditEntry{}, err
+	}
+
+	return entry.toAuditEntry(), nil
+}
+
+// GetByIDs returns the entries that still exist out of ids
+func (a *PgAuditRepository) GetByIDs(ctx context.Context, ids []uint64) ([]models.AuditEntry, error) {
+	ctx, done := instrument(ctx, "PgAuditRepository.GetByIDs")
+	defer done()
+
+	const query = "SELECT * FROM audit_log WHERE id = ANY($1)"
+	entries := make(dbAuditEntries, 0)
+
+	err := a.db.SelectContext(ctx, &entries, query, pq.Array(toInt64s(ids)))
+	if err != nil {
+		return nil, err
+	}
+
+	return entries.toAuditEntries(), nil
+}
+
+// GetPage returns the newest entries matching the filter. If beforeID isn't 0, only older entries are returned.
+func (a *PgAuditRepository) GetPage(ctx context.Context, filter models.AuditFilter, beforeID uint64, limit int) ([]models.AuditEntry, error) {
+	ctx, done := instrument(ctx, "PgAuditRepository.GetPage")
+	defer done()
+
+	const query = `SELECT * FROM audit_log
+		WHERE ($1 = '' OR actor = $1)
+		AND ($2 = '' OR action = $2)
+		AND ($3 = '' OR target = $3)
+		AND ($4 = '' OR result = $4)
+		AND ($5::BIGINT = 0 OR created_at >= $5)
+		AND ($6::BIGINT = 0 OR created_at <= $6)
+		AND ($7::BIGINT = 0 OR id < $7)
+		ORDER BY id DESC LIMIT $8`
+
+	entries := make(dbAuditEntries, 0)
+
+	err := a.db.SelectContext(ctx, &entries, query, filter.Actor, filter.Action, filter.Target, filter.Result,
+		filter.From, filter.Until, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries.toAuditEntries(), nil
+}
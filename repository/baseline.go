@@ -14,6 +14,9 @@ type PgBaselineRepository struct {
 }
 
 func (f *PgBaselineRepository) CreateMany(ctx context.Context, wfs []models.FsObject) (err error) {
+	ctx, done := instrument(ctx, "PgBaselineRepository.CreateMany")
+	defer done()
+
 	const query = "INSERT INTO baseline_fs_objects(path, hash, created, modified, uid, gid, mode, fk_agent_id) VALUES(:path,:hash,:created,:modified,:uid,:gid,:mode,:agentid)"
 
 	wfsLen := len(wfs)
@@ -35,6 +38,9 @@ func (f *PgBaselineRepository) CreateMany(ctx context.Context, wfs []models.FsOb
 }
 
 func (f *PgBaselineRepository) GetByPathAndAgentID(ctx context.Context, path string, agentID uint64) (models.FsObject, error) {
+	ctx, done := instrument(ctx, "PgBaselineRepository.GetByPathAndAgentID")
+	defer done()
+
 	const query = "SELECT * FROM baseline_fs_objects WHERE path = $1 AND fk_agent_id = $2 LIMIT 1"
 	var fsObject dbFsObject
 
@@ -50,6 +56,9 @@ func (f *PgBaselineRepository) GetByPathAndAgentID(ctx context.Context, path str
 }
 
 func (f *PgBaselineRepository) GetBaselineByAgent(ctx context.Context, agentID uint64) ([]models.FsObject, error) {
+	ctx, done := instrument(ctx, "PgBaselineRepository.GetBaselineByAgent")
+	defer done()
+
 	const query = "SELECT * FROM baseline_fs_objects  WHERE fk_agent_id = $1 ORDER BY id ASC"
 	objs := make(dbFsObjects, 0)
 
@@ -66,6 +75,9 @@ func (f *PgBaselineRepository) GetBaselineByAgent(ctx context.Context, agentID u
 }
 
 func (f *PgBaselineRepository) DeleteBaselineForAgent(ctx context.Context, agentID uint64) (err error) {
+	ctx, done := instrument(ctx, "PgBaselineRepository.DeleteBaselineForAgent")
+	defer done()
+
 	const query = "DELETE FROM baseline_fs_objects WHERE fk_agent_id = $1"
 
 	_, err = f.db.ExecContext(ctx, query, agentID)
@@ -0,0 +1,157 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/chain"
+	"github.com/jmoiron/sqlx"
+)
+
+// Held while a link is appended, so that every link is chained to the one committed before it
+const chainLockID = 0x66696d63
+
+type PgChainRepository struct {
+	db *sqlx.DB
+}
+
+// lockChain makes other transactions that change the chain wait until tx ends
+func lockChain(ctx context.Context, tx *sqlx.Tx) error {
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", chainLockID)
+	return err
+}
+
+// appendChainLink chains a row that was inserted or deleted in tx. Other transactions wait for the lock until tx ends.
+func appendChainLink(ctx context.Context, tx *sqlx.Tx, link models.ChainLink) (models.ChainLink, error) {
+	err := lockChain(ctx, tx)
+	if err != nil {
+		return models.ChainLink{}, err
+	}
+
+	var prev string
+	err = tx.GetContext(ctx, &prev, "SELECT hash FROM chain_links ORDER BY id DESC LIMIT 1")
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return models.ChainLink{}, err
+	}
+
+	link.Hash = chain.LinkHash(prev, link)
+
+	const query = "INSERT INTO chain_links(source, row_id, agent_id, row_hash, hash) VALUES($1,$2,$3,$4,$5) RETURNING id"
+
+	err = tx.GetContext(ctx, &link.ID, query, link.Source, link.RowID, link.AgentID, link.RowHash, link.Hash)
+	if err != nil {
+		return models.ChainLink{}, err
+	}
+
+	return link, nil
+}
+
+// GetLinks returns up to limit links that follow the link with afterID
+func (c *PgChainRepository) GetLinks(ctx context.Context, afterID uint64, limit int) ([]models.ChainLink, error) {
+	ctx, done := instrument(ctx, "PgChainRepository.GetLinks")
+	defer done()
+
+	const query = "SELECT * FROM chain_links WHERE id > $1 ORDER BY id LIMIT $2"
+	links := make(dbChainLinks, 0)
+
+	err := c.db.SelectContext(ctx, &links, query, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return links.toChainLinks(), nil
+}
+
+func (c *PgChainRepository) GetLatestLink(ctx context.Context) (models.ChainLink, error) {
+	ctx, done := instrument(ctx, "PgChainRepository.GetLatestLink")
+	defer done()
+
+	const query = "SELECT * FROM chain_links ORDER BY id DESC LIMIT 1"
+	var link dbChainLink
+
+	err := c.db.GetContext(ctx, &link, query)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.ChainLink{}, errEmptyResultSet
+		}
+		return models.ChainLink{}, err
+	}
+
+	return link.toChainLink(), nil
+}
+
+// GetUnchained returns the alerts and audit entries that have no link, except for those stored before the chain was
+// created. Only Source and RowID are set.
+func (c *PgChainRepository) GetUnchained(ctx context.Context) ([]models.ChainLink, error) {
+	ctx, done := instrument(ctx, "PgChainRepository.GetUnchained")
+	defer done()
+
+	const query = `SELECT 'alert' AS source, id AS row_id FROM alerts a
+			WHERE a.id > (SELECT row_id FROM chain_start WHERE source = 'alert')
+			AND NOT EXISTS (SELECT 1 FROM chain_links WHERE source = 'alert' AND row_id = a.id)
+		UNION ALL
+		SELECT 'audit' AS source, id AS row_id FROM audit_log l
+			WHERE l.id > (SELECT row_id FROM chain_start WHERE source = 'audit')
+			AND NOT EXISTS (SELECT 1 FROM chain_links WHERE source = 'audit' AND row_id = l.id)
+		ORDER BY source, row_id`
+	links := make(dbChainLinks, 0)
+
+	err := c.db.SelectContext(ctx, &links, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return links.toChainLinks(), nil
+}
+
+func (c *PgChainRepository) CreateCheckpoint(ctx context.Context, cp models.ChainCheckpoint) (err error) {
+	ctx, done := instrument(ctx, "PgChainRepository.CreateCheckpoint")
+	defer done()
+
+	return insertCheckpoint(ctx, c.db, cp)
+}
+
+func insertCheckpoint(ctx context.Context, db sqlx.ExecerContext, cp models.ChainCheckpoint) error {
+	const query = `INSERT INTO chain_checkpoints(fk_link_id, hash, certificate, signature, created_at)
+		VALUES($1,$2,$3,$4,$5)`
+
+	_, err := db.ExecContext(ctx, query, cp.LinkID, cp.Hash, cp.Certificate, cp.Signature, cp.CreatedAt)
+
+	return err
+}
+
+// GetCheckpoints returns all checkpoints ordered by the links they sign
+func (c *PgChainRepository) GetCheckpoints(ctx context.Context) ([]models.ChainCheckpoint, error) {
+	ctx, done := instrument(ctx, "PgChainRepository.GetCheckpoints")
+	defer done()
+
+	const query = "SELECT * FROM chain_checkpoints ORDER BY fk_link_id, id"
+	checkpoints := make(dbChainCheckpoints, 0)
+
+	err := c.db.SelectContext(ctx, &checkpoints, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return checkpoints.toChainCheckpoints(), nil
+}
+
+func (c *PgChainRepository) GetLatestCheckpoint(ctx context.Context) (models.ChainCheckpoint, error) {
+	ctx, done := instrument(ctx, "PgChainRepository.GetLatestCheckpoint")
+	defer done()
+
+	const query = "SELECT * FROM chain_checkpoints ORDER BY fk_link_id DESC, id DESC LIMIT 1"
+	var cp dbChainCheckpoint
+
+	err := c.db.GetContext(ctx, &cp, query)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.ChainCheckpoint{}, errEmptyResultSet
+		}
+		return models.ChainCheckpoint{}, err
+	}
+
+	return cp.toChainCheckpoint(), nil
+}
@@ -5,23 +5,34 @@ import (
 	"database/sql"
 
 	"github.com/Leantar/fimserver/models"
-	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 )
 
 type PgEndpointRepository struct {
-	db *sqlx.DB
+	db dbtx
 }
 
 func (e *PgEndpointRepository) Create(ctx context.Context, ep models.Endpoint) (err error) {
-	const query = "INSERT INTO endpoints(name, kind, roles, has_baseline, baseline_is_current, watched_paths) VALUES($1,$2,$3,$4,$5,$6)"
+	ctx, done := instrument(ctx, "PgEndpointRepository.Create")
+	defer done()
 
-	_, err = e.db.ExecContext(ctx, query, ep.Name, ep.Kind, pq.Array(ep.Roles), ep.HasBaseline, ep.BaselineIsCurrent, pq.Array(ep.WatchedPaths))
+	const query = `INSERT INTO endpoints(name, kind, roles, has_baseline, baseline_is_current, watched_paths, cert_pins, uri_identity)
+		VALUES($1,$2,$3,$4,$5,$6,$7,NULLIF($8, ''))`
+
+	pins := ep.CertPins
+	if pins == nil {
+		pins = []string{}
+	}
+
+	_, err = e.db.ExecContext(ctx, query, ep.Name, ep.Kind, pq.Array(ep.Roles), ep.HasBaseline, ep.BaselineIsCurrent, pq.Array(ep.WatchedPaths), pq.Array(pins), ep.URIIdentity)
 
 	return
 }
 
 func (e *PgEndpointRepository) GetByName(ctx context.Context, name string) (models.Endpoint, error) {
+	ctx, done := instrument(ctx, "PgEndpointRepository.GetByName")
+	defer done()
+
 	const query = "SELECT * FROM endpoints WHERE name = $1 LIMIT 1"
 	var endpoint dbEndpoint
 
@@ -36,7 +47,46 @@ func (e *PgEndpointRepository) GetByName(ctx context.Context, name string) (mode
 	return endpoint.toEndpoint(), nil
 }
 
+func (e *PgEndpointRepository) GetByID(ctx context.Context, id uint64) (models.Endpoint, error) {
+	ctx, done := instrument(ctx, "PgEndpointRepository.GetByID")
+	defer done()
+
+	const query = "SELECT * FROM endpoints WHERE id = $1 LIMIT 1"
+	var endpoint dbEndpoint
+
+	err := e.db.GetContext(ctx, &endpoint, query, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return models.Endpoint{}, errEmptyResultSet
+		}
+		return models.Endpoint{}, err
+	}
+
+	return endpoint.toEndpoint(), nil
+}
+
+func (e *PgEndpointRepository) GetByURIIdentity(ctx context.Context, uri string) (models.Endpoint, error) {
+	ctx, done := instrument(ctx, "PgEndpointRepository.GetByURIIdentity")
+	defer done()
+
+	const query = "SELECT * FROM endpoints WHERE uri_identity = $1 LIMIT 1"
+	var endpoint dbEndpoint
+
+	err := e.db.GetContext(ctx, &endpoint, query, uri)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return models.Endpoint{}, errEmptyResultSet
+		}
+		return models.Endpoint{}, err
+	}
+
+	return endpoint.toEndpoint(), nil
+}
+
 func (e *PgEndpointRepository) GetAgents(ctx context.Context) ([]models.Endpoint, error) {
+	ctx, done := instrument(ctx, "PgEndpointRepository.GetAgents")
+	defer done()
+
 	const query = "SELECT * FROM endpoints WHERE kind = 'agent'"
 	endpoints := make(dbEndpoints, 0)
 
@@ -52,7 +102,55 @@ func (e *PgEndpointRepository) GetAgents(ctx context.Context) ([]models.Endpoint
 	return endpoints.toEndpoints(), nil
 }
 
+func (e *PgEndpointRepository) GetClients(ctx context.Context) ([]models.Endpoint, error) {
+	ctx, done := instrument(ctx, "PgEndpointRepository.GetClients")
+	defer done()
+
+	const query = "SELECT * FROM endpoints WHERE kind = 'client' ORDER BY name"
+	endpoints := make(dbEndpoints, 0)
+
+	err := e.db.SelectContext(ctx, &endpoints, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(endpoints) == 0 {
+		return nil, errEmptyResultSet
+	}
+
+	return endpoints.toEndpoints(), nil
+}
+
+func (e *PgEndpointRepository) CountByBaselineState(ctx context.Context) (map[string]uint64, error) {
+	ctx, done := instrument(ctx, "PgEndpointRepository.CountByBaselineState")
+	defer done()
+
+	const query = `SELECT CASE
+			WHEN NOT has_baseline THEN 'missing'
+			WHEN baseline_is_current THEN 'current'
+			ELSE 'update_approved'
+		END AS state, COUNT(*) AS count
+		FROM endpoints WHERE kind = 'agent' GROUP BY state`
+	rows := make([]dbStateCount, 0)
+
+	err := e.db.SelectContext(ctx, &rows, query)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]uint64)
+	for _, row := range rows {
+		counts[row.State] = row.Count
+	}
+
+	return counts, nil
+}
+
+// Update doesn't write last_scan, so that an endpoint that was read before a scan can't reset it. Use UpdateLastScan.
 func (e *PgEndpointRepository) Update(ctx context.Context, ep models.Endpoint) (err error) {
+	ctx, done := instrument(ctx, "PgEndpointRepository.Update")
+	defer done()
+
 	const query = "UPDATE endpoints SET name = $1, kind = $2, roles = $3, has_baseline = $4, baseline_is_current = $5, watched_paths = $6 WHERE id = $7"
 
 	_, err = e.db.ExecContext(ctx, query, ep.Name, ep.Kind, pq.Array(ep.Roles), ep.HasBaseline, ep.BaselineIsCurrent, pq.Array(ep.WatchedPaths), ep.ID)
@@ -60,7 +158,100 @@ func (e *PgEndpointRepository) Update(ctx context.Context, ep models.Endpoint) (
 	return
 }
 
+// UpdateWatchedPaths replaces the watched paths of the agent. Approvals of its baseline update and a permission that
+// wasn't used yet were given for the old paths, so they are discarded in the same statement.
+func (e *PgEndpointRepository) UpdateWatchedPaths(ctx context.Context, id uint64, watchedPaths []string) (err error) {
+	ctx, done := instrument(ctx, "PgEndpointRepository.UpdateWatchedPaths")
+	defer done()
+
+	const query = `WITH discarded AS (DELETE FROM baseline_approvals WHERE fk_agent_id = $2)
+		UPDATE endpoints SET watched_paths = $1, baseline_is_current = true WHERE id = $2`
+
+	_, err = e.db.ExecContext(ctx, query, pq.Array(watchedPaths), id)
+
+	return
+}
+
+func (e *PgEndpointRepository) UpdateLastScan(ctx context.Context, id uint64, lastScan int64) (err error) {
+	ctx, done := instrument(ctx, "PgEndpointRepository.UpdateLastScan")
+	defer done()
+
+	const query = "UPDATE endpoints SET last_scan = $1 WHERE id = $2"
+
+	_, err = e.db.ExecContext(ctx, query, lastScan, id)
+
+	return
+}
+
+func (e *PgEndpointRepository) UpdateRoles(ctx context.Context, id uint64, roles []string) (err error) {
+	ctx, done := instrument(ctx, "PgEndpointRepository.UpdateRoles")
+	defer done()
+
+	const query = "UPDATE endpoints SET roles = $1 WHERE id = $2"
+
+	_, err = e.db.ExecContext(ctx, query, pq.Array(roles), id)
+
+	return
+}
+
+// UpdateCredentials replaces the certificate pins and the URI identity. An empty URI identity removes it.
+func (e *PgEndpointRepository) UpdateCredentials(ctx context.Context, id uint64, certPins []string, uriIdentity string) (err error) {
+	ctx, done := instrument(ctx, "PgEndpointRepository.UpdateCredentials")
+	defer done()
+
+	const query = "UPDATE endpoints SET cert_pins = $1, uri_identity = NULLIF($2, '') WHERE id = $3"
+
+	_, err = e.db.ExecContext(ctx, query, pq.Array(certPins), uriIdentity, id)
+
+	return
+}
+
+func (e *PgEndpointRepository) UpdateDisabled(ctx context.Context, id uint64, disabled bool) (err error) {
+	ctx, done := instrument(ctx, "PgEndpointRepository.UpdateDisabled")
+	defer done()
+
+	const query = "UPDATE endpoints SET disabled = $1 WHERE id = $2"
+
+	_, err = e.db.ExecContext(ctx, query, disabled, id)
+
+	return
+}
+
+// UpdateLastSeen records an authenticated call of the endpoint and clears its silent state
+func (e *PgEndpointRepository) UpdateLastSeen(ctx context.Context, id uint64, lastSeen int64, remoteAddress string) (err error) {
+	ctx, done := instrument(ctx, "PgEndpointRepository.UpdateLastSeen")
+	defer done()
+
+	const query = "UPDATE endpoints SET last_seen = $1, remote_address = $2, is_silent = FALSE WHERE id = $3"
+
+	_, err = e.db.ExecContext(ctx, query, lastSeen, remoteAddress, id)
+
+	return
+}
+
+// MarkSilent marks enabled agents as silent that were seen before but not since seenBefore. Only the newly marked agents are
+// returned, so every silence is reported once even with multiple server instances.
+func (e *PgEndpointRepository) MarkSilent(ctx context.Context, seenBefore int64) ([]models.Endpoint, error) {
+	ctx, done := instrument(ctx, "PgEndpointRepository.MarkSilent")
+	defer done()
+
+	const query = `UPDATE endpoints SET is_silent = TRUE
+		WHERE kind = 'agent' AND NOT is_silent AND NOT disabled AND last_seen > 0 AND last_seen < $1
+		RETURNING *`
+	endpoints := make(dbEndpoints, 0)
+
+	err := e.db.SelectContext(ctx, &endpoints, query, seenBefore)
+	if err != nil {
+		return nil, err
+	}
+
+	return endpoints.toEndpoints(), nil
+}
+
 func (e *PgEndpointRepository) Delete(ctx context.Context, name string) (err error) {
+	ctx, done := instrument(ctx, "PgEndpointRepository.Delete")
+	defer done()
+
 	const query = "DELETE FROM endpoints WHERE name = $1"
 
 	_, err = e.db.ExecContext(ctx, query, name)
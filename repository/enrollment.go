@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/jmoiron/sqlx"
+)
+
+type PgEnrollmentTokenRepository struct {
+	db *sqlx.DB
+}
+
+// Replace stores the token for its endpoint, invalidating any token issued before
+func (e *PgEnrollmentTokenRepository) Replace(ctx context.Context, token models.EnrollmentToken) (err error) {
+	ctx, done := instrument(ctx, "PgEnrollmentTokenRepository.Replace")
+	defer done()
+
+	const query = `INSERT INTO enrollment_tokens(token_hash, expires_at, fk_endpoint_id) VALUES($1,$2,$3)
+		ON CONFLICT (fk_endpoint_id) DO UPDATE SET token_hash = EXCLUDED.token_hash, expires_at = EXCLUDED.expires_at`
+
+	_, err = e.db.ExecContext(ctx, query, token.TokenHash, token.ExpiresAt, token.EndpointID)
+
+	return
+}
+
+// Consume deletes and returns the token with the given hash, so that it can only be used once.
+// Expired tokens are returned as well and must be checked by the caller.
+func (e *PgEnrollmentTokenRepository) Consume(ctx context.Context, tokenHash string) (models.EnrollmentToken, error) {
+	ctx, done := instrument(ctx, "PgEnrollmentTokenRepository.Consume")
+	defer done()
+
+	const query = "DELETE FROM enrollment_tokens WHERE token_hash = $1 RETURNING *"
+	var token dbEnrollmentToken
+
+	err := e.db.GetContext(ctx, &token, query, tokenHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.EnrollmentToken{}, errEmptyResultSet
+		}
+		return models.EnrollmentToken{}, err
+	}
+
+	return token.toEnrollmentToken(), nil
+}
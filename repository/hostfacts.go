@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+type PgHostFactsRepository struct {
+	db *sqlx.DB
+}
+
+func (h *PgHostFactsRepository) Create(ctx context.Context, facts models.HostFacts) (err error) {
+	ctx, done := instrument(ctx, "PgHostFactsRepository.Create")
+	defer done()
+
+	const query = "INSERT INTO host_facts(hostname, os_release, kernel, agent_version, ip_addresses, reported_at, fk_agent_id) VALUES($1,$2,$3,$4,$5,$6,$7)"
+
+	_, err = h.db.ExecContext(ctx, query, facts.Hostname, facts.OsRelease, facts.Kernel, facts.AgentVersion, pq.Array(facts.IPAddresses), facts.ReportedAt, facts.AgentID)
+
+	return
+}
+
+func (h *PgHostFactsRepository) GetLatestByAgent(ctx context.Context, agentID uint64) (models.HostFacts, error) {
+	ctx, done := instrument(ctx, "PgHostFactsRepository.GetLatestByAgent")
+	defer done()
+
+	const query = "SELECT * FROM host_facts WHERE fk_agent_id = $1 ORDER BY id DESC LIMIT 1"
+	var facts dbHostFacts
+
+	err := h.db.GetContext(ctx, &facts, query, agentID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.HostFacts{}, errEmptyResultSet
+		}
+		return models.HostFacts{}, err
+	}
+
+	return facts.toHostFacts(), nil
+}
+
+// GetLatest returns the current facts of every agent that reported any, keyed by agent ID
+func (h *PgHostFactsRepository) GetLatest(ctx context.Context) (map[uint64]models.HostFacts, error) {
+	ctx, done := instrument(ctx, "PgHostFactsRepository.GetLatest")
+	defer done()
+
+	const query = "SELECT DISTINCT ON (fk_agent_id) * FROM host_facts ORDER BY fk_agent_id, id DESC"
+	rows := make(dbHostFactsList, 0)
+
+	err := h.db.SelectContext(ctx, &rows, query)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := make(map[uint64]models.HostFacts, len(rows))
+	for _, facts := range rows.toHostFacts() {
+		latest[facts.AgentID] = facts
+	}
+
+	return latest, nil
+}
+
+// GetHistoryByAgent returns all facts an agent reported, the most recent first
+func (h *PgHostFactsRepository) GetHistoryByAgent(ctx context.Context, agentID uint64) ([]models.HostFacts, error) {
+	ctx, done := instrument(ctx, "PgHostFactsRepository.GetHistoryByAgent")
+	defer done()
+
+	const query = "SELECT * FROM host_facts WHERE fk_agent_id = $1 ORDER BY id DESC"
+	rows := make(dbHostFactsList, 0)
+
+	err := h.db.SelectContext(ctx, &rows, query, agentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return nil, errEmptyResultSet
+	}
+
+	return rows.toHostFacts(), nil
+}
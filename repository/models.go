@@ -1,8 +1,14 @@
 package repository
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+
 	"github.com/Leantar/fimserver/models"
 	"github.com/Leantar/fimserver/modules/casbin"
+	"github.com/Leantar/fimserver/modules/notifier"
 	"github.com/lib/pq"
 )
 
@@ -14,6 +20,13 @@ type dbEndpoint struct {
 	HasBaseline       bool           `db:"has_baseline"`
 	BaselineIsCurrent bool           `db:"baseline_is_current"`
 	WatchedPaths      pq.StringArray `db:"watched_paths"`
+	LastScan          int64          `db:"last_scan"`
+	LastSeen          int64          `db:"last_seen"`
+	RemoteAddress     string         `db:"remote_address"`
+	IsSilent          bool           `db:"is_silent"`
+	Disabled          bool           `db:"disabled"`
+	CertPins          pq.StringArray `db:"cert_pins"`
+	URIIdentity       sql.NullString `db:"uri_identity"`
 }
 
 func (d dbEndpoint) toEndpoint() models.Endpoint {
@@ -25,6 +38,13 @@ func (d dbEndpoint) toEndpoint() models.Endpoint {
 		HasBaseline:       d.HasBaseline,
 		BaselineIsCurrent: d.BaselineIsCurrent,
 		WatchedPaths:      d.WatchedPaths,
+		LastScan:          d.LastScan,
+		LastSeen:          d.LastSeen,
+		RemoteAddress:     d.RemoteAddress,
+		IsSilent:          d.IsSilent,
+		Disabled:          d.Disabled,
+		CertPins:          d.CertPins,
+		URIIdentity:       d.URIIdentity.String,
 	}
 }
 
@@ -39,18 +59,81 @@ func (d dbEndpoints) toEndpoints() []models.Endpoint {
 	return conv
 }
 
+type dbStateCount struct {
+	State string `db:"state"`
+	Count uint64 `db:"count"`
+}
+
 type dbAlert struct {
-	ID         uint64 `db:"id"`
-	Kind       string `db:"kind"`
-	Difference string `db:"difference"`
-	IssuedAt   int64  `db:"issued_at"`
-	Path       string `db:"path"`
-	Modified   int64  `db:"modified"`
-	AgentID    uint64 `db:"fk_agent_id"`
+	ID          uint64        `db:"id"`
+	Kind        string        `db:"kind"`
+	Severity    string        `db:"severity"`
+	Difference  string        `db:"difference"`
+	Differences dbDifferences `db:"differences"`
+	IssuedAt    int64         `db:"issued_at"`
+	Path        string        `db:"path"`
+	Modified    int64         `db:"modified"`
+	AgentID     uint64        `db:"fk_agent_id"`
 }
 
 func (d dbAlert) toAlert() models.Alert {
-	return models.Alert(d)
+	return models.Alert{
+		ID:          d.ID,
+		Kind:        d.Kind,
+		Severity:    d.Severity,
+		Difference:  d.Difference,
+		Differences: d.Differences.toDifferences(),
+		IssuedAt:    d.IssuedAt,
+		Path:        d.Path,
+		Modified:    d.Modified,
+		AgentID:     d.AgentID,
+	}
+}
+
+type dbDifference struct {
+	Field  string `json:"field"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after"`
+}
+
+// dbDifferences is stored as JSON array
+type dbDifferences []dbDifference
+
+func toDBDifferences(diffs []models.Difference) dbDifferences {
+	conv := make(dbDifferences, len(diffs))
+	for i, diff := range diffs {
+		conv[i] = dbDifference(diff)
+	}
+
+	return conv
+}
+
+func (d dbDifferences) toDifferences() []models.Difference {
+	conv := make([]models.Difference, len(d))
+	for i, diff := range d {
+		conv[i] = models.Difference(diff)
+	}
+
+	return conv
+}
+
+// Value returns a string, because pq would send a []byte as bytea
+func (d dbDifferences) Value() (driver.Value, error) {
+	b, err := json.Marshal([]dbDifference(d))
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+func (d *dbDifferences) Scan(src interface{}) error {
+	b, ok := src.([]byte)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into differences", src)
+	}
+
+	return json.Unmarshal(b, (*[]dbDifference)(d))
 }
 
 type dbAlerts []dbAlert
@@ -64,6 +147,58 @@ func (d dbAlerts) toAlerts() []models.Alert {
 	return conv
 }
 
+type dbSeverityCount struct {
+	AgentID  uint64 `db:"fk_agent_id"`
+	Severity string `db:"severity"`
+	Count    uint64 `db:"count"`
+}
+
+type dbAlertCount struct {
+	Kind     string `db:"kind"`
+	Severity string `db:"severity"`
+	Count    uint64 `db:"count"`
+}
+
+type dbPathCount struct {
+	Path  string `db:"path"`
+	Count uint64 `db:"count"`
+}
+
+type dbHostFacts struct {
+	ID           uint64         `db:"id"`
+	Hostname     string         `db:"hostname"`
+	OsRelease    string         `db:"os_release"`
+	Kernel       string         `db:"kernel"`
+	AgentVersion string         `db:"agent_version"`
+	IPAddresses  pq.StringArray `db:"ip_addresses"`
+	ReportedAt   int64          `db:"reported_at"`
+	AgentID      uint64         `db:"fk_agent_id"`
+}
+
+func (d dbHostFacts) toHostFacts() models.HostFacts {
+	return models.HostFacts{
+		ID:           d.ID,
+		Hostname:     d.Hostname,
+		OsRelease:    d.OsRelease,
+		Kernel:       d.Kernel,
+		AgentVersion: d.AgentVersion,
+		IPAddresses:  d.IPAddresses,
+		ReportedAt:   d.ReportedAt,
+		AgentID:      d.AgentID,
+	}
+}
+
+type dbHostFactsList []dbHostFacts
+
+func (d dbHostFactsList) toHostFacts() []models.HostFacts {
+	conv := make([]models.HostFacts, len(d))
+	for i, facts := range d {
+		conv[i] = facts.toHostFacts()
+	}
+
+	return conv
+}
+
 type dbFsObject struct {
 	ID       uint64 `db:"id"`
 	Path     string `db:"path"`
@@ -124,3 +259,177 @@ func (d dbRules) toRules() []casbin.Rule {
 
 	return conv
 }
+
+type dbNotification struct {
+	ID          uint64 `db:"id"`
+	Webhook     string `db:"webhook"`
+	Payload     []byte `db:"payload"`
+	ContentType string `db:"content_type"`
+	Attempts    uint32 `db:"attempts"`
+	NextAttempt int64  `db:"next_attempt"`
+}
+
+func (d dbNotification) toMessage() notifier.Message {
+	return notifier.Message(d)
+}
+
+type dbNotifications []dbNotification
+
+func (d dbNotifications) toMessages() []notifier.Message {
+	conv := make([]notifier.Message, len(d))
+	for i, msg := range d {
+		conv[i] = msg.toMessage()
+	}
+
+	return conv
+}
+
+type dbRevocation struct {
+	ID        uint64 `db:"id"`
+	Serial    string `db:"serial"`
+	Reason    string `db:"reason"`
+	RevokedBy string `db:"revoked_by"`
+	RevokedAt int64  `db:"revoked_at"`
+}
+
+func (d dbRevocation) toRevocation() models.Revocation {
+	return models.Revocation{
+		ID:        d.ID,
+		Serial:    d.Serial,
+		Reason:    d.Reason,
+		RevokedBy: d.RevokedBy,
+		RevokedAt: d.RevokedAt,
+	}
+}
+
+type dbRevocationList []dbRevocation
+
+func (d dbRevocationList) toRevocations() []models.Revocation {
+	conv := make([]models.Revocation, len(d))
+	for i, rev := range d {
+		conv[i] = rev.toRevocation()
+	}
+
+	return conv
+}
+
+type dbEnrollmentToken struct {
+	ID         uint64 `db:"id"`
+	TokenHash  string `db:"token_hash"`
+	ExpiresAt  int64  `db:"expires_at"`
+	EndpointID uint64 `db:"fk_endpoint_id"`
+}
+
+func (d dbEnrollmentToken) toEnrollmentToken() models.EnrollmentToken {
+	return models.EnrollmentToken{
+		ID:         d.ID,
+		TokenHash:  d.TokenHash,
+		ExpiresAt:  d.ExpiresAt,
+		EndpointID: d.EndpointID,
+	}
+}
+
+type dbAuditEntry struct {
+	ID            uint64 `db:"id"`
+	Actor         string `db:"actor"`
+	Action        string `db:"action"`
+	Target        string `db:"target"`
+	Parameters    string `db:"parameters"`
+	Result        string `db:"result"`
+	RemoteAddress string `db:"remote_address"`
+	CreatedAt     int64  `db:"created_at"`
+}
+
+func (d dbAuditEntry) toAuditEntry() models.AuditEntry {
+	return models.AuditEntry{
+		ID:            d.ID,
+		Actor:         d.Actor,
+		Action:        d.Action,
+		Target:        d.Target,
+		Parameters:    d.Parameters,
+		Result:        d.Result,
+		RemoteAddress: d.RemoteAddress,
+		CreatedAt:     d.CreatedAt,
+	}
+}
+
+type dbAuditEntries []dbAuditEntry
+
+func (d dbAuditEntries) toAuditEntries() []models.AuditEntry {
+	conv := make([]models.AuditEntry, len(d))
+	for i, entry := range d {
+		conv[i] = entry.toAuditEntry()
+	}
+
+	return conv
+}
+
+type dbChainLink struct {
+	ID      uint64 `db:"id"`
+	Source  string `db:"source"`
+	RowID   uint64 `db:"row_id"`
+	AgentID uint64 `db:"agent_id"`
+	RowHash string `db:"row_hash"`
+	Hash    string `db:"hash"`
+}
+
+func (d dbChainLink) toChainLink() models.ChainLink {
+	return models.ChainLink(d)
+}
+
+type dbChainLinks []dbChainLink
+
+func (d dbChainLinks) toChainLinks() []models.ChainLink {
+	conv := make([]models.ChainLink, len(d))
+	for i, link := range d {
+		conv[i] = link.toChainLink()
+	}
+
+	return conv
+}
+
+type dbChainCheckpoint struct {
+	ID          uint64 `db:"id"`
+	LinkID      uint64 `db:"fk_link_id"`
+	Hash        string `db:"hash"`
+	Certificate string `db:"certificate"`
+	Signature   []byte `db:"signature"`
+	CreatedAt   int64  `db:"created_at"`
+}
+
+func (d dbChainCheckpoint) toChainCheckpoint() models.ChainCheckpoint {
+	return models.ChainCheckpoint(d)
+}
+
+type dbChainCheckpoints []dbChainCheckpoint
+
+func (d dbChainCheckpoints) toChainCheckpoints() []models.ChainCheckpoint {
+	conv := make([]models.ChainCheckpoint, len(d))
+	for i, cp := range d {
+		conv[i] = cp.toChainCheckpoint()
+	}
+
+	return conv
+}
+
+type dbBaselineApproval struct {
+	ID        uint64 `db:"id"`
+	AgentID   uint64 `db:"fk_agent_id"`
+	Approver  string `db:"approver"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+func (d dbBaselineApproval) toBaselineApproval() models.BaselineApproval {
+	return models.BaselineApproval(d)
+}
+
+type dbBaselineApprovals []dbBaselineApproval
+
+func (d dbBaselineApprovals) toBaselineApprovals() []models.BaselineApproval {
+	conv := make([]models.BaselineApproval, len(d))
+	for i, approval := range d {
+		conv[i] = approval.toBaselineApproval()
+	}
+
+	return conv
+}
@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/Leantar/fimserver/modules/notifier"
+	"github.com/jmoiron/sqlx"
+)
+
+type PgNotificationRepository struct {
+	db *sqlx.DB
+}
+
+func (n *PgNotificationRepository) Create(ctx context.Context, msg notifier.Message) error {
+	ctx, done := instrument(ctx, "PgNotificationRepository.Create")
+	defer done()
+
+	return insertNotification(ctx, n.db, msg)
+}
+
+func insertNotification(ctx context.Context, db sqlx.ExecerContext, msg notifier.Message) error {
+	const query = "INSERT INTO notifications(webhook, payload, content_type, attempts, next_attempt) VALUES($1,$2,$3,$4,$5)"
+
+	_, err := db.ExecContext(ctx, query, msg.Webhook, msg.Payload, msg.ContentType, msg.Attempts, msg.NextAttempt)
+
+	return err
+}
+
+func (n *PgNotificationRepository) Claim(ctx context.Context, now, leaseUntil int64, limit int) ([]notifier.Message, error) {
+	ctx, done := instrument(ctx, "PgNotificationRepository.Claim")
+	defer done()
+
+	// Moving next_attempt into the future hides the claimed messages from other server instances
+	const query = `UPDATE notifications SET next_attempt = $1 WHERE id IN (
+		SELECT id FROM notifications WHERE next_attempt <= $2 ORDER BY id ASC LIMIT $3 FOR UPDATE SKIP LOCKED
+	) RETURNING *`
+	msgs := make(dbNotifications, 0)
+
+	err := n.db.SelectContext(ctx, &msgs, query, leaseUntil, now, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return msgs.toMessages(), nil
+}
+
+func (n *PgNotificationRepository) Reschedule(ctx context.Context, id uint64, attempts uint32, nextAttempt int64) (err error) {
+	ctx, done := instrument(ctx, "PgNotificationRepository.Reschedule")
+	defer done()
+
+	const query = "UPDATE notifications SET attempts = $1, next_attempt = $2 WHERE id = $3"
+
+	_, err = n.db.ExecContext(ctx, query, attempts, nextAttempt, id)
+
+	return
+}
+
+func (n *PgNotificationRepository) Delete(ctx context.Context, id uint64) (err error) {
+	ctx, done := instrument(ctx, "PgNotificationRepository.Delete")
+	defer done()
+
+	const query = "DELETE FROM notifications WHERE id = $1"
+
+	_, err = n.db.ExecContext(ctx, query, id)
+
+	return
+}
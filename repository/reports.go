@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/report"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+type PgReportRepository struct {
+	db *sqlx.DB
+}
+
+func (r *PgReportRepository) GetAgents(ctx context.Context) ([]models.Endpoint, error) {
+	endpoints := PgEndpointRepository{db: r.db}
+
+	return endpoints.GetAgents(ctx)
+}
+
+func (r *PgReportRepository) GetPendingApprovalAgentIDs(ctx context.Context) (map[uint64]bool, error) {
+	approvals := PgBaselineApprovalRepository{db: r.db}
+
+	return approvals.GetPendingAgentIDs(ctx)
+}
+
+// CountAlertsBetween counts the alerts issued from from until before to
+func (r *PgReportRepository) CountAlertsBetween(ctx context.Context, agentIDs []uint64, from, to int64) ([]report.AlertCount, error) {
+	ctx, done := instrument(ctx, "PgReportRepository.CountAlertsBetween")
+	defer done()
+
+	const query = `SELECT kind, severity, COUNT(*) AS count FROM alerts
+		WHERE fk_agent_id = ANY($1) AND issued_at >= $2 AND issued_at < $3
+		GROUP BY kind, severity ORDER BY kind, severity`
+	rows := make([]dbAlertCount, 0)
+
+	err := r.db.SelectContext(ctx, &rows, query, pq.Array(toInt64s(agentIDs)), from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]report.AlertCount, len(rows))
+	for i, row := range rows {
+		counts[i] = report.AlertCount(row)
+	}
+
+	return counts, nil
+}
+
+// GetTopPathsBetween returns the paths with the most alerts issued from from until before to
+func (r *PgReportRepository) GetTopPathsBetween(ctx context.Context, agentIDs []uint64, from, to int64, limit int) ([]report.PathCount, error) {
+	ctx, done := instrument(ctx, "PgReportRepository.GetTopPathsBetween")
+	defer done()
+
+	const query = `SELECT path, COUNT(*) AS count FROM alerts
+		WHERE fk_agent_id = ANY($1) AND issued_at >= $2 AND issued_at < $3
+		GROUP BY path ORDER BY count DESC, path ASC LIMIT $4`
+	rows := make([]dbPathCount, 0)
+
+	err := r.db.SelectContext(ctx, &rows, query, pq.Array(toInt64s(agentIDs)), from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]report.PathCount, len(rows))
+	for i, row := range rows {
+		paths[i] = report.PathCount(row)
+	}
+
+	return paths, nil
+}
+
+// ClaimDigest records that the digest of the group for the period that ends at periodEnd is generated. It returns
+// false if another server instance already claimed it.
+func (r *PgReportRepository) ClaimDigest(ctx context.Context, group string, periodEnd, now int64) (bool, error) {
+	ctx, done := instrument(ctx, "PgReportRepository.ClaimDigest")
+	defer done()
+
+	const query = "INSERT INTO digest_runs(group_name, period_end, created_at) VALUES($1,$2,$3) ON CONFLICT DO NOTHING"
+
+	res, err := r.db.ExecContext(ctx, query, group, periodEnd, now)
+	if err != nil {
+		return false, err
+	}
+
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return claimed == 1, nil
+}
+
+// ReleaseDigest removes the claim of a digest that couldn't be generated, so that it can be generated again
+func (r *PgReportRepository) ReleaseDigest(ctx context.Context, group string, periodEnd int64) (err error) {
+	ctx, done := instrument(ctx, "PgReportRepository.ReleaseDigest")
+	defer done()
+
+	const query = "DELETE FROM digest_runs WHERE group_name = $1 AND period_end = $2"
+
+	_, err = r.db.ExecContext(ctx, query, group, periodEnd)
+
+	return
+}
+
+func (r *PgReportRepository) IsEmptyResultSetError(err error) bool {
+	return isEmptyResultSetError(err)
+}
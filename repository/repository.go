@@ -1,18 +1,28 @@
 package repository
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/Leantar/fimserver/modules/casbin"
+	"github.com/Leantar/fimserver/modules/notifier"
+	"github.com/Leantar/fimserver/modules/report"
 	"github.com/Leantar/fimserver/server"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/rs/zerolog/log"
 )
 
 var errEmptyResultSet = errors.New("result set was empty")
 
+// Every inserted alert is announced on this channel by a trigger
+const alertChannel = "fim_alerts"
+
+// Every statement that changes the rules table is announced on this channel by a trigger
+const ruleChannel = "fim_rules"
+
 type Config struct {
 	Host     string `yaml:"host"`
 	Port     int64  `yaml:"port"`
@@ -23,7 +33,8 @@ type Config struct {
 }
 
 type PgRepository struct {
-	db *sqlx.DB
+	db  *sqlx.DB
+	dsn string
 }
 
 func New(conf Config) *PgRepository {
@@ -35,18 +46,80 @@ func New(conf Config) *PgRepository {
 		log.Fatal().Caller().Err(err).Msg("failed to connect to database")
 	}
 
-	return &PgRepository{db: db}
+	return &PgRepository{db: db, dsn: dsn}
+}
+
+// Held while migrating, so that concurrent migrations of the same database don't apply a migration twice
+const migrationLockID = 0x66696d6d
+
+// CheckSchema fails if the database hasn't been migrated to the version this build needs
+func (r *PgRepository) CheckSchema(ctx context.Context) error {
+	version, err := schemaVersion(ctx, r.db)
+	if err != nil {
+		return err
+	}
+
+	if version < len(migrations) {
+		return fmt.Errorf("database schema is at version %d, but %d is required. run with -reconcile to migrate it", version, len(migrations))
+	}
+
+	return nil
 }
 
-func (r *PgRepository) ApplySchema() error {
-	for _, schema := range schemas {
-		_, err := r.db.Exec(schema)
+// schemaVersion returns the number of applied migrations
+func schemaVersion(ctx context.Context, db dbtx) (int, error) {
+	var exists bool
+	err := db.GetContext(ctx, &exists, "SELECT to_regclass('schema_migrations') IS NOT NULL")
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	var version int
+	err = db.GetContext(ctx, &version, "SELECT COALESCE(MAX(version) + 1, 0) FROM schema_migrations")
+
+	return version, err
+}
+
+// Migrate applies the migrations that are missing in the database and returns their names
+func (t *PgTx) Migrate(ctx context.Context) ([]string, error) {
+	_, err := t.tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at BIGINT NOT NULL);`)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := schemaVersion(ctx, t.tx)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make([]string, 0)
+	for ; version < len(migrations); version++ {
+		m := migrations[version]
+		for _, statement := range m.statements {
+			_, err = t.tx.ExecContext(ctx, statement)
+			if err != nil {
+				return nil, fmt.Errorf("migration %d '%s': %w", version, m.name, err)
+			}
+		}
+
+		const query = "INSERT INTO schema_migrations(version, name, applied_at) VALUES($1,$2,$3)"
+
+		_, err = t.tx.ExecContext(ctx, query, version, m.name, time.Now().Unix())
 		if err != nil {
-			return err
+			return nil, err
 		}
+		applied = append(applied, m.name)
 	}
 
-	return nil
+	return applied, nil
 }
 
 func (r *PgRepository) Endpoints() server.EndpointRepository {
@@ -67,12 +140,138 @@ func (r *PgRepository) Alerts() server.AlertRepository {
 	}
 }
 
+func (r *PgRepository) HostFacts() server.HostFactsRepository {
+	return &PgHostFactsRepository{
+		db: r.db,
+	}
+}
+
+func (r *PgRepository) BaselineApprovals() server.BaselineApprovalRepository {
+	return &PgBaselineApprovalRepository{
+		db: r.db,
+	}
+}
+
+func (r *PgRepository) Audit() server.AuditRepository {
+	return &PgAuditRepository{
+		db: r.db,
+	}
+}
+
+func (r *PgRepository) Chain() server.ChainRepository {
+	return &PgChainRepository{
+		db: r.db,
+	}
+}
+
+func (r *PgRepository) EnrollmentTokens() server.EnrollmentTokenRepository {
+	return &PgEnrollmentTokenRepository{
+		db: r.db,
+	}
+}
+
+func (r *PgRepository) Revocations() server.RevocationRepository {
+	return &PgRevocationRepository{
+		db: r.db,
+	}
+}
+
 func (r *PgRepository) Rules() casbin.RuleRepository {
 	return &PgRuleRepository{
 		db: r.db,
 	}
 }
 
+func (r *PgRepository) Notifications() notifier.OutboxRepository {
+	return &PgNotificationRepository{
+		db: r.db,
+	}
+}
+
+// ListenForAlerts signals whenever an alert was inserted by any server instance.
+// Signals are also sent after the listener reconnected, because notifications may have been missed.
+// The listener is closed and the channel with it once ctx is done.
+func (r *PgRepository) ListenForAlerts(ctx context.Context) (<-chan struct{}, error) {
+	return r.listen(ctx, alertChannel)
+}
+
+// ListenForRuleChanges signals whenever the rules table was changed, including changes that were made by hand
+func (r *PgRepository) ListenForRuleChanges(ctx context.Context) (<-chan struct{}, error) {
+	return r.listen(ctx, ruleChannel)
+}
+
+func (r *PgRepository) listen(ctx context.Context, channel string) (<-chan struct{}, error) {
+	listener := pq.NewListener(r.dsn, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Warn().Err(err).Msgf("listener for '%s' lost connection", channel)
+		}
+	})
+
+	err := listener.Listen(channel)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	signals := make(chan struct{}, 1)
+	go func() {
+		defer close(signals)
+		defer listener.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-listener.Notify:
+				select {
+				case signals <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return signals, nil
+}
+
+func (r *PgRepository) Reports() report.Repository {
+	return &PgReportRepository{
+		db: r.db,
+	}
+}
+
+// InTx runs fn with repositories whose changes are committed together if fn succeeds and rolled back otherwise
+func (r *PgRepository) InTx(ctx context.Context, fn func(tx *PgTx) error) error {
+	return withTx(ctx, r.db, func(tx *sqlx.Tx) error {
+		return fn(&PgTx{tx: tx})
+	})
+}
+
+// PgTx gives the repositories that reconciling the bootstrap file needs, running in a single transaction
+type PgTx struct {
+	tx *sqlx.Tx
+}
+
+func (t *PgTx) Endpoints() *PgEndpointRepository {
+	return &PgEndpointRepository{
+		db: t.tx,
+	}
+}
+
+func (t *PgTx) Rules() *PgRuleRepository {
+	return &PgRuleRepository{
+		db: t.tx,
+	}
+}
+
+func (t *PgTx) IsEmptyResultSetError(err error) bool {
+	return isEmptyResultSetError(err)
+}
+
 func (r *PgRepository) IsEmptyResultSetError(err error) bool {
+	return isEmptyResultSetError(err)
+}
+
+func isEmptyResultSetError(err error) bool {
 	return errors.Is(err, errEmptyResultSet)
 }
@@ -0,0 +1,42 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/jmoiron/sqlx"
+)
+
+type PgRevocationRepository struct {
+	db *sqlx.DB
+}
+
+func (r *PgRevocationRepository) Create(ctx context.Context, rev models.Revocation) (err error) {
+	ctx, done := instrument(ctx, "PgRevocationRepository.Create")
+	defer done()
+
+	const query = "INSERT INTO revocations(serial, reason, revoked_by, revoked_at) VALUES($1,$2,$3,$4)"
+
+	_, err = r.db.ExecContext(ctx, query, rev.Serial, rev.Reason, rev.RevokedBy, rev.RevokedAt)
+
+	return
+}
+
+func (r *PgRevocationRepository) GetAll(ctx context.Context) ([]models.Revocation, error) {
+	ctx, done := instrument(ctx, "PgRevocationRepository.GetAll")
+	defer done()
+
+	const query = "SELECT * FROM revocations ORDER BY id"
+	rows := make(dbRevocationList, 0)
+
+	err := r.db.SelectContext(ctx, &rows, query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return nil, errEmptyResultSet
+	}
+
+	return rows.toRevocations(), nil
+}
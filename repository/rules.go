@@ -5,14 +5,18 @@ import (
 
 	"github.com/Leantar/fimserver/modules/casbin"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 type PgRuleRepository struct {
-	db *sqlx.DB
+	db dbtx
 	sqlx.Tx
 }
 
 func (r *PgRuleRepository) Create(ctx context.Context, li casbin.Rule) (err error) {
+	ctx, done := instrument(ctx, "PgRuleRepository.Create")
+	defer done()
+
 	const query = "INSERT INTO rules(p_type,v0,v1,v2,v3,v4,v5) VALUES($1,$2,$3,$4,$5,$6,$7)"
 
 	_, err = r.db.ExecContext(ctx, query, li.PType, li.V0, li.V1, li.V2, li.V3, li.V4, li.V5)
@@ -21,6 +25,9 @@ func (r *PgRuleRepository) Create(ctx context.Context, li casbin.Rule) (err erro
 }
 
 func (r *PgRuleRepository) GetAll(ctx context.Context) ([]casbin.Rule, error) {
+	ctx, done := instrument(ctx, "PgRuleRepository.GetAll")
+	defer done()
+
 	const query = "SELECT * from rules"
 	rules := make(dbRules, 0)
 
@@ -36,7 +43,46 @@ func (r *PgRuleRepository) GetAll(ctx context.Context) ([]casbin.Rule, error) {
 	return rules.toRules(), nil
 }
 
+// The placeholders are filled by ruleFilterArgs
+const ruleFilterCondition = `(cardinality($1::TEXT[]) = 0 OR p_type = ANY($1))
+		AND (cardinality($2::TEXT[]) = 0 OR v0 = ANY($2))
+		AND (cardinality($3::TEXT[]) = 0 OR v1 = ANY($3))
+		AND (cardinality($4::TEXT[]) = 0 OR v2 = ANY($4))
+		AND (cardinality($5::TEXT[]) = 0 OR v3 = ANY($5))
+		AND (cardinality($6::TEXT[]) = 0 OR v4 = ANY($6))
+		AND (cardinality($7::TEXT[]) = 0 OR v5 = ANY($7))`
+
+func ruleFilterArgs(filter casbin.Filter) []interface{} {
+	return []interface{}{
+		pq.Array(filter.PType),
+		pq.Array(filter.V0),
+		pq.Array(filter.V1),
+		pq.Array(filter.V2),
+		pq.Array(filter.V3),
+		pq.Array(filter.V4),
+		pq.Array(filter.V5),
+	}
+}
+
+func (r *PgRuleRepository) GetFiltered(ctx context.Context, filter casbin.Filter) ([]casbin.Rule, error) {
+	ctx, done := instrument(ctx, "PgRuleRepository.GetFiltered")
+	defer done()
+
+	const query = "SELECT * FROM rules WHERE " + ruleFilterCondition
+	rules := make(dbRules, 0)
+
+	err := r.db.SelectContext(ctx, &rules, query, ruleFilterArgs(filter)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return rules.toRules(), nil
+}
+
 func (r *PgRuleRepository) Delete(ctx context.Context, li casbin.Rule) (err error) {
+	ctx, done := instrument(ctx, "PgRuleRepository.Delete")
+	defer done()
+
 	const query = "DELETE FROM rules WHERE p_type = $1 AND v0 = $2 AND v1 = $3 AND v2 = $4 AND v3 = $5 AND v4 = $6 AND v5 = $7"
 
 	_, err = r.db.ExecContext(ctx, query, li.PType, li.V0, li.V1, li.V2, li.V3, li.V4, li.V5)
@@ -44,7 +90,21 @@ func (r *PgRuleRepository) Delete(ctx context.Context, li casbin.Rule) (err erro
 	return
 }
 
+func (r *PgRuleRepository) DeleteFiltered(ctx context.Context, filter casbin.Filter) (err error) {
+	ctx, done := instrument(ctx, "PgRuleRepository.DeleteFiltered")
+	defer done()
+
+	const query = "DELETE FROM rules WHERE " + ruleFilterCondition
+
+	_, err = r.db.ExecContext(ctx, query, ruleFilterArgs(filter)...)
+
+	return
+}
+
 func (r *PgRuleRepository) DeleteAll(ctx context.Context) (err error) {
+	ctx, done := instrument(ctx, "PgRuleRepository.DeleteAll")
+	defer done()
+
 	const query = "DELETE FROM rules"
 
 	_, err = r.db.ExecContext(ctx, query)
@@ -1,48 +1,298 @@
 package repository
 
-var schemas = [...]string{
-	`CREATE TABLE endpoints (
-		id BIGSERIAL PRIMARY KEY,
-		name TEXT UNIQUE NOT NULL,
-		kind VARCHAR(32) NOT NULL,
-		roles TEXT[] NOT NULL,
-		has_baseline BOOLEAN NOT NULL,
-		baseline_is_current BOOLEAN NOT NULL,
-		watched_paths TEXT[] NOT NULL
-	);`,
-	`CREATE TABLE baseline_fs_objects (
-		id BIGSERIAL PRIMARY KEY,
-		path TEXT NOT NULL,
-		hash VARCHAR(64) NOT NULL,
-		created BIGINT NOT NULL,
-		modified BIGINT NOT NULL,
-		uid INT NOT NULL,
-		gid INT NOT NULL,
-		mode BIGINT NOT NULL,
-		fk_agent_id BIGINT NOT NULL,
-		UNIQUE (path, fk_agent_id),
-		FOREIGN KEY (fk_agent_id)
-			REFERENCES endpoints(id)
-			ON DELETE CASCADE);`,
-	`CREATE TABLE alerts (
-		id BIGSERIAL PRIMARY KEY,
-		kind VARCHAR(32) NOT NULL,
-		difference TEXT NOT NULL,
-		issued_at BIGINT NOT NULL,
-		path TEXT NOT NULL,
-		modified BIGINT NOT NULL,
-		fk_agent_id BIGINT NOT NULL,
-		FOREIGN KEY (fk_agent_id)
-			REFERENCES endpoints(id)
-			ON DELETE CASCADE);`,
-	`CREATE TABLE rules (
-		id BIGSERIAL PRIMARY KEY,
-		p_type VARCHAR(100) NOT NULL,
-		v0 VARCHAR(100) NOT NULL DEFAULT '',
-		v1 VARCHAR(100) NOT NULL DEFAULT '',
-		v2 VARCHAR(100) NOT NULL DEFAULT '',
-		v3 VARCHAR(100) NOT NULL DEFAULT '',
-		v4 VARCHAR(100) NOT NULL DEFAULT '',
-		v5 VARCHAR(100) NOT NULL DEFAULT '',
-		UNIQUE (p_type, v0, v1, v2, v3, v4, v5));`,
+// migration changes the schema from the previous version. Its statements are idempotent, so that databases which were
+// set up before versioning was introduced, and already have some of the changes, can be migrated as well.
+type migration struct {
+	name       string
+	statements []string
+}
+
+// migrations are applied in order. The version of a migration is its index. Applied migrations must never be changed,
+// every schema change needs a new one.
+var migrations = [...]migration{
+	{
+		name: "baseline",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS endpoints (
+				id BIGSERIAL PRIMARY KEY,
+				name TEXT UNIQUE NOT NULL,
+				kind VARCHAR(32) NOT NULL,
+				roles TEXT[] NOT NULL,
+				has_baseline BOOLEAN NOT NULL,
+				baseline_is_current BOOLEAN NOT NULL,
+				watched_paths TEXT[] NOT NULL
+			);`,
+			`CREATE TABLE IF NOT EXISTS baseline_fs_objects (
+				id BIGSERIAL PRIMARY KEY,
+				path TEXT NOT NULL,
+				hash VARCHAR(64) NOT NULL,
+				created BIGINT NOT NULL,
+				modified BIGINT NOT NULL,
+				uid INT NOT NULL,
+				gid INT NOT NULL,
+				mode BIGINT NOT NULL,
+				fk_agent_id BIGINT NOT NULL,
+				UNIQUE (path, fk_agent_id),
+				FOREIGN KEY (fk_agent_id)
+					REFERENCES endpoints(id)
+					ON DELETE CASCADE);`,
+			`CREATE TABLE IF NOT EXISTS alerts (
+				id BIGSERIAL PRIMARY KEY,
+				kind VARCHAR(32) NOT NULL,
+				difference TEXT NOT NULL,
+				issued_at BIGINT NOT NULL,
+				path TEXT NOT NULL,
+				modified BIGINT NOT NULL,
+				fk_agent_id BIGINT NOT NULL,
+				FOREIGN KEY (fk_agent_id)
+					REFERENCES endpoints(id)
+					ON DELETE CASCADE);`,
+			`CREATE TABLE IF NOT EXISTS rules (
+				id BIGSERIAL PRIMARY KEY,
+				p_type VARCHAR(100) NOT NULL,
+				v0 VARCHAR(100) NOT NULL DEFAULT '',
+				v1 VARCHAR(100) NOT NULL DEFAULT '',
+				v2 VARCHAR(100) NOT NULL DEFAULT '',
+				v3 VARCHAR(100) NOT NULL DEFAULT '',
+				v4 VARCHAR(100) NOT NULL DEFAULT '',
+				v5 VARCHAR(100) NOT NULL DEFAULT '',
+				UNIQUE (p_type, v0, v1, v2, v3, v4, v5));`,
+		},
+	},
+	{
+		name: "alert severity",
+		statements: []string{
+			`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS severity VARCHAR(16);`,
+			// Existing alerts get the severity of their kind, like new ones do
+			`UPDATE alerts SET severity = CASE kind
+				WHEN 'CREATE' THEN 'LOW'
+				WHEN 'TIMESTOMP' THEN 'HIGH'
+				ELSE 'MEDIUM' END
+			WHERE severity IS NULL;`,
+			`ALTER TABLE alerts ALTER COLUMN severity SET NOT NULL;`,
+		},
+	},
+	{
+		name: "last scan",
+		statements: []string{
+			`ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS last_scan BIGINT NOT NULL DEFAULT 0;`,
+			`CREATE INDEX IF NOT EXISTS alerts_agent_path_idx ON alerts(fk_agent_id, path, id);`,
+		},
+	},
+	{
+		name: "notifications",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS notifications (
+				id BIGSERIAL PRIMARY KEY,
+				webhook TEXT NOT NULL,
+				payload BYTEA NOT NULL,
+				attempts INT NOT NULL,
+				next_attempt BIGINT NOT NULL);`,
+			`CREATE INDEX IF NOT EXISTS notifications_next_attempt_idx ON notifications(next_attempt);`,
+		},
+	},
+	{
+		name: "alert differences",
+		statements: []string{
+			`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS differences JSONB NOT NULL DEFAULT '[]';`,
+		},
+	},
+	{
+		name: "alert notifications",
+		statements: []string{
+			`CREATE OR REPLACE FUNCTION notify_alert() RETURNS trigger AS $$
+			BEGIN
+				PERFORM pg_notify('` + alertChannel + `', NEW.id::text);
+				RETURN NEW;
+			END;
+			$$ LANGUAGE plpgsql;`,
+			`DROP TRIGGER IF EXISTS alerts_notify ON alerts;`,
+			`CREATE TRIGGER alerts_notify AFTER INSERT ON alerts
+				FOR EACH ROW EXECUTE PROCEDURE notify_alert();`,
+		},
+	},
+	{
+		name: "notification content type",
+		statements: []string{
+			// Only JSON alerts were queued before digests were added
+			`ALTER TABLE notifications ADD COLUMN IF NOT EXISTS content_type TEXT NOT NULL DEFAULT 'application/json';`,
+			`ALTER TABLE notifications ALTER COLUMN content_type DROP DEFAULT;`,
+		},
+	},
+	{
+		name: "alert query indexes",
+		statements: []string{
+			`CREATE INDEX IF NOT EXISTS alerts_agent_issued_at_idx ON alerts(fk_agent_id, issued_at, id);`,
+			`CREATE INDEX IF NOT EXISTS alerts_issued_at_idx ON alerts(issued_at, id);`,
+			`CREATE INDEX IF NOT EXISTS alerts_path_idx ON alerts(path text_pattern_ops);`,
+		},
+	},
+	{
+		name: "last seen",
+		statements: []string{
+			`ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS last_seen BIGINT NOT NULL DEFAULT 0;`,
+			`ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS remote_address TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS is_silent BOOLEAN NOT NULL DEFAULT FALSE;`,
+		},
+	},
+	{
+		name: "host facts",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS host_facts (
+				id BIGSERIAL PRIMARY KEY,
+				hostname TEXT NOT NULL,
+				os_release TEXT NOT NULL,
+				kernel TEXT NOT NULL,
+				agent_version TEXT NOT NULL,
+				ip_addresses TEXT[] NOT NULL,
+				reported_at BIGINT NOT NULL,
+				fk_agent_id BIGINT NOT NULL,
+				FOREIGN KEY (fk_agent_id)
+					REFERENCES endpoints(id)
+					ON DELETE CASCADE);`,
+			`CREATE INDEX IF NOT EXISTS host_facts_agent_idx ON host_facts(fk_agent_id, id);`,
+		},
+	},
+	{
+		name: "disabled endpoints",
+		statements: []string{
+			`ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT FALSE;`,
+		},
+	},
+	{
+		name: "rule notifications",
+		statements: []string{
+			`CREATE OR REPLACE FUNCTION notify_rules() RETURNS trigger AS $$
+			BEGIN
+				PERFORM pg_notify('` + ruleChannel + `', '');
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql;`,
+			`DROP TRIGGER IF EXISTS rules_notify ON rules;`,
+			`CREATE TRIGGER rules_notify AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON rules
+				FOR EACH STATEMENT EXECUTE PROCEDURE notify_rules();`,
+		},
+	},
+	{
+		name: "revocations",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS revocations (
+				id BIGSERIAL PRIMARY KEY,
+				serial TEXT NOT NULL UNIQUE,
+				reason TEXT NOT NULL,
+				revoked_by TEXT NOT NULL,
+				revoked_at BIGINT NOT NULL);`,
+		},
+	},
+	{
+		name: "enrollment tokens",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS enrollment_tokens (
+				id BIGSERIAL PRIMARY KEY,
+				token_hash TEXT NOT NULL UNIQUE,
+				expires_at BIGINT NOT NULL,
+				fk_endpoint_id BIGINT NOT NULL UNIQUE,
+				FOREIGN KEY (fk_endpoint_id)
+					REFERENCES endpoints(id)
+					ON DELETE CASCADE);`,
+		},
+	},
+	{
+		name: "endpoint credentials",
+		statements: []string{
+			`ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS cert_pins TEXT[] NOT NULL DEFAULT '{}';`,
+			`ALTER TABLE endpoints ADD COLUMN IF NOT EXISTS uri_identity TEXT UNIQUE;`,
+		},
+	},
+	{
+		name: "audit log",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS audit_log (
+				id BIGSERIAL PRIMARY KEY,
+				actor TEXT NOT NULL,
+				action TEXT NOT NULL,
+				target TEXT NOT NULL,
+				parameters TEXT NOT NULL,
+				result TEXT NOT NULL,
+				remote_address TEXT NOT NULL,
+				created_at BIGINT NOT NULL);`,
+			`CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log(created_at);`,
+			`CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON audit_log(actor, id);`,
+			`CREATE INDEX IF NOT EXISTS audit_log_target_idx ON audit_log(target, id);`,
+			`CREATE OR REPLACE FUNCTION reject_change() RETURNS trigger AS $$
+			BEGIN
+				RAISE EXCEPTION '% is append-only', TG_TABLE_NAME;
+			END;
+			$$ LANGUAGE plpgsql;`,
+			`DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;`,
+			`CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+				FOR EACH STATEMENT EXECUTE PROCEDURE reject_change();`,
+			// Used by the trigger of the first version of the audit log
+			`DROP FUNCTION IF EXISTS reject_audit_log_change();`,
+		},
+	},
+	{
+		name: "chain",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS chain_links (
+				id BIGSERIAL PRIMARY KEY,
+				source VARCHAR(16) NOT NULL,
+				row_id BIGINT NOT NULL,
+				agent_id BIGINT NOT NULL,
+				row_hash TEXT NOT NULL,
+				hash TEXT NOT NULL);`,
+			`CREATE INDEX IF NOT EXISTS chain_links_row_idx ON chain_links(source, row_id);`,
+			`CREATE TABLE IF NOT EXISTS chain_checkpoints (
+				id BIGSERIAL PRIMARY KEY,
+				fk_link_id BIGINT NOT NULL,
+				hash TEXT NOT NULL,
+				certificate TEXT NOT NULL,
+				signature BYTEA NOT NULL,
+				created_at BIGINT NOT NULL,
+				FOREIGN KEY (fk_link_id)
+					REFERENCES chain_links(id));`,
+			`CREATE INDEX IF NOT EXISTS chain_checkpoints_link_idx ON chain_checkpoints(fk_link_id);`,
+			// Rows up to row_id were stored before the chain existed, so they aren't reported as unchained. The chain
+			// covers all rows if it was created together with the tables.
+			`CREATE TABLE IF NOT EXISTS chain_start (
+				source VARCHAR(16) PRIMARY KEY,
+				row_id BIGINT NOT NULL);`,
+			`INSERT INTO chain_start(source, row_id)
+				SELECT 'alert', CASE WHEN EXISTS (SELECT 1 FROM chain_links) THEN 0 ELSE COALESCE(MAX(id), 0) END FROM alerts
+				ON CONFLICT DO NOTHING;`,
+			`INSERT INTO chain_start(source, row_id)
+				SELECT 'audit', CASE WHEN EXISTS (SELECT 1 FROM chain_links) THEN 0 ELSE COALESCE(MAX(id), 0) END FROM audit_log
+				ON CONFLICT DO NOTHING;`,
+			`DROP TRIGGER IF EXISTS chain_links_append_only ON chain_links;`,
+			`CREATE TRIGGER chain_links_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON chain_links
+				FOR EACH STATEMENT EXECUTE PROCEDURE reject_change();`,
+			`DROP TRIGGER IF EXISTS chain_checkpoints_append_only ON chain_checkpoints;`,
+			`CREATE TRIGGER chain_checkpoints_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON chain_checkpoints
+				FOR EACH STATEMENT EXECUTE PROCEDURE reject_change();`,
+		},
+	},
+	{
+		name: "baseline approvals",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS baseline_approvals (
+				id BIGSERIAL PRIMARY KEY,
+				fk_agent_id BIGINT NOT NULL,
+				approver TEXT NOT NULL,
+				created_at BIGINT NOT NULL,
+				UNIQUE (fk_agent_id, approver),
+				FOREIGN KEY (fk_agent_id)
+					REFERENCES endpoints(id)
+					ON DELETE CASCADE);`,
+		},
+	},
+	{
+		name: "digest runs",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS digest_runs (
+				group_name TEXT NOT NULL,
+				period_end BIGINT NOT NULL,
+				created_at BIGINT NOT NULL,
+				PRIMARY KEY (group_name, period_end));`,
+		},
+	},
 }
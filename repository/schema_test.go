@@ -0,0 +1,50 @@
+package repository
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Databases set up before versioning already have some of the changes, so every migration must be safe to repeat
+func TestMigrationsAreIdempotent(t *testing.T) {
+	createTrigger := regexp.MustCompile(`^CREATE TRIGGER (\w+) .* ON (\w+)`)
+
+	for version, m := range migrations {
+		dropped := make(map[string]bool)
+
+		for _, statement := range m.statements {
+			s := strings.Join(strings.Fields(statement), " ")
+
+			switch {
+			case strings.HasPrefix(s, "CREATE TABLE "), strings.HasPrefix(s, "CREATE INDEX "):
+				if !strings.Contains(s, " IF NOT EXISTS ") {
+					t.Errorf("migration %d '%s': %q lacks IF NOT EXISTS", version, m.name, s)
+				}
+			case strings.HasPrefix(s, "ALTER TABLE ") && strings.Contains(s, " ADD COLUMN "):
+				if !strings.Contains(s, " ADD COLUMN IF NOT EXISTS ") {
+					t.Errorf("migration %d '%s': %q lacks IF NOT EXISTS", version, m.name, s)
+				}
+			case strings.HasPrefix(s, "CREATE FUNCTION "):
+				t.Errorf("migration %d '%s': %q must use CREATE OR REPLACE", version, m.name, s)
+			case strings.HasPrefix(s, "DROP TRIGGER IF EXISTS "):
+				dropped[strings.TrimSuffix(strings.TrimPrefix(s, "DROP TRIGGER IF EXISTS "), ";")] = true
+			case strings.HasPrefix(s, "CREATE TRIGGER "):
+				match := createTrigger.FindStringSubmatch(s)
+				if match == nil || !dropped[match[1]+" ON "+match[2]] {
+					t.Errorf("migration %d '%s': %q isn't preceded by DROP TRIGGER IF EXISTS", version, m.name, s)
+				}
+			}
+		}
+	}
+}
+
+func TestMigrationNamesAreUnique(t *testing.T) {
+	names := make(map[string]bool)
+	for _, m := range migrations {
+		if names[m.name] {
+			t.Errorf("migration '%s' exists twice", m.name)
+		}
+		names[m.name] = true
+	}
+}
@@ -1,5 +1,15 @@
 package repository
 
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Leantar/fimserver/modules/metrics"
+	"github.com/Leantar/fimserver/modules/tracing"
+	"github.com/jmoiron/sqlx"
+)
+
 func getMinimum(a, b int) int {
 	if a < b {
 		return a
@@ -7,3 +17,75 @@ func getMinimum(a, b int) int {
 		return b
 	}
 }
+
+// instrument starts a span for a repository method. The returned function ends the span and records the query latency.
+func instrument(ctx context.Context, method string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, method)
+
+	return ctx, func() {
+		span.End()
+		metrics.ObserveQuery(method, start)
+	}
+}
+
+// dbtx is implemented by both *sqlx.DB and *sqlx.Tx, so that repositories can run their queries in a transaction
+type dbtx interface {
+	sqlx.ExecerContext
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+}
+
+// withTx runs fn in a transaction, which is committed if fn succeeds and rolled back otherwise
+func withTx(ctx context.Context, db *sqlx.DB, fn func(tx *sqlx.Tx) error) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// toInt64s converts IDs for use with pq.Array, which doesn't support unsigned integers
+func toInt64s(ids []uint64) []int64 {
+	conv := make([]int64, len(ids))
+	for i, id := range ids {
+		conv[i] = int64(id)
+	}
+
+	return conv
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// escapeLike escapes the wildcards of a LIKE pattern with backslashes
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// globToLike converts a shell style pattern with * and ? wildcards to a LIKE pattern. An empty pattern matches everything.
+func globToLike(glob string) string {
+	if glob == "" {
+		return "%"
+	}
+
+	var b strings.Builder
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteByte('%')
+		case '?':
+			b.WriteByte('_')
+		default:
+			b.WriteString(escapeLike(string(r)))
+		}
+	}
+
+	return b.String()
+}
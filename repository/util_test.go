@@ -0,0 +1,44 @@
+package repository
+
+import "testing"
+
+func TestEscapeLike(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "/var/log", want: "/var/log"},
+		{in: "/tmp/100%", want: `/tmp/100\%`},
+		{in: "/etc/my_conf", want: `/etc/my\_conf`},
+		{in: `C:\Windows`, want: `C:\\Windows`},
+		{in: `\%`, want: `\\\%`},
+	}
+
+	for _, tt := range tests {
+		if got := escapeLike(tt.in); got != tt.want {
+			t.Errorf("escapeLike(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestGlobToLike(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "", want: "%"},
+		{in: "*", want: "%"},
+		{in: "/etc/*.conf", want: "/etc/%.conf"},
+		{in: "/var/log/syslog.?", want: "/var/log/syslog._"},
+		// LIKE wildcards in the glob match only themselves
+		{in: "/tmp/*_100%", want: `/tmp/%\_100\%`},
+		{in: `/a\*`, want: `/a\\%`},
+		{in: "/tmp/ä?", want: "/tmp/ä_"},
+	}
+
+	for _, tt := range tests {
+		if got := globToLike(tt.in); got != tt.want {
+			t.Errorf("globToLike(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
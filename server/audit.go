@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Leantar/fimproto/proto"
+	"github.com/Leantar/fimserver/models"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Calls of these RPCs are written to the audit log, including the ones that were denied or failed
+var auditedRPCs = map[string]bool{
+	"CreateBaselineUpdateApproval": true,
+	"CreateAgentEndpoint":          true,
+	"CreateClientEndpoint":         true,
+	"CreateEnrollmentToken":        true,
+	"DeleteEndpoint":               true,
+	"UpdateEndpointWatchedPaths":   true,
+	"UpdateClientEndpointRoles":    true,
+	"UpdateEndpointCredentials":    true,
+	"DisableEndpoint":              true,
+	"EnableEndpoint":               true,
+	"AddPolicyRule":                true,
+	"RemovePolicyRule":             true,
+	"RevokeCertificate":            true,
+}
+
+// Calls of these streaming RPCs are audited as well. Their requests are streams of file system objects, so only the
+// number of received messages is recorded.
+var auditedStreams = map[string]bool{
+	"CreateBaseline": true,
+	"UpdateBaseline": true,
+}
+
+const auditWriteTimeout = 10 * time.Second
+
+// auditCall records a call of an audited RPC by the authenticated endpoint in ctx. Returning the error wouldn't undo
+// the call, so it is only logged.
+func (s *Server) auditCall(ctx context.Context, rpc string, req interface{}, callErr error) {
+	if !auditedRPCs[rpc] {
+		return
+	}
+
+	s.writeCallEntry(ctx, rpc, auditTarget(req), auditParameters(req), callErr)
+}
+
+// auditStream records a call of an audited streaming RPC, which acts on the calling agent
+func (s *Server) auditStream(ctx context.Context, rpc string, received int, callErr error) {
+	actor := ctx.Value(endpointKey("endpoint")).(models.Endpoint)
+	params := fmt.Sprintf(`{"messages":%d}`, received)
+
+	s.writeCallEntry(ctx, rpc, actor.Name, params, callErr)
+}
+
+func (s *Server) writeCallEntry(ctx context.Context, rpc, target, params string, callErr error) {
+	actor := ctx.Value(endpointKey("endpoint")).(models.Endpoint)
+	remoteAddr, _ := ctx.Value(endpointKey("remote_address")).(string)
+
+	result := "OK"
+	if callErr != nil {
+		result = status.Code(callErr).String()
+	}
+
+	s.writeAuditEntry(models.AuditEntry{
+		Actor:         actor.Name,
+		Action:        rpc,
+		Target:        target,
+		Parameters:    params,
+		Result:        result,
+		RemoteAddress: remoteAddr,
+		CreatedAt:     time.Now().Unix(),
+	})
+}
+
+// auditParameters encodes the request with protojson, which knows the JSON names of the proto fields
+func auditParameters(req interface{}) string {
+	m, ok := req.(protoreflect.ProtoMessage)
+	if !ok {
+		return "null"
+	}
+
+	params, err := protojson.Marshal(m)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to encode audited request")
+		return "null"
+	}
+
+	return string(params)
+}
+
+// auditDisabled records the rejected call of a disabled endpoint. The request isn't known when endpoints are
+// authenticated, so it has no parameters.
+func (s *Server) auditDisabled(endpoint models.Endpoint, method, remoteAddr string) {
+	s.writeAuditEntry(models.AuditEntry{
+		Actor:         endpoint.Name,
+		Action:        strings.TrimPrefix(method, "/fim.Fim/"),
+		Parameters:    "null",
+		Result:        "DISABLED",
+		RemoteAddress: remoteAddr,
+		CreatedAt:     time.Now().Unix(),
+	})
+}
+
+func (s *Server) writeAuditEntry(entry models.AuditEntry) {
+	// Detached from the request, so that a client can't cancel the write by disconnecting right after the call
+	writeCtx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+	defer cancel()
+
+	err := s.repo.Audit().Create(writeCtx, entry)
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to write audit entry for '%s' by '%s'", entry.Action, entry.Actor)
+	}
+}
+
+// auditTarget names what a request acts on
+func auditTarget(req interface{}) string {
+	switch r := req.(type) {
+	case *proto.EndpointName:
+		return r.Name
+	case *proto.AgentEndpoint:
+		return r.Name
+	case *proto.ClientEndpoint:
+		return r.Name
+	case *proto.EndpointCredentials:
+		return r.Name
+	case *proto.PolicyRule:
+		return r.Rpc
+	case *proto.CertificateRevocation:
+		return r.Serial
+	default:
+		return ""
+	}
+}
+
+// StreamAuditInterceptor runs before authorization, so that denied calls are audited as well
+func (s *Server) StreamAuditInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	rpc := strings.TrimPrefix(info.FullMethod, "/fim.Fim/")
+	if !auditedStreams[rpc] {
+		return handler(srv, stream)
+	}
+
+	counted := &countingStream{ServerStream: stream}
+	err := handler(srv, counted)
+	s.auditStream(stream.Context(), rpc, counted.received, err)
+
+	return err
+}
+
+// countingStream counts the messages a handler received
+type countingStream struct {
+	grpc.ServerStream
+	received int
+}
+
+func (c *countingStream) RecvMsg(m interface{}) error {
+	err := c.ServerStream.RecvMsg(m)
+	if err == nil {
+		c.received++
+	}
+
+	return err
+}
+
+// UnaryAuditInterceptor runs before authorization, so that denied calls are audited as well
+func (s *Server) UnaryAuditInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	resp, err = handler(ctx, req)
+	s.auditCall(ctx, strings.TrimPrefix(info.FullMethod, "/fim.Fim/"), req, err)
+
+	return resp, err
+}
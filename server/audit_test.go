@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Leantar/fimserver/models"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// auditTestStream yields a number of messages and then io.EOF
+type auditTestStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	pending int
+}
+
+func (a *auditTestStream) Context() context.Context { return a.ctx }
+
+func (a *auditTestStream) RecvMsg(interface{}) error {
+	if a.pending == 0 {
+		return io.EOF
+	}
+	a.pending--
+	return nil
+}
+
+func TestStreamAuditInterceptor(t *testing.T) {
+	repo := &authTestRepo{}
+	s := &Server{repo: repo}
+
+	ctx := context.WithValue(context.Background(), endpointKey("endpoint"), models.Endpoint{Name: "agent1", Kind: "agent"})
+	ctx = context.WithValue(ctx, endpointKey("remote_address"), "10.0.0.1")
+
+	drain := func(_ interface{}, stream grpc.ServerStream) error {
+		for {
+			if err := stream.RecvMsg(nil); err == io.EOF {
+				return nil
+			}
+		}
+	}
+
+	err := s.StreamAuditInterceptor(nil, &auditTestStream{ctx: ctx, pending: 3},
+		&grpc.StreamServerInfo{FullMethod: "/fim.Fim/CreateBaseline", IsClientStream: true}, drain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Denied calls are audited, because authorization runs after the audit interceptor
+	denied := status.Error(codes.PermissionDenied, "unauthorized")
+	err = s.StreamAuditInterceptor(nil, &auditTestStream{ctx: ctx, pending: 3},
+		&grpc.StreamServerInfo{FullMethod: "/fim.Fim/UpdateBaseline", IsClientStream: true},
+		func(interface{}, grpc.ServerStream) error { return denied })
+	if err != denied {
+		t.Fatalf("interceptor returned %v, want %v", err, denied)
+	}
+
+	err = s.StreamAuditInterceptor(nil, &auditTestStream{ctx: ctx, pending: 3},
+		&grpc.StreamServerInfo{FullMethod: "/fim.Fim/ReportFsStatus", IsClientStream: true}, drain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []models.AuditEntry{
+		{Actor: "agent1", Action: "CreateBaseline", Target: "agent1", Parameters: `{"messages":3}`, Result: "OK", RemoteAddress: "10.0.0.1"},
+		{Actor: "agent1", Action: "UpdateBaseline", Target: "agent1", Parameters: `{"messages":0}`, Result: "PermissionDenied", RemoteAddress: "10.0.0.1"},
+	}
+	if !reflect.DeepEqual(repo.entries, want) {
+		t.Errorf("audit entries = %+v, want %+v", repo.entries, want)
+	}
+}
+
+func TestAuditParametersUseProtoJSON(t *testing.T) {
+	// encoding/json would write the struct fields of the message instead
+	got := auditParameters(durationpb.New(90 * time.Second))
+	if got != `"90s"` {
+		t.Errorf("auditParameters() = %s, want \"90s\"", got)
+	}
+
+	if got := auditParameters(nil); got != "null" {
+		t.Errorf("auditParameters(nil) = %s, want null", got)
+	}
+}
+
+func TestAuditedStreamsAreStreams(t *testing.T) {
+	for rpc := range auditedStreams {
+		if auditedRPCs[rpc] {
+			t.Errorf("'%s' is audited as a unary and a streaming RPC", rpc)
+		}
+	}
+}
@@ -2,7 +2,11 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+
+	"github.com/Leantar/fimserver/modules/metrics"
+	"github.com/Leantar/fimserver/modules/tracing"
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
@@ -14,7 +18,8 @@ import (
 
 type endpointKey string
 
-func (s *Server) checkAuthentication(ctx context.Context) (context.Context, error) {
+// checkAuthentication authenticates the peer in ctx for a call of method
+func (s *Server) checkAuthentication(ctx context.Context, method string) (context.Context, error) {
 	p, ok := peer.FromContext(ctx)
 	if !ok {
 		return ctx, errors.New("couldn't get peer from ctx")
@@ -25,20 +30,59 @@ func (s *Server) checkAuthentication(ctx context.Context) (context.Context, erro
 		return ctx, errors.New("invalid credential type")
 	}
 
-	name := tlsAuth.State.PeerCertificates[0].Subject.CommonName
+	return s.authenticate(ctx, tlsAuth.State, p.Addr.String(), method)
+}
+
+// authenticate looks up the endpoint that belongs to the verified client certificate and stores it in ctx. Calls of
+// disabled endpoints are rejected and audited, whatever the method.
+func (s *Server) authenticate(ctx context.Context, state tls.ConnectionState, remoteAddr, method string) (context.Context, error) {
+	// The span is not part of the returned context, so that the handler's spans don't become its children
+	spanCtx, span := tracing.Start(ctx, "checkAuthentication")
+	defer span.End()
+
+	if len(state.PeerCertificates) == 0 {
+		return ctx, errors.New("no client certificate")
+	}
+
+	cert := state.PeerCertificates[0]
 
-	endpoint, err := s.repo.Endpoints().GetByName(ctx, name)
+	err := s.checkRevocation(cert)
 	if err != nil {
-		log.Warn().Caller().Err(err).Msg("failed to get endpoint by name")
 		return ctx, err
 	}
 
+	endpoint, err := s.endpointForCertificate(spanCtx, cert)
+	if err != nil {
+		log.Warn().Caller().Err(err).Msgf("failed to get endpoint for certificate '%s'", cert.Subject.CommonName)
+		return ctx, err
+	}
+
+	err = s.checkPins(endpoint, cert)
+	if err != nil {
+		log.Warn().Err(err).Msgf("rejected certificate '%s' of '%s'", serialKey(cert.SerialNumber), endpoint.Name)
+		return ctx, err
+	}
+
+	if endpoint.Disabled {
+		log.Warn().Msgf("rejected disabled endpoint '%s'", endpoint.Name)
+		s.forwarder.ForwardRejection(endpoint.Name, "endpoint is disabled")
+		s.auditDisabled(endpoint, method, remoteAddr)
+		return ctx, errors.New("endpoint is disabled")
+	}
+
+	if endpoint.Kind == "agent" {
+		endpoint = s.updateLastSeen(spanCtx, endpoint, remoteAddr)
+	}
+
+	ctx = context.WithValue(ctx, endpointKey("remote_address"), remoteAddr)
+
 	return context.WithValue(ctx, endpointKey("endpoint"), endpoint), nil
 }
 
-func (s *Server) StreamAuthenticationInterceptor(srv interface{}, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
-	newCtx, err := s.checkAuthentication(stream.Context())
+func (s *Server) StreamAuthenticationInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	newCtx, err := s.checkAuthentication(stream.Context(), info.FullMethod)
 	if err != nil {
+		metrics.AuthenticationFailures.Inc()
 		return status.Error(codes.Unauthenticated, "unauthenticated")
 	}
 
@@ -48,9 +92,15 @@ func (s *Server) StreamAuthenticationInterceptor(srv interface{}, stream grpc.Se
 	return handler(srv, wrapped)
 }
 
-func (s *Server) UnaryAuthenticationInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
-	newCtx, err := s.checkAuthentication(ctx)
+func (s *Server) UnaryAuthenticationInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	// Enroll authenticates by itself, because agents call it before they have a certificate
+	if info.FullMethod == enrollMethod {
+		return handler(ctx, req)
+	}
+
+	newCtx, err := s.checkAuthentication(ctx, info.FullMethod)
 	if err != nil {
+		metrics.AuthenticationFailures.Inc()
 		return nil, status.Error(codes.Unauthenticated, "unauthenticated")
 	}
 
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/Leantar/fimserver/models"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// authTestRepo serves a single endpoint and records the audit entries
+type authTestRepo struct {
+	Repository
+	endpoint models.Endpoint
+	entries  []models.AuditEntry
+}
+
+func (r *authTestRepo) Endpoints() EndpointRepository        { return authTestEndpoints{r: r} }
+func (r *authTestRepo) Audit() AuditRepository               { return authTestAudit{r: r} }
+func (r *authTestRepo) IsEmptyResultSetError(err error) bool { return err == errTestNotFound }
+
+type authTestEndpoints struct {
+	EndpointRepository
+	r *authTestRepo
+}
+
+func (e authTestEndpoints) GetByName(_ context.Context, name string) (models.Endpoint, error) {
+	if name != e.r.endpoint.Name {
+		return models.Endpoint{}, errTestNotFound
+	}
+	return e.r.endpoint, nil
+}
+
+type authTestAudit struct {
+	AuditRepository
+	r *authTestRepo
+}
+
+func (a authTestAudit) Create(_ context.Context, entry models.AuditEntry) error {
+	entry.CreatedAt = 0
+	a.r.entries = append(a.r.entries, entry)
+	return nil
+}
+
+type authTestForwarder struct {
+	Forwarder
+	rejections []string
+}
+
+func (f *authTestForwarder) ForwardRejection(endpoint, reason string) {
+	f.rejections = append(f.rejections, endpoint+": "+reason)
+}
+
+type authTestStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authTestStream) Context() context.Context { return s.ctx }
+
+// peerContext returns the context of a call from addr with a certificate for name
+func peerContext(name string, addr *net.TCPAddr) context.Context {
+	cert := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name}}
+
+	return peer.NewContext(context.Background(), &peer.Peer{
+		Addr:     addr,
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	})
+}
+
+func TestDisabledEndpointsAreAudited(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+
+	repo := &authTestRepo{endpoint: models.Endpoint{ID: 1, Name: "viewer", Kind: "client", Disabled: true}}
+	forwarder := &authTestForwarder{}
+	s := &Server{repo: repo, forwarder: forwarder, revoked: newRevocationList()}
+
+	_, err := s.UnaryAuthenticationInterceptor(peerContext("viewer", addr), nil,
+		&grpc.UnaryServerInfo{FullMethod: "/fim.Fim/GetAgents"},
+		func(context.Context, interface{}) (interface{}, error) {
+			t.Error("handler of a disabled endpoint was called")
+			return nil, nil
+		})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("unary call returned %v, want %s", err, codes.Unauthenticated)
+	}
+
+	err = s.StreamAuthenticationInterceptor(nil, authTestStream{ctx: peerContext("viewer", addr)},
+		&grpc.StreamServerInfo{FullMethod: "/fim.Fim/SubscribeAlerts", IsServerStream: true},
+		func(interface{}, grpc.ServerStream) error {
+			t.Error("handler of a disabled endpoint was called")
+			return nil
+		})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("stream returned %v, want %s", err, codes.Unauthenticated)
+	}
+
+	want := []models.AuditEntry{
+		{Actor: "viewer", Action: "GetAgents", Parameters: "null", Result: "DISABLED", RemoteAddress: addr.String()},
+		{Actor: "viewer", Action: "SubscribeAlerts", Parameters: "null", Result: "DISABLED", RemoteAddress: addr.String()},
+	}
+	if !reflect.DeepEqual(repo.entries, want) {
+		t.Errorf("audit entries = %+v, want %+v", repo.entries, want)
+	}
+	if len(forwarder.rejections) != 2 {
+		t.Errorf("forwarded rejections = %v, want 2", forwarder.rejections)
+	}
+}
+
+func TestEnabledEndpointsAreNotAuditedOnAuthentication(t *testing.T) {
+	repo := &authTestRepo{endpoint: models.Endpoint{ID: 1, Name: "viewer", Kind: "client"}}
+	s := &Server{repo: repo, forwarder: &authTestForwarder{}, revoked: newRevocationList()}
+
+	ctx, err := s.checkAuthentication(peerContext("viewer", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}), "/fim.Fim/GetAgents")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if endpoint := ctx.Value(endpointKey("endpoint")).(models.Endpoint); endpoint.Name != "viewer" {
+		t.Errorf("authenticated endpoint = %q, want viewer", endpoint.Name)
+	}
+	if len(repo.entries) != 0 {
+		t.Errorf("authentication wrote audit entries: %+v", repo.entries)
+	}
+}
@@ -6,23 +6,17 @@ import (
 	"strings"
 
 	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/metrics"
+	"github.com/Leantar/fimserver/modules/tracing"
+	"github.com/Leantar/fimserver/modules/validation"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-type checkableEndpoint struct {
-	Kind              string
-	Roles             []interface{}
-	HasBaseline       bool
-	BaselineIsCurrent bool
-}
-
-func (s *Server) checkAuthorization(endpoint models.Endpoint, fullMethod string) error {
-	method := strings.TrimPrefix(fullMethod, "/fim.Fim/")
-
-	ep := checkableEndpoint{
+func newCheckableEndpoint(endpoint models.Endpoint) validation.Subject {
+	ep := validation.Subject{
 		Kind:              endpoint.Kind,
 		Roles:             make([]interface{}, 0),
 		HasBaseline:       endpoint.HasBaseline,
@@ -33,12 +27,23 @@ func (s *Server) checkAuthorization(endpoint models.Endpoint, fullMethod string)
 		ep.Roles = append(ep.Roles, role)
 	}
 
-	ok, err := s.enforcer.Enforce(ep, method)
+	return ep
+}
+
+func (s *Server) checkAuthorization(ctx context.Context, endpoint models.Endpoint, fullMethod string) error {
+	_, span := tracing.Start(ctx, "checkAuthorization")
+	defer span.End()
+
+	method := strings.TrimPrefix(fullMethod, "/fim.Fim/")
+
+	ok, err := s.enforcer.Enforce(newCheckableEndpoint(endpoint), method)
 	if err != nil {
 		log.Error().Caller().Err(err).Msg("failed to check authz")
+		metrics.AuthorizationFailures.WithLabelValues(method).Inc()
 		return errors.New("unauthorized")
 	}
 	if !ok {
+		metrics.AuthorizationFailures.WithLabelValues(method).Inc()
 		return errors.New("unauthorized")
 	}
 
@@ -48,9 +53,13 @@ func (s *Server) checkAuthorization(endpoint models.Endpoint, fullMethod string)
 }
 
 func (s *Server) UnaryAuthorizationInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	if info.FullMethod == enrollMethod {
+		return handler(ctx, req)
+	}
+
 	endpoint := ctx.Value(endpointKey("endpoint")).(models.Endpoint)
 
-	err = s.checkAuthorization(endpoint, info.FullMethod)
+	err = s.checkAuthorization(ctx, endpoint, info.FullMethod)
 	if err != nil {
 		return nil, status.Error(codes.PermissionDenied, "unauthorized")
 	}
@@ -61,7 +70,7 @@ func (s *Server) UnaryAuthorizationInterceptor(ctx context.Context, req interfac
 func (s *Server) StreamAuthorizationInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
 	endpoint := stream.Context().Value(endpointKey("endpoint")).(models.Endpoint)
 
-	err := s.checkAuthorization(endpoint, info.FullMethod)
+	err := s.checkAuthorization(stream.Context(), endpoint, info.FullMethod)
 	if err != nil {
 		return status.Error(codes.PermissionDenied, "unauthorized")
 	}
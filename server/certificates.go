@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const certPollInterval = 10 * time.Second
+
+// certStore hands the current server certificate and client CAs to every TLS handshake, so they can be replaced
+// without restarting the listeners. Established connections keep the certificates they were made with.
+type certStore struct {
+	certPath   string
+	keyPath    string
+	caPath     string
+	clientAuth tls.ClientAuthType
+	verify     func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+
+	mu      sync.RWMutex
+	current *tls.Config
+}
+
+func newCertStore(certPath, keyPath, caPath string, clientAuth tls.ClientAuthType, verify func([][]byte, [][]*x509.Certificate) error) (*certStore, error) {
+	certPath, err := filepath.Abs(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPath, err = filepath.Abs(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	caPath, err = filepath.Abs(caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &certStore{
+		certPath:   certPath,
+		keyPath:    keyPath,
+		caPath:     caPath,
+		clientAuth: clientAuth,
+		verify:     verify,
+	}
+
+	err = c.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// tlsConfig returns the config for the listeners. Every handshake picks up the certificates that are current at that time.
+func (c *certStore) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+
+			return c.current, nil
+		},
+		// Not used for handshakes, because GetConfigForClient takes precedence. It tells the gateway that no files need to be loaded.
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+
+			return &c.current.Certificates[0], nil
+		},
+	}
+}
+
+// certificate returns the current server certificate, including its parsed leaf
+func (c *certStore) certificate() tls.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.current.Certificates[0]
+}
+
+// load reads all files and replaces the current config. If any file is invalid, the current config is kept.
+func (c *certStore) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+
+	caBytes, err := ioutil.ReadFile(c.caPath)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	ok := pool.AppendCertsFromPEM(caBytes)
+	if !ok {
+		return errors.New("couldn't parse ca.cert")
+	}
+
+	c.mu.Lock()
+	c.current = &tls.Config{
+		Certificates:          []tls.Certificate{cert},
+		ClientAuth:            c.clientAuth,
+		ClientCAs:             pool,
+		MinVersion:            tls.VersionTLS13,
+		NextProtos:            []string{"h2", "http/1.1"},
+		VerifyPeerCertificate: c.verify,
+	}
+	c.mu.Unlock()
+
+	log.Info().Msgf("loaded server certificate '%s' with fingerprint %s, valid until %s",
+		leaf.Subject.CommonName, fingerprint(leaf), leaf.NotAfter.Format(time.RFC3339))
+	if time.Now().After(leaf.NotAfter) {
+		log.Warn().Msgf("server certificate '%s' has expired", leaf.Subject.CommonName)
+	}
+
+	return nil
+}
+
+// fingerprint is the SHA-256 hash of the DER encoded certificate, formatted like openssl does
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(parts, ":")
+}
+
+// fileState changes whenever one of the files is written, replaced or removed
+func fileState(paths ...string) string {
+	var b strings.Builder
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			b.WriteString("missing;")
+			continue
+		}
+		fmt.Fprintf(&b, "%d:%d;", info.Size(), info.ModTime().UnixNano())
+	}
+
+	return b.String()
+}
+
+// watchCertificates reloads the certificates when their files change or the process receives SIGHUP
+func (s *Server) watchCertificates(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+
+	paths := []string{s.certs.certPath, s.certs.keyPath, s.certs.caPath}
+	if s.issuesCertificates() {
+		paths = append(paths, s.conf.CaKeyFile)
+	}
+	state := fileState(paths...)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Info().Msg("received SIGHUP, reloading certificates")
+		case <-ticker.C:
+			// Only retried once the files change again, so that a half written rotation isn't reported every tick
+			current := fileState(paths...)
+			if current == state {
+				continue
+			}
+			state = current
+		}
+
+		s.reloadCertificates()
+	}
+}
+
+func (s *Server) reloadCertificates() {
+	err := s.certs.load()
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to reload certificates, keeping the current ones")
+	}
+
+	if !s.issuesCertificates() {
+		return
+	}
+
+	iss, err := loadIssuer(s.conf.CaFile, s.conf.CaKeyFile)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to reload ca key, keeping the current one")
+		return
+	}
+
+	s.issuerMu.Lock()
+	s.issuer = iss
+	s.issuerMu.Unlock()
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// copyTestFile replaces dst with the content of src, like a certificate rotation does
+func copyTestFile(t *testing.T, src, dst string) {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dst, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	// The test CAs double as server certificates
+	first, firstCert, firstKey := newTestCA(t, dir, "first")
+	second, secondCert, secondKey := newTestCA(t, dir, "second")
+
+	certPath := filepath.Join(dir, "server.pem")
+	keyPath := filepath.Join(dir, "server.key")
+	caPath := filepath.Join(dir, "ca.pem")
+	copyTestFile(t, firstCert, certPath)
+	copyTestFile(t, firstKey, keyPath)
+	copyTestFile(t, firstCert, caPath)
+
+	c, err := newCertStore(certPath, keyPath, caPath, tls.RequireAndVerifyClientCert, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := c.tlsConfig()
+
+	current := func() *tls.Config {
+		conf, err := config.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conf
+	}
+
+	if !c.certificate().Leaf.Equal(first.cert) {
+		t.Fatal("store didn't load the first certificate")
+	}
+
+	copyTestFile(t, secondCert, certPath)
+	copyTestFile(t, secondKey, keyPath)
+	copyTestFile(t, secondCert, caPath)
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Handshakes of the existing listener config pick up the new certificate
+	if !current().Certificates[0].Leaf.Equal(second.cert) {
+		t.Error("handshake didn't pick up the reloaded certificate")
+	}
+	if cert, err := config.GetCertificate(&tls.ClientHelloInfo{}); err != nil || !cert.Leaf.Equal(second.cert) {
+		t.Error("GetCertificate didn't return the reloaded certificate")
+	}
+	if current().ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Error("reload changed the client authentication")
+	}
+
+	// A half written rotation keeps the current certificate
+	copyTestFile(t, firstCert, certPath)
+	if err := c.load(); err == nil {
+		t.Error("certificate that doesn't match its key was loaded")
+	}
+	if err := ioutil.WriteFile(caPath, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	copyTestFile(t, firstKey, keyPath)
+	if err := c.load(); err == nil {
+		t.Error("invalid ca was loaded")
+	}
+	if !c.certificate().Leaf.Equal(second.cert) {
+		t.Error("failed reload replaced the current certificate")
+	}
+}
+
+func TestReloadCertificatesReplacesIssuer(t *testing.T) {
+	dir := t.TempDir()
+	first, firstCert, firstKey := newTestCA(t, dir, "first")
+	second, secondCert, secondKey := newTestCA(t, dir, "second")
+
+	caPath := filepath.Join(dir, "ca.pem")
+	caKeyPath := filepath.Join(dir, "ca.key")
+	copyTestFile(t, firstCert, caPath)
+	copyTestFile(t, firstKey, caKeyPath)
+
+	certs, err := newCertStore(caPath, caKeyPath, caPath, tls.RequireAndVerifyClientCert, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{certs: certs, issuer: first, conf: Config{CaFile: caPath, CaKeyFile: caKeyPath}}
+
+	copyTestFile(t, secondCert, caPath)
+	copyTestFile(t, secondKey, caKeyPath)
+	s.reloadCertificates()
+
+	if !s.currentIssuer().cert.Equal(second.cert) {
+		t.Error("reload didn't replace the issuer")
+	}
+
+	// An invalid key keeps the current issuer
+	if err := ioutil.WriteFile(caKeyPath, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.reloadCertificates()
+	if !s.currentIssuer().cert.Equal(second.cert) {
+		t.Error("failed reload replaced the issuer")
+	}
+}
+
+func TestFileState(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cert.pem")
+	missing := filepath.Join(dir, "missing.pem")
+
+	if err := ioutil.WriteFile(path, []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	before := fileState(path, missing)
+
+	if err := ioutil.WriteFile(path, []byte("ab"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	written := fileState(path, missing)
+	if written == before {
+		t.Error("state didn't change when the file was written")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if fileState(path, missing) == written {
+		t.Error("state didn't change when the file was removed")
+	}
+}
@@ -0,0 +1,350 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/chain"
+	"github.com/Leantar/fimserver/modules/validation"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultChainCheckpointInterval = 300 * time.Second
+	chainVerifyBatchSize           = 1000
+)
+
+// writeCheckpoints signs the head of the chain whenever it moved, so that the rows before it can't be changed together
+// with the chain
+func (s *Server) writeCheckpoints(ctx context.Context) {
+	interval := defaultChainCheckpointInterval
+	if s.conf.ChainCheckpointInterval != 0 {
+		interval = time.Duration(s.conf.ChainCheckpointInterval) * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := s.checkpointChain(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Error().Caller().Err(err).Msg("failed to write chain checkpoint")
+		}
+	}
+}
+
+func (s *Server) checkpointChain(ctx context.Context) error {
+	link, err := s.repo.Chain().GetLatestLink(ctx)
+	if err != nil {
+		if s.repo.IsEmptyResultSetError(err) {
+			return nil
+		}
+		return err
+	}
+
+	latest, err := s.repo.Chain().GetLatestCheckpoint(ctx)
+	if err != nil && !s.repo.IsEmptyResultSetError(err) {
+		return err
+	}
+	if err == nil && latest.LinkID == link.ID {
+		return nil
+	}
+
+	return s.signCheckpoint(ctx, link)
+}
+
+func (s *Server) signCheckpoint(ctx context.Context, link models.ChainLink) error {
+	cp, err := s.newCheckpoint(link)
+	if err != nil {
+		return err
+	}
+
+	return s.repo.Chain().CreateCheckpoint(ctx, cp)
+}
+
+// newCheckpoint signs the link with the key of the current server certificate
+func (s *Server) newCheckpoint(link models.ChainLink) (models.ChainCheckpoint, error) {
+	cert := s.certs.certificate()
+
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return models.ChainCheckpoint{}, errors.New("server key can't sign")
+	}
+
+	sig, err := signChainMessage(signer, chain.CheckpointMessage(link.ID, link.Hash))
+	if err != nil {
+		return models.ChainCheckpoint{}, err
+	}
+
+	return models.ChainCheckpoint{
+		LinkID:      link.ID,
+		Hash:        link.Hash,
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Leaf.Raw})),
+		Signature:   sig,
+		CreatedAt:   time.Now().Unix(),
+	}, nil
+}
+
+// removeAlerts deletes the alerts of an agent. The removal is signed in the same transaction, so that the alerts are
+// only deleted if the chain allows them to be missing.
+func (s *Server) removeAlerts(ctx context.Context, agentID uint64) error {
+	return s.repo.Alerts().DeleteAll(ctx, agentID, s.newCheckpoint)
+}
+
+func signChainMessage(signer crypto.Signer, msg []byte) ([]byte, error) {
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+
+	digest := sha256.Sum256(msg)
+	return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+func verifyChainSignature(pub crypto.PublicKey, msg, sig []byte) bool {
+	digest := sha256.Sum256(msg)
+
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, msg, sig)
+	default:
+		return false
+	}
+}
+
+// chainSigners are the pins of the public keys that checkpoints may be signed with: the key of cert_file and the keys
+// of previous server certificates in chain_signer_pins. Any other certificate issued by the CA, such as an agent's,
+// must not be able to sign checkpoints.
+func chainSigners(conf Config) (map[string]bool, error) {
+	certPEM, err := ioutil.ReadFile(conf.CertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("couldn't parse server certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signers := map[string]bool{publicKeyPin(cert): true}
+	for _, pin := range conf.ChainSignerPins {
+		normalized, err := validation.NormalizeCertPin(pin)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chain signer pin '%s': %w", pin, err)
+		}
+		signers[normalized] = true
+	}
+
+	return signers, nil
+}
+
+func verifyCheckpoint(cp models.ChainCheckpoint, signers map[string]bool) error {
+	block, _ := pem.Decode([]byte(cp.Certificate))
+	if block == nil {
+		return errors.New("certificate isn't PEM encoded")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	if !signers[publicKeyPin(cert)] {
+		return errors.New("not signed with a server key")
+	}
+
+	if !verifyChainSignature(cert.PublicKey, chain.CheckpointMessage(cp.LinkID, cp.Hash), cp.Signature) {
+		return errors.New("signature doesn't match")
+	}
+
+	return nil
+}
+
+// CheckChain verifies every link against the link before it, its row and the checkpoints. Alerts may only be missing
+// if a signed removal of their agent follows them. Rows that were inserted without a link are reported as well.
+func CheckChain(ctx context.Context, repo Repository, conf Config) (models.ChainReport, error) {
+	signers, err := chainSigners(conf)
+	if err != nil {
+		return models.ChainReport{}, err
+	}
+
+	checkpoints, err := repo.Chain().GetCheckpoints(ctx)
+	if err != nil {
+		return models.ChainReport{}, err
+	}
+
+	report := models.ChainReport{Checkpoints: uint64(len(checkpoints))}
+
+	// Only valid checkpoints are used to check the links
+	signed := make(map[uint64][]models.ChainCheckpoint)
+	for _, cp := range checkpoints {
+		err := verifyCheckpoint(cp, signers)
+		if err != nil {
+			report.Breaks = append(report.Breaks, models.ChainBreak{
+				LinkID: cp.LinkID, Source: "checkpoint", RowID: cp.ID, Reason: "invalid checkpoint: " + err.Error(),
+			})
+			continue
+		}
+		signed[cp.LinkID] = append(signed[cp.LinkID], cp)
+	}
+
+	// Alerts that are missing, by agent, until a removal allows it
+	missing := make(map[uint64][]models.ChainLink)
+
+	var prev string
+	var afterID uint64
+	for {
+		links, err := repo.Chain().GetLinks(ctx, afterID, chainVerifyBatchSize)
+		if err != nil {
+			return models.ChainReport{}, err
+		}
+		if len(links) == 0 {
+			break
+		}
+		afterID = links[len(links)-1].ID
+
+		rowHashes, err := chainRowHashes(ctx, repo, links)
+		if err != nil {
+			return models.ChainReport{}, err
+		}
+
+		for _, link := range links {
+			report.Links++
+			report.UncheckpointedLinks++
+
+			brk := func(reason string) {
+				report.Breaks = append(report.Breaks, models.ChainBreak{
+					LinkID: link.ID, Source: link.Source, RowID: link.RowID, Reason: reason,
+				})
+			}
+
+			if chain.LinkHash(prev, link) != link.Hash {
+				brk("link doesn't follow the link before it")
+			}
+			// The next link is checked against the stored hash, so that a changed link is reported only once
+			prev = link.Hash
+
+			isSigned := false
+			for _, cp := range signed[link.ID] {
+				if cp.Hash != link.Hash {
+					brk("link doesn't match its checkpoint")
+					continue
+				}
+				isSigned = true
+			}
+			if isSigned {
+				report.UncheckpointedLinks = 0
+			}
+
+			switch link.Source {
+			case chain.SourceAlert, chain.SourceAudit:
+				hash, ok := rowHashes[link.Source][link.RowID]
+				if !ok && link.Source == chain.SourceAlert {
+					missing[link.AgentID] = append(missing[link.AgentID], link)
+				} else if !ok {
+					brk("row was deleted")
+				} else if hash != link.RowHash {
+					brk("row was changed")
+				}
+			case chain.SourceRemoval:
+				if !isSigned {
+					brk("removal isn't signed")
+					continue
+				}
+				delete(missing, link.AgentID)
+			default:
+				brk("unknown source")
+			}
+		}
+	}
+
+	var deleted []models.ChainLink
+	for _, links := range missing {
+		deleted = append(deleted, links...)
+	}
+	sort.Slice(deleted, func(i, j int) bool {
+		return deleted[i].ID < deleted[j].ID
+	})
+	for _, link := range deleted {
+		report.Breaks = append(report.Breaks, models.ChainBreak{
+			LinkID: link.ID, Source: link.Source, RowID: link.RowID, Reason: "row was deleted",
+		})
+	}
+
+	unchained, err := repo.Chain().GetUnchained(ctx)
+	if err != nil {
+		return models.ChainReport{}, err
+	}
+	for _, row := range unchained {
+		report.Breaks = append(report.Breaks, models.ChainBreak{Source: row.Source, RowID: row.RowID, Reason: "row isn't chained"})
+	}
+
+	return report, nil
+}
+
+// chainRowHashes hashes the rows that still exist for the links, by source and row ID
+func chainRowHashes(ctx context.Context, repo Repository, links []models.ChainLink) (map[string]map[uint64]string, error) {
+	var alertIDs, auditIDs []uint64
+	for _, link := range links {
+		switch link.Source {
+		case chain.SourceAlert:
+			alertIDs = append(alertIDs, link.RowID)
+		case chain.SourceAudit:
+			auditIDs = append(auditIDs, link.RowID)
+		}
+	}
+
+	hashes := map[string]map[uint64]string{
+		chain.SourceAlert: make(map[uint64]string),
+		chain.SourceAudit: make(map[uint64]string),
+	}
+
+	if len(alertIDs) != 0 {
+		alerts, err := repo.Alerts().GetByIDs(ctx, alertIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range alerts {
+			hashes[chain.SourceAlert][a.ID] = chain.AlertHash(a)
+		}
+	}
+
+	if len(auditIDs) != 0 {
+		entries, err := repo.Audit().GetByIDs(ctx, auditIDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			hashes[chain.SourceAudit][e.ID] = chain.AuditHash(e)
+		}
+	}
+
+	return hashes, nil
+}
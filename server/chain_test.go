@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/chain"
+)
+
+// chainTestRepo serves the chain and its rows from memory. Only the methods used by CheckChain are implemented.
+type chainTestRepo struct {
+	Repository
+	links       []models.ChainLink
+	checkpoints []models.ChainCheckpoint
+	alerts      map[uint64]models.Alert
+	entries     map[uint64]models.AuditEntry
+	unchained   []models.ChainLink
+}
+
+func (r *chainTestRepo) Chain() ChainRepository           { return chainTestChain{r: r} }
+func (r *chainTestRepo) Alerts() AlertRepository          { return chainTestAlerts{r: r} }
+func (r *chainTestRepo) Audit() AuditRepository           { return chainTestAudit{r: r} }
+func (r *chainTestRepo) IsEmptyResultSetError(error) bool { return false }
+
+type chainTestChain struct {
+	ChainRepository
+	r *chainTestRepo
+}
+
+func (c chainTestChain) GetLinks(_ context.Context, afterID uint64, limit int) ([]models.ChainLink, error) {
+	links := make([]models.ChainLink, 0)
+	for _, l := range c.r.links {
+		if l.ID > afterID && len(links) < limit {
+			links = append(links, l)
+		}
+	}
+
+	return links, nil
+}
+
+func (c chainTestChain) GetCheckpoints(context.Context) ([]models.ChainCheckpoint, error) {
+	return c.r.checkpoints, nil
+}
+
+func (c chainTestChain) GetUnchained(context.Context) ([]models.ChainLink, error) {
+	return c.r.unchained, nil
+}
+
+type chainTestAlerts struct {
+	AlertRepository
+	r *chainTestRepo
+}
+
+func (a chainTestAlerts) GetByIDs(_ context.Context, ids []uint64) ([]models.Alert, error) {
+	alerts := make([]models.Alert, 0)
+	for _, id := range ids {
+		if al, ok := a.r.alerts[id]; ok {
+			alerts = append(alerts, al)
+		}
+	}
+
+	return alerts, nil
+}
+
+type chainTestAudit struct {
+	AuditRepository
+	r *chainTestRepo
+}
+
+func (a chainTestAudit) GetByIDs(_ context.Context, ids []uint64) ([]models.AuditEntry, error) {
+	entries := make([]models.AuditEntry, 0)
+	for _, id := range ids {
+		if e, ok := a.r.entries[id]; ok {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries, nil
+}
+
+// chainTestSigner is a self-signed certificate and its key
+type chainTestSigner struct {
+	key     ed25519.PrivateKey
+	certPEM string
+}
+
+func newChainTestSigner(t *testing.T) chainTestSigner {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fimserver"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return chainTestSigner{key: key, certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+func (s chainTestSigner) checkpoint(t *testing.T, id uint64, link models.ChainLink) models.ChainCheckpoint {
+	sig, err := signChainMessage(s.key, chain.CheckpointMessage(link.ID, link.Hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return models.ChainCheckpoint{ID: id, LinkID: link.ID, Hash: link.Hash, Certificate: s.certPEM, Signature: sig}
+}
+
+// newChainTest builds a valid chain of two alerts of agent 1, an audit entry, a signed checkpoint and another alert of
+// agent 2 after it
+func newChainTest(t *testing.T) (*chainTestRepo, chainTestSigner, Config) {
+	server := newChainTestSigner(t)
+
+	certFile := filepath.Join(t.TempDir(), "server.crt")
+	err := ioutil.WriteFile(certFile, []byte(server.certPEM), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := &chainTestRepo{
+		alerts: map[uint64]models.Alert{
+			1: {ID: 1, Kind: "CHANGE", Severity: "MEDIUM", Difference: "hash: aa -> bb", Path: "/etc/passwd", AgentID: 1},
+			2: {ID: 2, Kind: "DELETE", Severity: "MEDIUM", Path: "/etc/group", AgentID: 1},
+			3: {ID: 3, Kind: "CREATE", Severity: "LOW", Path: "/tmp/x", AgentID: 2},
+		},
+		entries: map[uint64]models.AuditEntry{
+			1: {ID: 1, Actor: "admin", Action: "DeleteEndpoint", Target: "agent3", Result: "OK"},
+		},
+	}
+
+	repo.appendLink(chain.SourceAlert, 1, 1, chain.AlertHash(repo.alerts[1]))
+	repo.appendLink(chain.SourceAlert, 2, 1, chain.AlertHash(repo.alerts[2]))
+	repo.appendLink(chain.SourceAudit, 1, 0, chain.AuditHash(repo.entries[1]))
+	repo.checkpoints = append(repo.checkpoints, server.checkpoint(t, 1, repo.links[2]))
+	repo.appendLink(chain.SourceAlert, 3, 2, chain.AlertHash(repo.alerts[3]))
+
+	return repo, server, Config{CertFile: certFile}
+}
+
+func (r *chainTestRepo) appendLink(source string, rowID, agentID uint64, rowHash string) models.ChainLink {
+	var prev string
+	if len(r.links) > 0 {
+		prev = r.links[len(r.links)-1].Hash
+	}
+
+	link := models.ChainLink{ID: uint64(len(r.links) + 1), Source: source, RowID: rowID, AgentID: agentID, RowHash: rowHash}
+	link.Hash = chain.LinkHash(prev, link)
+	r.links = append(r.links, link)
+
+	return link
+}
+
+func TestCheckChainIntact(t *testing.T) {
+	repo, _, conf := newChainTest(t)
+
+	report, err := CheckChain(context.Background(), repo, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := models.ChainReport{Links: 4, Checkpoints: 1, UncheckpointedLinks: 1}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("report = %+v, want %+v", report, want)
+	}
+}
+
+func TestCheckChainBreaks(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, repo *chainTestRepo, server chainTestSigner)
+		want   []models.ChainBreak
+	}{
+		{
+			name: "changed alert",
+			tamper: func(t *testing.T, repo *chainTestRepo, _ chainTestSigner) {
+				al := repo.alerts[1]
+				al.Severity = "LOW"
+				repo.alerts[1] = al
+			},
+			want: []models.ChainBreak{{LinkID: 1, Source: chain.SourceAlert, RowID: 1, Reason: "row was changed"}},
+		},
+		{
+			name: "deleted audit entry",
+			tamper: func(t *testing.T, repo *chainTestRepo, _ chainTestSigner) {
+				delete(repo.entries, 1)
+			},
+			want: []models.ChainBreak{{LinkID: 3, Source: chain.SourceAudit, RowID: 1, Reason: "row was deleted"}},
+		},
+		{
+			name: "deleted alert without removal",
+			tamper: func(t *testing.T, repo *chainTestRepo, _ chainTestSigner) {
+				delete(repo.alerts, 2)
+			},
+			want: []models.ChainBreak{{LinkID: 2, Source: chain.SourceAlert, RowID: 2, Reason: "row was deleted"}},
+		},
+		{
+			name: "deleted alerts with signed removal",
+			tamper: func(t *testing.T, repo *chainTestRepo, server chainTestSigner) {
+				delete(repo.alerts, 1)
+				delete(repo.alerts, 2)
+				removal := repo.appendLink(chain.SourceRemoval, 0, 1, "")
+				repo.checkpoints = append(repo.checkpoints, server.checkpoint(t, 2, removal))
+			},
+			want: nil,
+		},
+		{
+			name: "removal without signature",
+			tamper: func(t *testing.T, repo *chainTestRepo, _ chainTestSigner) {
+				delete(repo.alerts, 1)
+				repo.appendLink(chain.SourceRemoval, 0, 1, "")
+			},
+			want: []models.ChainBreak{
+				{LinkID: 5, Source: chain.SourceRemoval, RowID: 0, Reason: "removal isn't signed"},
+				{LinkID: 1, Source: chain.SourceAlert, RowID: 1, Reason: "row was deleted"},
+			},
+		},
+		{
+			name: "removal of another agent",
+			tamper: func(t *testing.T, repo *chainTestRepo, server chainTestSigner) {
+				delete(repo.alerts, 1)
+				removal := repo.appendLink(chain.SourceRemoval, 0, 2, "")
+				repo.checkpoints = append(repo.checkpoints, server.checkpoint(t, 2, removal))
+			},
+			want: []models.ChainBreak{{LinkID: 1, Source: chain.SourceAlert, RowID: 1, Reason: "row was deleted"}},
+		},
+		{
+			name: "rewritten link",
+			tamper: func(t *testing.T, repo *chainTestRepo, _ chainTestSigner) {
+				repo.links[1].RowHash = "forged"
+			},
+			want: []models.ChainBreak{
+				{LinkID: 2, Source: chain.SourceAlert, RowID: 2, Reason: "link doesn't follow the link before it"},
+				{LinkID: 2, Source: chain.SourceAlert, RowID: 2, Reason: "row was changed"},
+			},
+		},
+		{
+			name: "rewritten chain up to a checkpoint",
+			tamper: func(t *testing.T, repo *chainTestRepo, _ chainTestSigner) {
+				al := repo.alerts[1]
+				al.Severity = "LOW"
+				repo.alerts[1] = al
+
+				// Recomputing all hashes hides the change from the links, but not from the checkpoint
+				prev := ""
+				for i := range repo.links {
+					if repo.links[i].Source == chain.SourceAlert {
+						repo.links[i].RowHash = chain.AlertHash(repo.alerts[repo.links[i].RowID])
+					}
+					repo.links[i].Hash = chain.LinkHash(prev, repo.links[i])
+					prev = repo.links[i].Hash
+				}
+			},
+			want: []models.ChainBreak{{LinkID: 3, Source: chain.SourceAudit, RowID: 1, Reason: "link doesn't match its checkpoint"}},
+		},
+		{
+			name: "checkpoint signed by another key",
+			tamper: func(t *testing.T, repo *chainTestRepo, _ chainTestSigner) {
+				other := newChainTestSigner(t)
+				repo.checkpoints = append(repo.checkpoints, other.checkpoint(t, 2, repo.links[3]))
+			},
+			want: []models.ChainBreak{{LinkID: 4, Source: "checkpoint", RowID: 2, Reason: "invalid checkpoint: not signed with a server key"}},
+		},
+		{
+			name: "forged signature",
+			tamper: func(t *testing.T, repo *chainTestRepo, _ chainTestSigner) {
+				repo.checkpoints[0].Signature[0] ^= 0xff
+			},
+			want: []models.ChainBreak{{LinkID: 3, Source: "checkpoint", RowID: 1, Reason: "invalid checkpoint: signature doesn't match"}},
+		},
+		{
+			name: "unchained row",
+			tamper: func(t *testing.T, repo *chainTestRepo, _ chainTestSigner) {
+				repo.unchained = []models.ChainLink{{Source: chain.SourceAlert, RowID: 9}}
+			},
+			want: []models.ChainBreak{{Source: chain.SourceAlert, RowID: 9, Reason: "row isn't chained"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, server, conf := newChainTest(t)
+			tt.tamper(t, repo, server)
+
+			report, err := CheckChain(context.Background(), repo, conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(report.Breaks, tt.want) {
+				t.Errorf("breaks = %+v, want %+v", report.Breaks, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/rs/zerolog/log"
+)
+
+const dashboardPrefix = "/ui/"
+
+//go:embed web
+var dashboardAssets embed.FS
+
+var dashboardHandler = newDashboardHandler()
+
+func newDashboardHandler() http.Handler {
+	assets, err := fs.Sub(dashboardAssets, "web")
+	if err != nil {
+		log.Fatal().Caller().Err(err).Msg("failed to open dashboard assets")
+	}
+
+	return http.StripPrefix(dashboardPrefix, http.FileServer(http.FS(assets)))
+}
+
+// session tells the dashboard who is logged in and which RPCs the casbin policy allows them to call
+type session struct {
+	Name  string   `json:"name"`
+	Kind  string   `json:"kind"`
+	Roles []string `json:"roles"`
+	Rpcs  []string `json:"rpcs"`
+}
+
+func (s *Server) serveSession(ctx context.Context, w http.ResponseWriter) {
+	endpoint := ctx.Value(endpointKey("endpoint")).(models.Endpoint)
+
+	sess := session{
+		Name:  endpoint.Name,
+		Kind:  endpoint.Kind,
+		Roles: endpoint.Roles,
+		Rpcs:  make([]string, 0),
+	}
+	if sess.Roles == nil {
+		sess.Roles = make([]string, 0)
+	}
+
+	seen := make(map[string]bool)
+	for _, rt := range routes {
+		if seen[rt.rpc] {
+			continue
+		}
+		seen[rt.rpc] = true
+
+		// The enforcer is used directly, so that the probes are neither logged as accesses nor counted as failures
+		ok, err := s.enforcer.Enforce(newCheckableEndpoint(endpoint), rt.rpc)
+		if err != nil {
+			log.Error().Caller().Err(err).Msg("failed to check authz")
+			continue
+		}
+		if ok {
+			sess.Rpcs = append(sess.Rpcs, rt.rpc)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sess)
+}
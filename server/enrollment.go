@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	"github.com/Leantar/fimproto/proto"
+	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/metrics"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	enrollMethod = "/fim.Fim/Enroll"
+
+	defaultEnrollmentTokenValidity = 24 * time.Hour
+	defaultIssuedCertValidity      = 7 * 24 * time.Hour
+)
+
+// newEnrollmentToken replaces any previous token of the agent with a new one
+func (s *Server) newEnrollmentToken(ctx context.Context, agent models.Endpoint) (*proto.EnrollmentToken, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	validity := defaultEnrollmentTokenValidity
+	if s.conf.EnrollmentTokenValidity != 0 {
+		validity = time.Duration(s.conf.EnrollmentTokenValidity) * time.Second
+	}
+	expiresAt := time.Now().Add(validity).Unix()
+
+	err = s.repo.EnrollmentTokens().Replace(ctx, models.EnrollmentToken{
+		TokenHash:  hashToken(token),
+		ExpiresAt:  expiresAt,
+		EndpointID: agent.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.EnrollmentToken{Token: token, ExpiresAt: expiresAt}, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// enrollingAgent returns the agent that a token belongs to. Without a token, the agent renews its certificate and must
+// authenticate with the current one. A renewal keeps the key of that certificate, because whoever stole a certificate
+// and its key could otherwise move the agent to a key of their own. Changing the key requires a new token from an admin.
+func (s *Server) enrollingAgent(ctx context.Context, token string, csr *x509.CertificateRequest) (models.Endpoint, error) {
+	if token == "" {
+		authCtx, err := s.checkAuthentication(ctx, enrollMethod)
+		if err != nil {
+			return models.Endpoint{}, err
+		}
+
+		agent := authCtx.Value(endpointKey("endpoint")).(models.Endpoint)
+		if agent.Kind != "agent" {
+			return models.Endpoint{}, errors.New("only agents can renew certificates")
+		}
+
+		cert, err := presentedCertificate(ctx)
+		if err != nil {
+			return models.Endpoint{}, err
+		}
+
+		if !bytes.Equal(csr.RawSubjectPublicKeyInfo, cert.RawSubjectPublicKeyInfo) {
+			s.forwarder.ForwardRejection(agent.Name, "renewal with a different key")
+			return models.Endpoint{}, errors.New("renewal must keep the key of the current certificate")
+		}
+
+		return agent, nil
+	}
+
+	t, err := s.repo.EnrollmentTokens().Consume(ctx, hashToken(token))
+	if err != nil {
+		if s.repo.IsEmptyResultSetError(err) {
+			s.forwarder.ForwardRejection("unknown", "invalid enrollment token")
+			return models.Endpoint{}, errors.New("invalid enrollment token")
+		}
+		return models.Endpoint{}, err
+	}
+
+	if time.Now().Unix() > t.ExpiresAt {
+		s.forwarder.ForwardRejection("unknown", "expired enrollment token")
+		return models.Endpoint{}, errors.New("enrollment token has expired")
+	}
+
+	agent, err := s.repo.Endpoints().GetByID(ctx, t.EndpointID)
+	if err != nil {
+		return models.Endpoint{}, err
+	}
+
+	if agent.Disabled {
+		s.forwarder.ForwardRejection(agent.Name, "endpoint is disabled")
+		return models.Endpoint{}, errors.New("endpoint is disabled")
+	}
+
+	return agent, nil
+}
+
+// presentedCertificate returns the client certificate of the connection
+func presentedCertificate(ctx context.Context) (*x509.Certificate, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, errors.New("couldn't get peer from ctx")
+	}
+
+	tlsAuth, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsAuth.State.PeerCertificates) == 0 {
+		return nil, errors.New("no client certificate")
+	}
+
+	return tlsAuth.State.PeerCertificates[0], nil
+}
+
+func parseCSR(csrPEM string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("csr must be a PEM encoded certificate request")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = csr.CheckSignature()
+	if err != nil {
+		return nil, err
+	}
+
+	return csr, nil
+}
+
+// issueAgentCertificate signs the public key of the CSR for the agent and pins the agent to that key.
+// The subject of the CSR is ignored.
+func (s *Server) issueAgentCertificate(ctx context.Context, agent models.Endpoint, csr *x509.CertificateRequest) (*proto.EnrollmentResponse, error) {
+	validity := defaultIssuedCertValidity
+	if s.conf.IssuedCertValidity != 0 {
+		validity = time.Duration(s.conf.IssuedCertValidity) * time.Second
+	}
+
+	cert, err := s.currentIssuer().issueClientCertificate(agent.Name, agent.URIIdentity, csr.PublicKey, validity)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replaces the pins of the previous certificate, which the agent no longer needs
+	err = s.repo.Endpoints().UpdateCredentials(ctx, agent.ID, []string{publicKeyPin(cert)}, agent.URIIdentity)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := ioutil.ReadFile(s.certs.caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Msgf("issued certificate '%s' to agent '%s', valid until %s",
+		serialKey(cert.SerialNumber), agent.Name, cert.NotAfter.Format(time.RFC3339))
+
+	return &proto.EnrollmentResponse{
+		Certificate:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		CaCertificate: string(ca),
+		NotAfter:      cert.NotAfter.Unix(),
+	}, nil
+}
+
+// rejectEnrollment counts a failed enrollment like a failed authentication
+func (s *Server) rejectEnrollment(err error) {
+	log.Warn().Err(err).Msg("rejected enrollment")
+	metrics.AuthenticationFailures.Inc()
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Leantar/fimproto/proto"
+	"github.com/Leantar/fimserver/models"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// enrollTestRepo keeps endpoints and enrollment tokens in memory
+type enrollTestRepo struct {
+	Repository
+	endpoints []models.Endpoint
+	tokens    map[string]models.EnrollmentToken
+}
+
+func (r *enrollTestRepo) Endpoints() EndpointRepository { return enrollTestEndpoints{r: r} }
+func (r *enrollTestRepo) EnrollmentTokens() EnrollmentTokenRepository {
+	return enrollTestTokens{r: r}
+}
+func (r *enrollTestRepo) IsEmptyResultSetError(err error) bool { return err == errTestNotFound }
+
+func (r *enrollTestRepo) find(match func(models.Endpoint) bool) (models.Endpoint, error) {
+	for _, ep := range r.endpoints {
+		if match(ep) {
+			return ep, nil
+		}
+	}
+	return models.Endpoint{}, errTestNotFound
+}
+
+type enrollTestEndpoints struct {
+	EndpointRepository
+	r *enrollTestRepo
+}
+
+func (e enrollTestEndpoints) GetByName(_ context.Context, name string) (models.Endpoint, error) {
+	return e.r.find(func(ep models.Endpoint) bool { return ep.Name == name })
+}
+
+func (e enrollTestEndpoints) GetByID(_ context.Context, id uint64) (models.Endpoint, error) {
+	return e.r.find(func(ep models.Endpoint) bool { return ep.ID == id })
+}
+
+func (e enrollTestEndpoints) GetByURIIdentity(_ context.Context, uri string) (models.Endpoint, error) {
+	return e.r.find(func(ep models.Endpoint) bool { return ep.URIIdentity == uri })
+}
+
+func (e enrollTestEndpoints) UpdateCredentials(_ context.Context, id uint64, certPins []string, uriIdentity string) error {
+	for i := range e.r.endpoints {
+		if e.r.endpoints[i].ID == id {
+			e.r.endpoints[i].CertPins = certPins
+			e.r.endpoints[i].URIIdentity = uriIdentity
+		}
+	}
+	return nil
+}
+
+func (e enrollTestEndpoints) UpdateLastSeen(context.Context, uint64, int64, string) error { return nil }
+
+type enrollTestTokens struct {
+	EnrollmentTokenRepository
+	r *enrollTestRepo
+}
+
+func (t enrollTestTokens) Replace(_ context.Context, token models.EnrollmentToken) error {
+	t.r.tokens[token.TokenHash] = token
+	return nil
+}
+
+func (t enrollTestTokens) Consume(_ context.Context, tokenHash string) (models.EnrollmentToken, error) {
+	token, ok := t.r.tokens[tokenHash]
+	if !ok {
+		return models.EnrollmentToken{}, errTestNotFound
+	}
+	delete(t.r.tokens, tokenHash)
+	return token, nil
+}
+
+type enrollTestForwarder struct {
+	authTestForwarder
+}
+
+func (*enrollTestForwarder) ForwardAction(string, string, string) {}
+
+// newEnrollTestServer returns a server that issues certificates for agent1 and the client admin
+func newEnrollTestServer(t *testing.T) (*Server, *enrollTestRepo, *enrollTestForwarder) {
+	iss, caPath, keyPath := newTestCA(t, t.TempDir(), "ca")
+
+	repo := &enrollTestRepo{
+		endpoints: []models.Endpoint{
+			{ID: 1, Name: "agent1", Kind: "agent"},
+			{ID: 2, Name: "admin", Kind: "client"},
+			{ID: 3, Name: "agent2", Kind: "agent", Disabled: true},
+		},
+		tokens: make(map[string]models.EnrollmentToken),
+	}
+	forwarder := &enrollTestForwarder{}
+
+	s := &Server{
+		repo:      repo,
+		forwarder: forwarder,
+		conf:      Config{CaFile: caPath, CaKeyFile: keyPath},
+		issuer:    iss,
+		certs:     &certStore{caPath: caPath},
+		revoked:   newRevocationList(),
+	}
+
+	return s, repo, forwarder
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// newTestCSR returns a PEM encoded certificate request for key
+func newTestCSR(t *testing.T, key *ecdsa.PrivateKey) string {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+// certPeerContext returns the context of a call with the client certificate cert
+func certPeerContext(cert *x509.Certificate) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{
+		Addr:     &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000},
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}},
+	})
+}
+
+func parseTestCertificate(t *testing.T, certPEM string) *x509.Certificate {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		t.Fatal("response contains no certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// enrollWithToken enrolls the endpoint with id through a new token and returns its certificate and key
+func enrollWithToken(t *testing.T, s *Server, id uint64) (*x509.Certificate, *ecdsa.PrivateKey) {
+	agent, err := s.repo.Endpoints().GetByID(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := s.newEnrollmentToken(context.Background(), agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := newTestKey(t)
+	resp, err := s.Enroll(context.Background(), &proto.EnrollmentRequest{Token: token.Token, Csr: newTestCSR(t, key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parseTestCertificate(t, resp.Certificate), key
+}
+
+func TestEnrollWithToken(t *testing.T) {
+	s, repo, _ := newEnrollTestServer(t)
+
+	token, err := s.newEnrollmentToken(context.Background(), repo.endpoints[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A malformed request doesn't use up the token
+	_, err = s.Enroll(context.Background(), &proto.EnrollmentRequest{Token: token.Token, Csr: "garbage"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("malformed csr returned %v, want %s", err, codes.InvalidArgument)
+	}
+
+	csr := newTestCSR(t, newTestKey(t))
+	resp, err := s.Enroll(context.Background(), &proto.EnrollmentRequest{Token: token.Token, Csr: csr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := parseTestCertificate(t, resp.Certificate)
+	if cert.Subject.CommonName != "agent1" {
+		t.Errorf("certificate was issued to %q, want agent1", cert.Subject.CommonName)
+	}
+	if err := cert.CheckSignatureFrom(s.issuer.cert); err != nil {
+		t.Errorf("certificate isn't signed by the ca: %v", err)
+	}
+	if pins := repo.endpoints[0].CertPins; len(pins) != 1 || pins[0] != publicKeyPin(cert) {
+		t.Errorf("agent pins = %v, want the key of the issued certificate", pins)
+	}
+
+	// Tokens can only be used once
+	_, err = s.Enroll(context.Background(), &proto.EnrollmentRequest{Token: token.Token, Csr: csr})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("reused token returned %v, want %s", err, codes.Unauthenticated)
+	}
+}
+
+func TestEnrollRejectsTokens(t *testing.T) {
+	s, repo, forwarder := newEnrollTestServer(t)
+	csr := newTestCSR(t, newTestKey(t))
+
+	repo.tokens[hashToken("expired")] = models.EnrollmentToken{TokenHash: hashToken("expired"), ExpiresAt: time.Now().Add(-time.Minute).Unix(), EndpointID: 1}
+	repo.tokens[hashToken("disabled")] = models.EnrollmentToken{TokenHash: hashToken("disabled"), ExpiresAt: time.Now().Add(time.Hour).Unix(), EndpointID: 3}
+
+	for _, token := range []string{"unknown", "expired", "disabled"} {
+		_, err := s.Enroll(context.Background(), &proto.EnrollmentRequest{Token: token, Csr: csr})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("%s token returned %v, want %s", token, err, codes.Unauthenticated)
+		}
+	}
+
+	want := []string{"unknown: invalid enrollment token", "unknown: expired enrollment token", "agent2: endpoint is disabled"}
+	if len(forwarder.rejections) != len(want) {
+		t.Fatalf("forwarded rejections = %v, want %v", forwarder.rejections, want)
+	}
+	for i := range want {
+		if forwarder.rejections[i] != want[i] {
+			t.Errorf("forwarded rejections = %v, want %v", forwarder.rejections, want)
+			break
+		}
+	}
+}
+
+func TestRenewalKeepsKey(t *testing.T) {
+	s, repo, forwarder := newEnrollTestServer(t)
+	current, key := enrollWithToken(t, s, 1)
+	ctx := certPeerContext(current)
+
+	_, err := s.Enroll(ctx, &proto.EnrollmentRequest{Csr: newTestCSR(t, newTestKey(t))})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("renewal with a different key returned %v, want %s", err, codes.Unauthenticated)
+	}
+	if len(forwarder.rejections) != 1 || forwarder.rejections[0] != "agent1: renewal with a different key" {
+		t.Errorf("forwarded rejections = %v", forwarder.rejections)
+	}
+
+	resp, err := s.Enroll(ctx, &proto.EnrollmentRequest{Csr: newTestCSR(t, key)})
+	if err != nil {
+		t.Fatalf("renewal with the same key was rejected: %v", err)
+	}
+
+	renewed := parseTestCertificate(t, resp.Certificate)
+	if renewed.Subject.CommonName != "agent1" || renewed.SerialNumber.Cmp(current.SerialNumber) == 0 {
+		t.Errorf("renewal issued %q with serial %s", renewed.Subject.CommonName, serialKey(renewed.SerialNumber))
+	}
+	// The pin of the key stays the same, so the current certificate keeps working until the agent switches
+	if pins := repo.endpoints[0].CertPins; len(pins) != 1 || pins[0] != publicKeyPin(current) {
+		t.Errorf("agent pins = %v, want the key of the current certificate", pins)
+	}
+}
+
+func TestRenewalRequiresAgent(t *testing.T) {
+	s, _, _ := newEnrollTestServer(t)
+	cert, key := enrollWithToken(t, s, 2)
+
+	_, err := s.Enroll(certPeerContext(cert), &proto.EnrollmentRequest{Csr: newTestCSR(t, key)})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("renewal of a client returned %v, want %s", err, codes.Unauthenticated)
+	}
+
+	// Without a token or a certificate, nothing is renewed
+	_, err = s.Enroll(context.Background(), &proto.EnrollmentRequest{Csr: newTestCSR(t, key)})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("renewal without a certificate returned %v, want %s", err, codes.Unauthenticated)
+	}
+}
+
+func TestEnrollWithoutIssuer(t *testing.T) {
+	s := &Server{}
+
+	_, err := s.Enroll(context.Background(), &proto.EnrollmentRequest{Token: "token"})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("enrollment without ca key returned %v, want %s", err, codes.Unimplemented)
+	}
+}
@@ -0,0 +1,919 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Leantar/fimproto/proto"
+	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/metrics"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	maxGatewayBodySize = 1 << 20
+	// Clients that send their headers slower than this would otherwise hold a connection forever
+	gatewayReadHeaderTimeout = 10 * time.Second
+)
+
+// route maps a REST resource to a Fim RPC. Requests are authorized with the casbin policy of the RPC.
+type route struct {
+	method  string
+	pattern string
+	rpc     string
+	summary string
+	// Prototypes of the JSON request body and the response. Both may be nil
+	request  interface{}
+	response interface{}
+	// The response is a JSON array of response items
+	list bool
+	// The response is a stream of newline delimited JSON response items
+	stream bool
+	handle func(s *Server, c *gatewayCall) (interface{}, error)
+}
+
+var routes = []route{
+	{
+		method: http.MethodGet, pattern: "/v1/agents", rpc: "GetAgents",
+		summary: "List all agents", response: proto.Agent{}, list: true,
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			stream := &agentStream{gatewayStream: c.collect()}
+			err := c.serverStream(stream.gatewayStream, &proto.Empty{}, func(req interface{}) error {
+				return s.GetAgents(req.(*proto.Empty), stream)
+			})
+			return stream.items, err
+		},
+	},
+	{
+		method: http.MethodGet, pattern: "/v1/agents/ranking", rpc: "GetAgentsByRisk",
+		summary: "List all agents ordered by descending risk score", response: proto.Agent{}, list: true,
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			stream := &agentStream{gatewayStream: c.collect()}
+			err := c.serverStream(stream.gatewayStream, &proto.Empty{}, func(req interface{}) error {
+				return s.GetAgentsByRisk(req.(*proto.Empty), stream)
+			})
+			return stream.items, err
+		},
+	},
+	{
+		method: http.MethodGet, pattern: "/v1/agents/{name}/alerts", rpc: "GetAlertsByAgent",
+		summary: "List all alerts of an agent", response: gatewayAlert{}, list: true,
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			stream := &alertCollector{gatewayStream: c.collect()}
+			err := c.serverStream(stream.gatewayStream, c.endpointName(), func(req interface{}) error {
+				return s.GetAlertsByAgent(req.(*proto.EndpointName), stream)
+			})
+			if err != nil {
+				return nil, err
+			}
+			return s.newGatewayAlerts(c.ctx, stream.alerts)
+		},
+	},
+	{
+		method: http.MethodGet, pattern: "/v1/agents/{name}/host-facts", rpc: "GetHostFactsHistory",
+		summary: "List the host facts an agent reported, the most recent first", response: proto.HostFacts{}, list: true,
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			stream := &hostFactsStream{gatewayStream: c.collect()}
+			err := c.serverStream(stream.gatewayStream, c.endpointName(), func(req interface{}) error {
+				return s.GetHostFactsHistory(req.(*proto.EndpointName), stream)
+			})
+			return stream.items, err
+		},
+	},
+	{
+		method: http.MethodGet, pattern: "/v1/alerts", rpc: "QueryAlerts",
+		summary: "Query a page of alerts. Filters are given as repeatable agent, kind and severity and single path_prefix, " +
+			"path_glob, issued_from, issued_until, order (asc or desc), page_size and page_token query parameters",
+		response: gatewayAlertPage{},
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			query := c.r.URL.Query()
+			req := &proto.AlertQuery{
+				AgentNames: query["agent"],
+				Kinds:      query["kind"],
+				Severities: query["severity"],
+				PathPrefix: query.Get("path_prefix"),
+				PathGlob:   query.Get("path_glob"),
+				Descending: query.Get("order") == "desc",
+				PageToken:  query.Get("page_token"),
+			}
+
+			var err error
+			if req.IssuedFrom, err = parseIntParam(query, "issued_from"); err != nil {
+				return nil, err
+			}
+			if req.IssuedUntil, err = parseIntParam(query, "issued_until"); err != nil {
+				return nil, err
+			}
+			if req.PageSize, err = parsePageSize(query); err != nil {
+				return nil, err
+			}
+
+			resp, err := c.unary(req, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.QueryAlerts(ctx, req.(*proto.AlertQuery))
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			page := resp.(*proto.AlertPage)
+			alerts, err := s.newGatewayAlerts(c.ctx, page.Alerts)
+			if err != nil {
+				return nil, err
+			}
+
+			return gatewayAlertPage{Alerts: alerts, NextPageToken: page.NextPageToken}, nil
+		},
+	},
+	{
+		method: http.MethodGet, pattern: "/v1/alerts/subscription", rpc: "SubscribeAlerts",
+		summary:  "Stream new alerts. Filters are given as repeatable agent, kind and severity query parameters",
+		response: gatewayAlert{}, stream: true,
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			query := c.r.URL.Query()
+			lastSeen, err := strconv.ParseUint(query.Get("last_seen_id"), 10, 64)
+			if err != nil && query.Get("last_seen_id") != "" {
+				return nil, status.Error(codes.InvalidArgument, "invalid last_seen_id")
+			}
+
+			sub := &proto.AlertSubscription{
+				AgentNames: query["agent"],
+				Kinds:      query["kind"],
+				Severities: query["severity"],
+				LastSeenId: lastSeen,
+			}
+
+			stream := &alertStream{gatewayStream: c.stream(), s: s}
+			return nil, c.serverStream(stream.gatewayStream, sub, func(req interface{}) error {
+				return s.SubscribeAlerts(req.(*proto.AlertSubscription), stream)
+			})
+		},
+	},
+	{
+		method: http.MethodPost, pattern: "/v1/agents/{name}/baseline-approval", rpc: "CreateBaselineUpdateApproval",
+		summary:  "Approve the baseline update of an agent. It may update its baseline once baseline_approval_quorum approvers approved it",
+		response: proto.Empty{},
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			return c.unary(c.endpointName(), func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.CreateBaselineUpdateApproval(ctx, req.(*proto.EndpointName))
+			})
+		},
+	},
+	{
+		method: http.MethodGet, pattern: "/v1/baseline-approvals", rpc: "GetPendingBaselineApprovals",
+		summary: "List the agents whose baseline update still lacks approvals", response: proto.PendingBaselineApproval{}, list: true,
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			stream := &pendingApprovalStream{gatewayStream: c.collect()}
+			err := c.serverStream(stream.gatewayStream, &proto.Empty{}, func(req interface{}) error {
+				return s.GetPendingBaselineApprovals(req.(*proto.Empty), stream)
+			})
+			return stream.items, err
+		},
+	},
+	{
+		method: http.MethodPost, pattern: "/v1/agents", rpc: "CreateAgentEndpoint",
+		summary: "Create an agent. Returns its enrollment token if the server issues certificates",
+		request: proto.AgentEndpoint{}, response: proto.EnrollmentToken{},
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			var req proto.AgentEndpoint
+			if err := c.decode(&req); err != nil {
+				return nil, err
+			}
+			return c.unary(&req, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.CreateAgentEndpoint(ctx, req.(*proto.AgentEndpoint))
+			})
+		},
+	},
+	{
+		method: http.MethodPost, pattern: "/v1/agents/{name}/enrollment-token", rpc: "CreateEnrollmentToken",
+		summary: "Create a new enrollment token for an agent", response: proto.EnrollmentToken{},
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			return c.unary(c.endpointName(), func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.CreateEnrollmentToken(ctx, req.(*proto.EndpointName))
+			})
+		},
+	},
+	{
+		method: http.MethodPut, pattern: "/v1/agents/{name}/watched-paths", rpc: "UpdateEndpointWatchedPaths",
+		summary: "Replace the watched paths of an agent. The name in the body is ignored",
+		request: proto.AgentEndpoint{}, response: proto.Empty{},
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			var req proto.AgentEndpoint
+			if err := c.decode(&req); err != nil {
+				return nil, err
+			}
+			req.Name = c.params["name"]
+			return c.unary(&req, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.UpdateEndpointWatchedPaths(ctx, req.(*proto.AgentEndpoint))
+			})
+		},
+	},
+	{
+		method: http.MethodPost, pattern: "/v1/clients", rpc: "CreateClientEndpoint",
+		summary: "Create a client", request: proto.ClientEndpoint{}, response: proto.Empty{},
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			var req proto.ClientEndpoint
+			if err := c.decode(&req); err != nil {
+				return nil, err
+			}
+			return c.unary(&req, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.CreateClientEndpoint(ctx, req.(*proto.ClientEndpoint))
+			})
+		},
+	},
+	{
+		method: http.MethodGet, pattern: "/v1/clients", rpc: "GetClientEndpoints",
+		summary: "List all clients", response: proto.Client{}, list: true,
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			stream := &clientStream{gatewayStream: c.collect()}
+			err := c.serverStream(stream.gatewayStream, &proto.Empty{}, func(req interface{}) error {
+				return s.GetClientEndpoints(req.(*proto.Empty), stream)
+			})
+			return stream.items, err
+		},
+	},
+	{
+		method: http.MethodPut, pattern: "/v1/clients/{name}/roles", rpc: "UpdateClientEndpointRoles",
+		summary: "Replace the roles of a client. The name in the body is ignored",
+		request: proto.ClientEndpoint{}, response: proto.Empty{},
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			var req proto.ClientEndpoint
+			if err := c.decode(&req); err != nil {
+				return nil, err
+			}
+			req.Name = c.params["name"]
+			return c.unary(&req, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.UpdateClientEndpointRoles(ctx, req.(*proto.ClientEndpoint))
+			})
+		},
+	},
+	{
+		method: http.MethodPut, pattern: "/v1/endpoints/{name}/credentials", rpc: "UpdateEndpointCredentials",
+		summary: "Replace the certificate pins and URI identity of an endpoint. The name in the body is ignored",
+		request: proto.EndpointCredentials{}, response: proto.Empty{},
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			var req proto.EndpointCredentials
+			if err := c.decode(&req); err != nil {
+				return nil, err
+			}
+			req.Name = c.params["name"]
+			return c.unary(&req, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.UpdateEndpointCredentials(ctx, req.(*proto.EndpointCredentials))
+			})
+		},
+	},
+	{
+		method: http.MethodPost, pattern: "/v1/endpoints/{name}/disable", rpc: "DisableEndpoint",
+		summary: "Reject an agent or client without deleting it", response: proto.Empty{},
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			return c.unary(c.endpointName(), func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.DisableEndpoint(ctx, req.(*proto.EndpointName))
+			})
+		},
+	},
+	{
+		method: http.MethodPost, pattern: "/v1/endpoints/{name}/enable", rpc: "EnableEndpoint",
+		summary: "Accept a disabled agent or client again", response: proto.Empty{},
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			return c.unary(c.endpointName(), func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.EnableEndpoint(ctx, req.(*proto.EndpointName))
+			})
+		},
+	},
+	{
+		method: http.MethodGet, pattern: "/v1/policy-rules", rpc: "GetPolicyRules",
+		summary: "List the casbin policy rules", response: proto.PolicyRule{}, list: true,
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			stream := &policyRuleStream{gatewayStream: c.collect()}
+			err := c.serverStream(stream.gatewayStream, &proto.Empty{}, func(req interface{}) error {
+				return s.GetPolicyRules(req.(*proto.Empty), stream)
+			})
+			return stream.items, err
+		},
+	},
+	{
+		method: http.MethodPost, pattern: "/v1/policy-rules", rpc: "AddPolicyRule",
+		summary: "Allow an RPC for the endpoints matching a subject rule",
+		request: proto.PolicyRule{}, response: proto.Empty{},
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			var req proto.PolicyRule
+			if err := c.decode(&req); err != nil {
+				return nil, err
+			}
+			return c.unary(&req, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.AddPolicyRule(ctx, req.(*proto.PolicyRule))
+			})
+		},
+	},
+	{
+		method: http.MethodDelete, pattern: "/v1/policy-rules", rpc: "RemovePolicyRule",
+		summary: "Remove a policy rule", request: proto.PolicyRule{}, response: proto.Empty{},
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			var req proto.PolicyRule
+			if err := c.decode(&req); err != nil {
+				return nil, err
+			}
+			return c.unary(&req, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.RemovePolicyRule(ctx, req.(*proto.PolicyRule))
+			})
+		},
+	},
+	{
+		method: http.MethodPost, pattern: "/v1/certificate-revocations", rpc: "RevokeCertificate",
+		summary: "Revoke a client certificate by its serial", request: proto.CertificateRevocation{}, response: proto.Empty{},
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			var req proto.CertificateRevocation
+			if err := c.decode(&req); err != nil {
+				return nil, err
+			}
+			return c.unary(&req, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.RevokeCertificate(ctx, req.(*proto.CertificateRevocation))
+			})
+		},
+	},
+	{
+		method: http.MethodGet, pattern: "/v1/audit-log", rpc: "QueryAuditLog",
+		summary: "Query a page of the audit log, the newest entries first. Filters are given as actor, action, target, " +
+			"result, from and until query parameters, besides page_size and page_token",
+		response: proto.AuditPage{},
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			query := c.r.URL.Query()
+			req := &proto.AuditQuery{
+				Actor:     query.Get("actor"),
+				Action:    query.Get("action"),
+				Target:    query.Get("target"),
+				Result:    query.Get("result"),
+				PageToken: query.Get("page_token"),
+			}
+
+			var err error
+			if req.From, err = parseIntParam(query, "from"); err != nil {
+				return nil, err
+			}
+			if req.Until, err = parseIntParam(query, "until"); err != nil {
+				return nil, err
+			}
+			if req.PageSize, err = parsePageSize(query); err != nil {
+				return nil, err
+			}
+
+			return c.unary(req, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.QueryAuditLog(ctx, req.(*proto.AuditQuery))
+			})
+		},
+	},
+	{
+		method: http.MethodGet, pattern: "/v1/chain-verification", rpc: "VerifyChain",
+		summary:  "Verify the hash chain over alerts and audit entries and list every break",
+		response: proto.ChainReport{},
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			return c.unary(&proto.Empty{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.VerifyChain(ctx, req.(*proto.Empty))
+			})
+		},
+	},
+	{
+		method: http.MethodDelete, pattern: "/v1/endpoints/{name}", rpc: "DeleteEndpoint",
+		summary: "Delete an agent or client", response: proto.Empty{},
+		handle: func(s *Server, c *gatewayCall) (interface{}, error) {
+			return c.unary(c.endpointName(), func(ctx context.Context, req interface{}) (interface{}, error) {
+				return s.DeleteEndpoint(ctx, req.(*proto.EndpointName))
+			})
+		},
+	},
+}
+
+type gateway struct {
+	srv *http.Server
+}
+
+func (s *Server) newGateway(tlsConfig *tls.Config) *gateway {
+	return &gateway{
+		srv: &http.Server{
+			Addr:              net.JoinHostPort(s.conf.Host, strconv.FormatInt(s.conf.GatewayPort, 10)),
+			Handler:           http.HandlerFunc(s.serveGateway),
+			TLSConfig:         tlsConfig,
+			ReadHeaderTimeout: gatewayReadHeaderTimeout,
+		},
+	}
+}
+
+func (g *gateway) run() error {
+	log.Info().Msgf("starting gateway on: %s", g.srv.Addr)
+
+	// The certificates are part of the TLS config
+	err := g.srv.ListenAndServeTLS("", "")
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// serveGatewayPage serves the resources that aren't RPCs: the OpenAPI document, the session and the dashboard
+func (s *Server) serveGatewayPage(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx, err := s.checkAuthentication(ctx, r.Method+" "+r.URL.Path)
+	if err != nil {
+		metrics.AuthenticationFailures.Inc()
+		writeGatewayError(w, status.Error(codes.Unauthenticated, "unauthenticated"))
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		switch {
+		case r.URL.Path == "/v1/openapi.json":
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(openAPIDocument())
+			return
+		case r.URL.Path == "/v1/session":
+			s.serveSession(ctx, w)
+			return
+		case r.URL.Path == "/":
+			http.Redirect(w, r, dashboardPrefix, http.StatusFound)
+			return
+		case strings.HasPrefix(r.URL.Path, dashboardPrefix):
+			dashboardHandler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	writeGatewayError(w, status.Error(codes.NotFound, "not found"))
+}
+
+func (g *gateway) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_ = g.srv.Shutdown(ctx)
+}
+
+func (s *Server) serveGateway(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil {
+		writeGatewayError(w, status.Error(codes.Unauthenticated, "unauthenticated"))
+		return
+	}
+
+	// The interceptors of the gRPC server read the client certificate from the peer
+	ctx := peer.NewContext(r.Context(), &peer.Peer{
+		Addr:     gatewayAddr(r.RemoteAddr),
+		AuthInfo: credentials.TLSInfo{State: *r.TLS},
+	})
+
+	rt, params, ok := matchRoute(r.Method, r.URL.Path)
+	if !ok {
+		s.serveGatewayPage(ctx, w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		err := checkSameOrigin(r)
+		if err != nil {
+			log.Warn().Err(err).Msgf("rejected %s %s from '%s'", r.Method, r.URL.Path, r.RemoteAddr)
+			writeGatewayError(w, err)
+			return
+		}
+	}
+
+	c := &gatewayCall{s: s, method: "/fim.Fim/" + rt.rpc, ctx: ctx, params: params, r: r, w: w}
+	resp, err := rt.handle(s, c)
+
+	if c.streaming {
+		// The status was already sent with the first item
+		if err != nil {
+			log.Warn().Err(err).Msgf("gateway stream for '%s' failed", rt.rpc)
+		}
+		return
+	}
+
+	if err != nil {
+		writeGatewayError(w, err)
+		return
+	}
+
+	body, err := marshalGatewayJSON(resp)
+	if err != nil {
+		log.Error().Caller().Err(err).Msgf("failed to encode response of '%s'", rt.rpc)
+		writeGatewayError(w, status.Error(codes.Internal, "internal error"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(append(body, '\n'))
+}
+
+// marshalGatewayJSON encodes proto messages with protojson and the proto field names, like other gRPC gateways do.
+// Lists of them and the gateway's own types are encoded with encoding/json.
+func marshalGatewayJSON(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case protoreflect.ProtoMessage:
+		return protojson.MarshalOptions{UseProtoNames: true}.Marshal(v)
+	case []interface{}:
+		items := make([]json.RawMessage, 0, len(v))
+		for _, item := range v {
+			b, err := marshalGatewayJSON(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, b)
+		}
+		return json.Marshal(items)
+	default:
+		return json.Marshal(v)
+	}
+}
+
+// checkSameOrigin rejects requests that another site may have made. Browsers send the client certificate with them too,
+// so they would run with the permissions of whoever opened that site. Other sites can't set the X-Requested-With header
+// or a JSON content type without a CORS preflight, which the gateway never answers.
+func checkSameOrigin(r *http.Request) error {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return status.Error(codes.PermissionDenied, "cross-site request")
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return status.Error(codes.PermissionDenied, "cross-origin request")
+		}
+	}
+
+	if r.Header.Get("X-Requested-With") == "" && !hasJSONBody(r) {
+		return status.Error(codes.PermissionDenied, "requests without a JSON body need the X-Requested-With header")
+	}
+
+	return nil
+}
+
+func hasJSONBody(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// parseIntParam parses an optional integer query parameter. Missing parameters are zero
+func parseIntParam(query url.Values, name string) (int64, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid %s", name)
+	}
+
+	return i, nil
+}
+
+// parsePageSize rejects sizes that don't fit the uint32 of the request, instead of letting them wrap around
+func parsePageSize(query url.Values) (uint32, error) {
+	pageSize, err := parseIntParam(query, "page_size")
+	if err != nil || pageSize < 0 || pageSize > math.MaxUint32 {
+		return 0, status.Error(codes.InvalidArgument, "invalid page_size")
+	}
+
+	return uint32(pageSize), nil
+}
+
+func matchRoute(method, path string) (route, map[string]string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	for _, rt := range routes {
+		if rt.method != method {
+			continue
+		}
+
+		patternSegments := strings.Split(strings.Trim(rt.pattern, "/"), "/")
+		if len(patternSegments) != len(segments) {
+			continue
+		}
+
+		params := make(map[string]string)
+		matched := true
+		for i, seg := range patternSegments {
+			if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+				params[strings.Trim(seg, "{}")] = segments[i]
+			} else if seg != segments[i] {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			return rt, params, true
+		}
+	}
+
+	return route{}, nil, false
+}
+
+func writeGatewayError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+
+	code := http.StatusInternalServerError
+	switch st.Code() {
+	case codes.InvalidArgument:
+		code = http.StatusBadRequest
+	case codes.Unauthenticated:
+		code = http.StatusUnauthorized
+	case codes.PermissionDenied:
+		code = http.StatusForbidden
+	case codes.NotFound:
+		code = http.StatusNotFound
+	case codes.AlreadyExists:
+		code = http.StatusConflict
+	case codes.FailedPrecondition:
+		code = http.StatusPreconditionFailed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": st.Message()})
+}
+
+type gatewayCall struct {
+	s         *Server
+	method    string
+	ctx       context.Context
+	params    map[string]string
+	r         *http.Request
+	w         http.ResponseWriter
+	streaming bool
+}
+
+// decode reads the JSON body into req
+func (c *gatewayCall) decode(req interface{}) error {
+	if !hasJSONBody(c.r) {
+		return status.Error(codes.InvalidArgument, "content type must be application/json")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.r.Body, maxGatewayBodySize))
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "invalid request body")
+	}
+
+	if m, ok := req.(protoreflect.ProtoMessage); ok {
+		err = protojson.Unmarshal(body, m)
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(req)
+	}
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "invalid request body")
+	}
+
+	return nil
+}
+
+// endpointName builds the request of RPCs that only take the name path parameter
+func (c *gatewayCall) endpointName() *proto.EndpointName {
+	return &proto.EndpointName{Name: c.params["name"]}
+}
+
+// unary calls handler through the unary interceptors of the gRPC server
+func (c *gatewayCall) unary(req interface{}, handler grpc.UnaryHandler) (interface{}, error) {
+	return c.s.unaryChain(c.ctx, req, &grpc.UnaryServerInfo{Server: c.s, FullMethod: c.method}, handler)
+}
+
+// serverStream calls handler through the stream interceptors of the gRPC server. Like gRPC, the request is received
+// from the stream the interceptors wrapped, which is how the validator sees it. gs takes over their context.
+func (c *gatewayCall) serverStream(gs *gatewayStream, req interface{}, handler func(req interface{}) error) error {
+	info := &grpc.StreamServerInfo{FullMethod: c.method, IsServerStream: true}
+
+	return c.s.streamChain(c.s, gs, info, func(_ interface{}, stream grpc.ServerStream) error {
+		err := stream.RecvMsg(req)
+		if err != nil {
+			return err
+		}
+
+		gs.ctx = stream.Context()
+
+		return handler(req)
+	})
+}
+
+// collect returns a server stream that gathers all sent items in memory
+func (c *gatewayCall) collect() *gatewayStream {
+	gs := &gatewayStream{ctx: c.ctx, items: make([]interface{}, 0)}
+	gs.send = func(m interface{}) error {
+		gs.items = append(gs.items, m)
+		return nil
+	}
+
+	return gs
+}
+
+// stream returns a server stream that writes every sent item as a line of JSON
+func (c *gatewayCall) stream() *gatewayStream {
+	flusher, _ := c.w.(http.Flusher)
+
+	return &gatewayStream{
+		ctx: c.ctx,
+		send: func(m interface{}) error {
+			if !c.streaming {
+				c.w.Header().Set("Content-Type", "application/x-ndjson")
+				c.w.WriteHeader(http.StatusOK)
+				c.streaming = true
+			}
+
+			b, err := marshalGatewayJSON(m)
+			if err != nil {
+				return err
+			}
+			if _, err := c.w.Write(append(b, '\n')); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+			return nil
+		},
+	}
+}
+
+// gatewayStream adapts HTTP responses to the server stream interfaces of the Fim service
+type gatewayStream struct {
+	ctx      context.Context
+	send     func(m interface{}) error
+	items    []interface{}
+	received bool
+}
+
+func (g *gatewayStream) SetHeader(metadata.MD) error  { return nil }
+func (g *gatewayStream) SendHeader(metadata.MD) error { return nil }
+func (g *gatewayStream) SetTrailer(metadata.MD)       {}
+func (g *gatewayStream) Context() context.Context     { return g.ctx }
+func (g *gatewayStream) SendMsg(m interface{}) error  { return g.send(m) }
+
+// RecvMsg receives the request of a server streaming RPC. It was built before the call, so it only has to be received
+// once.
+func (g *gatewayStream) RecvMsg(interface{}) error {
+	if g.received {
+		return io.EOF
+	}
+	g.received = true
+
+	return nil
+}
+
+// gatewayAddr is the remote address of a gateway request
+type gatewayAddr string
+
+func (a gatewayAddr) Network() string { return "tcp" }
+func (a gatewayAddr) String() string  { return string(a) }
+
+type agentStream struct {
+	*gatewayStream
+}
+
+func (a *agentStream) Send(agent *proto.Agent) error {
+	return a.send(agent)
+}
+
+type hostFactsStream struct {
+	*gatewayStream
+}
+
+func (h *hostFactsStream) Send(facts *proto.HostFacts) error {
+	return h.send(facts)
+}
+
+type clientStream struct {
+	*gatewayStream
+}
+
+func (c *clientStream) Send(client *proto.Client) error {
+	return c.send(client)
+}
+
+type pendingApprovalStream struct {
+	*gatewayStream
+}
+
+func (p *pendingApprovalStream) Send(approval *proto.PendingBaselineApproval) error {
+	return p.send(approval)
+}
+
+type policyRuleStream struct {
+	*gatewayStream
+}
+
+func (p *policyRuleStream) Send(rule *proto.PolicyRule) error {
+	return p.send(rule)
+}
+
+// alertStream sends every alert together with its differences
+type alertStream struct {
+	*gatewayStream
+	s *Server
+}
+
+func (a *alertStream) Send(al *proto.Alert) error {
+	alerts, err := a.s.newGatewayAlerts(a.ctx, []*proto.Alert{al})
+	if err != nil {
+		return err
+	}
+
+	return a.send(alerts[0])
+}
+
+// alertCollector keeps the sent alerts, so that their differences can be looked up at once
+type alertCollector struct {
+	*gatewayStream
+	alerts []*proto.Alert
+}
+
+func (a *alertCollector) Send(al *proto.Alert) error {
+	a.alerts = append(a.alerts, al)
+	return nil
+}
+
+// newGatewayAlerts adds the stored differences to the alerts, because proto alerts only carry the text form
+func (s *Server) newGatewayAlerts(ctx context.Context, alerts []*proto.Alert) ([]gatewayAlert, error) {
+	ids := make([]uint64, len(alerts))
+	for i, al := range alerts {
+		ids[i] = al.Id
+	}
+
+	stored, err := s.repo.Alerts().GetByIDs(ctx, ids)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to get alerts")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	differences := make(map[uint64][]models.Difference, len(stored))
+	for _, al := range stored {
+		differences[al.ID] = al.Differences
+	}
+
+	conv := make([]gatewayAlert, len(alerts))
+	for i, al := range alerts {
+		diffs := make([]gatewayDifference, 0, len(differences[al.Id]))
+		for _, diff := range differences[al.Id] {
+			diffs = append(diffs, gatewayDifference(diff))
+		}
+		conv[i] = gatewayAlert{Alert: al, Differences: diffs}
+	}
+
+	return conv, nil
+}
+
+// gatewayAlert extends alerts with their structured differences
+type gatewayAlert struct {
+	*proto.Alert
+	Differences []gatewayDifference `json:"differences"`
+}
+
+// MarshalJSON encodes the alert like other proto messages and adds the differences
+func (g gatewayAlert) MarshalJSON() ([]byte, error) {
+	b, err := marshalGatewayJSON(g.Alert)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	err = json.Unmarshal(b, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	fields["differences"], err = json.Marshal(g.Differences)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(fields)
+}
+
+type gatewayAlertPage struct {
+	Alerts        []gatewayAlert `json:"alerts"`
+	NextPageToken string         `json:"next_page_token,omitempty"`
+}
+
+type gatewayDifference struct {
+	Field  string `json:"field"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after"`
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Leantar/fimproto/proto"
+	"github.com/Leantar/fimserver/models"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestParsePageSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  uint32
+		fails bool
+	}{
+		{value: "", want: 0},
+		{value: "50", want: 50},
+		{value: "4294967295", want: 4294967295},
+		{value: "4294967296", fails: true},
+		{value: "-1", fails: true},
+		{value: "ten", fails: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parsePageSize(url.Values{"page_size": {tt.value}})
+		if (err != nil) != tt.fails {
+			t.Errorf("parsePageSize(%q) error = %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parsePageSize(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+// recordingStream records the requests a stream handler receives
+type recordingStream struct {
+	grpc.ServerStream
+	received []interface{}
+}
+
+func (r *recordingStream) RecvMsg(m interface{}) error {
+	r.received = append(r.received, m)
+	return r.ServerStream.RecvMsg(m)
+}
+
+func TestGatewayCallsRunThroughInterceptors(t *testing.T) {
+	repo := &approvalTestRepo{
+		agent:     models.Endpoint{ID: 1, Name: "agent1", Kind: "agent", HasBaseline: true, BaselineIsCurrent: true},
+		approvals: []models.BaselineApproval{{AgentID: 1, Approver: "alice", CreatedAt: 10}},
+	}
+	s := &Server{repo: repo}
+
+	var methods []string
+	s.unaryChain = func(ctx context.Context, _ interface{}, info *grpc.UnaryServerInfo, _ grpc.UnaryHandler) (interface{}, error) {
+		methods = append(methods, info.FullMethod)
+		if _, ok := peer.FromContext(ctx); !ok {
+			t.Error("unary call has no peer")
+		}
+		return nil, status.Error(codes.PermissionDenied, "unauthorized")
+	}
+
+	recorder := &recordingStream{}
+	s.streamChain = func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		methods = append(methods, info.FullMethod)
+		if _, ok := peer.FromContext(stream.Context()); !ok {
+			t.Error("stream has no peer")
+		}
+
+		wrapped := grpc_middleware.WrapServerStream(stream)
+		wrapped.WrappedContext = context.WithValue(stream.Context(), endpointKey("endpoint"), models.Endpoint{Name: "viewer"})
+		recorder.ServerStream = wrapped
+
+		return handler(srv, recorder)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "https://fim/v1/agents/agent1/baseline-approval", nil)
+	r.Header.Set("X-Requested-With", "fetch")
+	w := httptest.NewRecorder()
+	s.serveGateway(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("denied call returned %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if len(repo.approvals) != 1 {
+		t.Error("denied call reached the handler")
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "https://fim/v1/baseline-approvals", nil)
+	w = httptest.NewRecorder()
+	s.serveGateway(w, r)
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "alice") {
+		t.Errorf("stream returned %d: %s", w.Code, w.Body.String())
+	}
+	if len(recorder.received) != 1 {
+		t.Fatalf("stream handler received %d requests through the interceptors, want 1", len(recorder.received))
+	}
+	if _, ok := recorder.received[0].(*proto.Empty); !ok {
+		t.Errorf("stream handler received %T, want *proto.Empty", recorder.received[0])
+	}
+
+	want := []string{"/fim.Fim/CreateBaselineUpdateApproval", "/fim.Fim/GetPendingBaselineApprovals"}
+	if strings.Join(methods, " ") != strings.Join(want, " ") {
+		t.Errorf("interceptors ran for %v, want %v", methods, want)
+	}
+}
@@ -2,15 +2,19 @@ package server
 
 import (
 	"context"
+	"strings"
+	"time"
 
 	"github.com/Leantar/fimproto/proto"
 	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/validation"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-func (s *Server) CreateAgentEndpoint(ctx context.Context, endpoint *proto.AgentEndpoint) (*proto.Empty, error) {
+// CreateAgentEndpoint returns an enrollment token for the agent if the server issues certificates
+func (s *Server) CreateAgentEndpoint(ctx context.Context, endpoint *proto.AgentEndpoint) (*proto.EnrollmentToken, error) {
 	admin := ctx.Value(endpointKey("endpoint")).(models.Endpoint)
 
 	_, err := s.repo.Endpoints().GetByName(ctx, endpoint.Name)
@@ -34,8 +38,64 @@ func (s *Server) CreateAgentEndpoint(ctx context.Context, endpoint *proto.AgentE
 	}
 
 	log.Info().Msgf("'%s' created agent '%s", admin.Name, endpoint.Name)
+	s.forwarder.ForwardAction(admin.Name, "CreateAgentEndpoint", endpoint.Name)
 
-	return &proto.Empty{}, nil
+	if !s.issuesCertificates() {
+		return &proto.EnrollmentToken{}, nil
+	}
+
+	agent, err := s.repo.Endpoints().GetByName(ctx, endpoint.Name)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to get endpoint")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	token, err := s.newEnrollmentToken(ctx, agent)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to create enrollment token")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	return token, nil
+}
+
+// CreateEnrollmentToken lets an agent enroll again, e.g. after its certificate expired. Previous tokens become invalid.
+func (s *Server) CreateEnrollmentToken(ctx context.Context, endpointName *proto.EndpointName) (*proto.EnrollmentToken, error) {
+	admin := ctx.Value(endpointKey("endpoint")).(models.Endpoint)
+
+	if !s.issuesCertificates() {
+		return nil, status.Error(codes.FailedPrecondition, "enrollment is disabled")
+	}
+
+	agent, err := s.repo.Endpoints().GetByName(ctx, endpointName.Name)
+	if err != nil {
+		if s.repo.IsEmptyResultSetError(err) {
+			return nil, status.Error(codes.NotFound, "endpoint not found")
+		}
+		log.Error().Caller().Err(err).Msg("failed to get endpoint")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	if agent.Kind != "agent" {
+		return nil, status.Error(codes.InvalidArgument, "only agents can enroll")
+	}
+
+	token, err := s.newEnrollmentToken(ctx, agent)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to create enrollment token")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	err = s.repo.BaselineApprovals().DeleteByAgent(ctx, agent.ID)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to delete baseline approvals")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	log.Info().Msgf("'%s' created an enrollment token for '%s'", admin.Name, agent.Name)
+	s.forwarder.ForwardAction(admin.Name, "CreateEnrollmentToken", agent.Name)
+
+	return token, nil
 }
 
 func (s *Server) CreateClientEndpoint(ctx context.Context, endpoint *proto.ClientEndpoint) (*proto.Empty, error) {
@@ -60,6 +120,7 @@ func (s *Server) CreateClientEndpoint(ctx context.Context, endpoint *proto.Clien
 	}
 
 	log.Info().Msgf("'%s' created client '%s' with roles '%v'", admin.Name, endpoint.Name, endpoint.Roles)
+	s.forwarder.ForwardAction(admin.Name, "CreateClientEndpoint", endpoint.Name)
 
 	return &proto.Empty{}, nil
 }
@@ -67,7 +128,7 @@ func (s *Server) CreateClientEndpoint(ctx context.Context, endpoint *proto.Clien
 func (s *Server) DeleteEndpoint(ctx context.Context, endpointName *proto.EndpointName) (*proto.Empty, error) {
 	admin := ctx.Value(endpointKey("endpoint")).(models.Endpoint)
 
-	_, err := s.repo.Endpoints().GetByName(ctx, endpointName.Name)
+	endpoint, err := s.repo.Endpoints().GetByName(ctx, endpointName.Name)
 	if err != nil {
 		if s.repo.IsEmptyResultSetError(err) {
 			return nil, status.Error(codes.NotFound, "endpoint not found")
@@ -76,6 +137,15 @@ func (s *Server) DeleteEndpoint(ctx context.Context, endpointName *proto.Endpoin
 		return nil, status.Error(codes.Internal, "internal error")
 	}
 
+	// Deleting the endpoint would delete the alerts as well, without recording the removal in the chain
+	if endpoint.Kind == "agent" {
+		err = s.removeAlerts(ctx, endpoint.ID)
+		if err != nil {
+			log.Error().Caller().Err(err).Msg("failed to delete alerts")
+			return nil, status.Error(codes.Internal, "internal error")
+		}
+	}
+
 	err = s.repo.Endpoints().Delete(ctx, endpointName.Name)
 	if err != nil {
 		log.Error().Caller().Err(err).Msg("failed to delete endpoint")
@@ -83,6 +153,7 @@ func (s *Server) DeleteEndpoint(ctx context.Context, endpointName *proto.Endpoin
 	}
 
 	log.Info().Msgf("'%s' deleted endpoint '%s'", admin.Name, endpointName.Name)
+	s.forwarder.ForwardAction(admin.Name, "DeleteEndpoint", endpointName.Name)
 
 	return &proto.Empty{}, nil
 }
@@ -99,15 +170,307 @@ func (s *Server) UpdateEndpointWatchedPaths(ctx context.Context, obj *proto.Agen
 		return nil, status.Error(codes.Internal, "internal error")
 	}
 
-	agent.WatchedPaths = obj.WatchedPaths
-
-	err = s.repo.Endpoints().Update(ctx, agent)
+	err = s.repo.Endpoints().UpdateWatchedPaths(ctx, agent.ID, obj.WatchedPaths)
 	if err != nil {
 		log.Error().Caller().Err(err).Msg("failed to update endpoint")
 		return nil, status.Error(codes.Internal, "internal error")
 	}
 
 	log.Info().Msgf("'%s' changed watched paths for '%s'", admin.Name, agent.Name)
+	s.forwarder.ForwardAction(admin.Name, "UpdateEndpointWatchedPaths", agent.Name)
+
+	return &proto.Empty{}, nil
+}
+
+func (s *Server) GetClientEndpoints(_ *proto.Empty, stream proto.Fim_GetClientEndpointsServer) error {
+	clients, err := s.repo.Endpoints().GetClients(stream.Context())
+	if err != nil {
+		if s.repo.IsEmptyResultSetError(err) {
+			return status.Error(codes.NotFound, "no clients were found")
+		}
+		log.Error().Caller().Err(err).Msg("failed to get clients")
+		return status.Error(codes.Internal, "internal error")
+	}
+
+	for _, c := range clients {
+		err := stream.Send(&proto.Client{
+			Name:     c.Name,
+			Roles:    c.Roles,
+			Disabled: c.Disabled,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) UpdateClientEndpointRoles(ctx context.Context, endpoint *proto.ClientEndpoint) (*proto.Empty, error) {
+	admin := ctx.Value(endpointKey("endpoint")).(models.Endpoint)
+
+	// Prevents admins from locking themselves out
+	if endpoint.Name == admin.Name {
+		return nil, status.Error(codes.FailedPrecondition, "can't change own roles")
+	}
+
+	client, err := s.repo.Endpoints().GetByName(ctx, endpoint.Name)
+	if err != nil {
+		if s.repo.IsEmptyResultSetError(err) {
+			return nil, status.Error(codes.NotFound, "client not found")
+		}
+		log.Error().Caller().Err(err).Msg("failed to get client")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	if client.Kind != "client" {
+		return nil, status.Error(codes.InvalidArgument, "endpoint is not a client")
+	}
+
+	roles := endpoint.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+
+	err = s.repo.Endpoints().UpdateRoles(ctx, client.ID, roles)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to update endpoint")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	log.Info().Msgf("'%s' changed roles of client '%s' from '%v' to '%v'", admin.Name, client.Name, client.Roles, roles)
+	s.forwarder.ForwardAction(admin.Name, "UpdateClientEndpointRoles", client.Name)
+
+	return &proto.Empty{}, nil
+}
+
+// UpdateEndpointCredentials replaces the certificate pins and the URI identity of an endpoint
+func (s *Server) UpdateEndpointCredentials(ctx context.Context, creds *proto.EndpointCredentials) (*proto.Empty, error) {
+	admin := ctx.Value(endpointKey("endpoint")).(models.Endpoint)
+
+	// Prevents admins from locking themselves out
+	if creds.Name == admin.Name {
+		return nil, status.Error(codes.FailedPrecondition, "can't change own credentials")
+	}
+
+	pins := make([]string, 0, len(creds.CertPins))
+	for _, pin := range creds.CertPins {
+		normalized, err := validation.NormalizeCertPin(pin)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		pins = append(pins, normalized)
+	}
+
+	if creds.UriIdentity != "" {
+		err := validation.URIIdentity(creds.UriIdentity)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	endpoint, err := s.repo.Endpoints().GetByName(ctx, creds.Name)
+	if err != nil {
+		if s.repo.IsEmptyResultSetError(err) {
+			return nil, status.Error(codes.NotFound, "endpoint not found")
+		}
+		log.Error().Caller().Err(err).Msg("failed to get endpoint")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	if creds.UriIdentity != "" {
+		other, err := s.repo.Endpoints().GetByURIIdentity(ctx, creds.UriIdentity)
+		if err == nil && other.ID != endpoint.ID {
+			return nil, status.Error(codes.AlreadyExists, "uri identity belongs to another endpoint")
+		}
+		if err != nil && !s.repo.IsEmptyResultSetError(err) {
+			log.Error().Caller().Err(err).Msg("failed to get endpoint")
+			return nil, status.Error(codes.Internal, "internal error")
+		}
+	}
+
+	err = s.repo.Endpoints().UpdateCredentials(ctx, endpoint.ID, pins, creds.UriIdentity)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to update endpoint")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	err = s.repo.BaselineApprovals().DeleteByAgent(ctx, endpoint.ID)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to delete baseline approvals")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	log.Info().Msgf("'%s' set %d certificate pins and uri identity '%s' for '%s'", admin.Name, len(pins), creds.UriIdentity, endpoint.Name)
+	s.forwarder.ForwardAction(admin.Name, "UpdateEndpointCredentials", endpoint.Name)
+
+	return &proto.Empty{}, nil
+}
+
+func (s *Server) DisableEndpoint(ctx context.Context, endpointName *proto.EndpointName) (*proto.Empty, error) {
+	return s.setEndpointDisabled(ctx, endpointName.Name, true)
+}
+
+func (s *Server) EnableEndpoint(ctx context.Context, endpointName *proto.EndpointName) (*proto.Empty, error) {
+	return s.setEndpointDisabled(ctx, endpointName.Name, false)
+}
+
+func (s *Server) setEndpointDisabled(ctx context.Context, name string, disabled bool) (*proto.Empty, error) {
+	admin := ctx.Value(endpointKey("endpoint")).(models.Endpoint)
+
+	if name == admin.Name {
+		return nil, status.Error(codes.FailedPrecondition, "can't disable or enable yourself")
+	}
+
+	endpoint, err := s.repo.Endpoints().GetByName(ctx, name)
+	if err != nil {
+		if s.repo.IsEmptyResultSetError(err) {
+			return nil, status.Error(codes.NotFound, "endpoint not found")
+		}
+		log.Error().Caller().Err(err).Msg("failed to get endpoint")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	if endpoint.Disabled == disabled {
+		return nil, status.Error(codes.AlreadyExists, "endpoint is already in the requested state")
+	}
+
+	err = s.repo.Endpoints().UpdateDisabled(ctx, endpoint.ID, disabled)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to update endpoint")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	err = s.repo.BaselineApprovals().DeleteByAgent(ctx, endpoint.ID)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to delete baseline approvals")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	action := "EnableEndpoint"
+	if disabled {
+		action = "DisableEndpoint"
+	}
+
+	log.Info().Msgf("'%s' performed %s on '%s'", admin.Name, action, endpoint.Name)
+	s.forwarder.ForwardAction(admin.Name, action, endpoint.Name)
+
+	return &proto.Empty{}, nil
+}
+
+func (s *Server) GetPolicyRules(_ *proto.Empty, stream proto.Fim_GetPolicyRulesServer) error {
+	for _, rule := range s.enforcer.GetPolicy() {
+		if len(rule) < 2 {
+			continue
+		}
+
+		err := stream.Send(&proto.PolicyRule{
+			SubjectRule: rule[0],
+			Rpc:         rule[1],
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) AddPolicyRule(ctx context.Context, rule *proto.PolicyRule) (*proto.Empty, error) {
+	admin := ctx.Value(endpointKey("endpoint")).(models.Endpoint)
+
+	err := validation.PolicyRule(rule.SubjectRule, rule.Rpc)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// The enforcer stores the rule through the adapter and applies it immediately
+	added, err := s.enforcer.AddPolicy(rule.SubjectRule, rule.Rpc)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to add policy rule")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	if !added {
+		return nil, status.Error(codes.AlreadyExists, "policy rule already exists")
+	}
+
+	log.Info().Msgf("'%s' allowed '%s' for '%s'", admin.Name, rule.Rpc, rule.SubjectRule)
+	s.forwarder.ForwardAction(admin.Name, "AddPolicyRule", rule.Rpc+": "+rule.SubjectRule)
+
+	return &proto.Empty{}, nil
+}
+
+func (s *Server) RemovePolicyRule(ctx context.Context, rule *proto.PolicyRule) (*proto.Empty, error) {
+	admin := ctx.Value(endpointKey("endpoint")).(models.Endpoint)
+
+	// Removals are checked one after another, so that two of them can't lock out an admin together
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+
+	if !s.enforcer.HasPolicy(rule.SubjectRule, rule.Rpc) {
+		return nil, status.Error(codes.NotFound, "policy rule not found")
+	}
+
+	// Prevents admins from locking themselves out of policy management
+	lost, err := s.lostPolicyRPCs(admin, []string{rule.SubjectRule, rule.Rpc})
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to check policy rule removal")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	if len(lost) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "removing the rule would revoke your access to %s", strings.Join(lost, ", "))
+	}
+
+	removed, err := s.enforcer.RemovePolicy(rule.SubjectRule, rule.Rpc)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to remove policy rule")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	if !removed {
+		return nil, status.Error(codes.NotFound, "policy rule not found")
+	}
+
+	log.Info().Msgf("'%s' removed '%s' for '%s'", admin.Name, rule.Rpc, rule.SubjectRule)
+	s.forwarder.ForwardAction(admin.Name, "RemovePolicyRule", rule.Rpc+": "+rule.SubjectRule)
+
+	return &proto.Empty{}, nil
+}
+
+func (s *Server) RevokeCertificate(ctx context.Context, rev *proto.CertificateRevocation) (*proto.Empty, error) {
+	admin := ctx.Value(endpointKey("endpoint")).(models.Endpoint)
+
+	serial, err := parseSerial(rev.Serial)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if s.revoked.isRevoked(serial) {
+		return nil, status.Error(codes.AlreadyExists, "certificate is already revoked")
+	}
+
+	err = s.repo.Revocations().Create(ctx, models.Revocation{
+		Serial:    serialKey(serial),
+		Reason:    rev.Reason,
+		RevokedBy: admin.Name,
+		RevokedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to create revocation")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	s.revoked.addStored(serialKey(serial))
+
+	// This server rejects the certificate from now on. The file only matters to other consumers of the CRL,
+	// and refreshRevocations writes it again from the database.
+	if s.publishesCRL() {
+		err = s.publishCRL(ctx)
+		if err != nil {
+			log.Error().Caller().Err(err).Msg("failed to publish crl")
+		}
+	}
+
+	log.Info().Msgf("'%s' revoked certificate '%s': %s", admin.Name, serialKey(serial), rev.Reason)
+	s.forwarder.ForwardAction(admin.Name, "RevokeCertificate", serialKey(serial))
 
 	return &proto.Empty{}, nil
 }
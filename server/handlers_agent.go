@@ -2,12 +2,18 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"time"
 
 	"github.com/Leantar/fimproto/proto"
 	"github.com/Leantar/fimserver/models"
 	"github.com/Leantar/fimserver/modules/alert"
+	"github.com/Leantar/fimserver/modules/metrics"
+	"github.com/Leantar/fimserver/modules/notifier"
+	"github.com/Leantar/fimserver/modules/tracing"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -17,6 +23,12 @@ const (
 	KindCreate = "CREATE"
 )
 
+const (
+	// Host facts are stored as the agent reports them, so their size is limited
+	maxHostFactLength  = 256
+	maxHostIPAddresses = 64
+)
+
 func (s *Server) GetStartupInfo(ctx context.Context, _ *proto.Empty) (*proto.StartupInfo, error) {
 	agent := ctx.Value(endpointKey("endpoint")).(models.Endpoint)
 
@@ -27,8 +39,110 @@ func (s *Server) GetStartupInfo(ctx context.Context, _ *proto.Empty) (*proto.Sta
 	}, nil
 }
 
+// Heartbeat lets idle agents show that they are alive. The last seen time is recorded during authentication.
+func (s *Server) Heartbeat(_ context.Context, _ *proto.Empty) (*proto.Empty, error) {
+	return &proto.Empty{}, nil
+}
+
+// Enroll issues a certificate to an agent that presents its enrollment token, or renews the certificate it presents
+// for the same key.
+// It is the only call that doesn't require a client certificate.
+func (s *Server) Enroll(ctx context.Context, req *proto.EnrollmentRequest) (*proto.EnrollmentResponse, error) {
+	if !s.issuesCertificates() {
+		return nil, status.Error(codes.Unimplemented, "enrollment is disabled")
+	}
+
+	// Checked first, so that a malformed request doesn't use up the token
+	csr, err := parseCSR(req.Csr)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	agent, err := s.enrollingAgent(ctx, req.Token, csr)
+	if err != nil {
+		s.rejectEnrollment(err)
+		return nil, status.Error(codes.Unauthenticated, "unauthenticated")
+	}
+
+	resp, err := s.issueAgentCertificate(ctx, agent, csr)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to issue certificate")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	s.forwarder.ForwardAction(agent.Name, "Enroll", agent.Name)
+
+	return resp, nil
+}
+
+// ReportHostFacts stores the facts an agent reports about its host. Unchanged facts are not stored again, so the
+// history only contains changes.
+func (s *Server) ReportHostFacts(ctx context.Context, hostFacts *proto.HostFacts) (*proto.Empty, error) {
+	agent := ctx.Value(endpointKey("endpoint")).(models.Endpoint)
+
+	facts := models.HostFacts{
+		Hostname:     hostFacts.Hostname,
+		OsRelease:    hostFacts.OsRelease,
+		Kernel:       hostFacts.Kernel,
+		AgentVersion: hostFacts.AgentVersion,
+		IPAddresses:  models.SortedIPAddresses(hostFacts.IpAddresses),
+		ReportedAt:   time.Now().Unix(),
+		AgentID:      agent.ID,
+	}
+
+	err := validateHostFacts(facts)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	latest, err := s.repo.HostFacts().GetLatestByAgent(ctx, agent.ID)
+	if err != nil && !s.repo.IsEmptyResultSetError(err) {
+		log.Error().Caller().Err(err).Msg("failed to get host facts")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	if err == nil && latest.Equal(facts) {
+		return &proto.Empty{}, nil
+	}
+
+	err = s.repo.HostFacts().Create(ctx, facts)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to create host facts")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	log.Info().Msgf("agent '%s' reported host facts of '%s' running agent version '%s'", agent.Name, facts.Hostname, facts.AgentVersion)
+
+	return &proto.Empty{}, nil
+}
+
+func validateHostFacts(facts models.HostFacts) error {
+	fields := map[string]string{
+		"hostname":      facts.Hostname,
+		"os release":    facts.OsRelease,
+		"kernel":        facts.Kernel,
+		"agent version": facts.AgentVersion,
+	}
+	for name, value := range fields {
+		if len(value) > maxHostFactLength {
+			return fmt.Errorf("%s must not be longer than %d characters", name, maxHostFactLength)
+		}
+	}
+
+	if len(facts.IPAddresses) > maxHostIPAddresses {
+		return fmt.Errorf("at most %d ip addresses can be reported", maxHostIPAddresses)
+	}
+	for _, addr := range facts.IPAddresses {
+		if len(addr) > maxHostFactLength {
+			return fmt.Errorf("ip addresses must not be longer than %d characters", maxHostFactLength)
+		}
+	}
+
+	return nil
+}
+
 func (s *Server) CreateBaseline(stream proto.Fim_CreateBaselineServer) error {
 	agent := stream.Context().Value(endpointKey("endpoint")).(models.Endpoint)
+	start := time.Now()
 
 	var objs []models.FsObject
 
@@ -73,13 +187,22 @@ func (s *Server) CreateBaseline(stream proto.Fim_CreateBaselineServer) error {
 		return status.Error(codes.Internal, "internal error")
 	}
 
+	err = s.repo.Endpoints().UpdateLastScan(stream.Context(), agent.ID, time.Now().Unix())
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to update last scan")
+		return status.Error(codes.Internal, "internal error")
+	}
+
 	log.Info().Msgf("'%s' set its baseline", agent.Name)
+	metrics.BaselineUploadSize.WithLabelValues("create").Observe(float64(len(objs)))
+	metrics.BaselineUploadDuration.WithLabelValues("create").Observe(time.Since(start).Seconds())
 
 	return stream.SendAndClose(&proto.Empty{})
 }
 
 func (s *Server) UpdateBaseline(stream proto.Fim_UpdateBaselineServer) error {
 	agent := stream.Context().Value(endpointKey("endpoint")).(models.Endpoint)
+	start := time.Now()
 
 	err := s.repo.BaselineFsObjects().DeleteBaselineForAgent(stream.Context(), agent.ID)
 	if err != nil {
@@ -87,9 +210,9 @@ func (s *Server) UpdateBaseline(stream proto.Fim_UpdateBaselineServer) error {
 		return status.Error(codes.Internal, "internal error")
 	}
 
-	err = s.repo.Alerts().DeleteAll(stream.Context(), agent.ID)
+	err = s.removeAlerts(stream.Context(), agent.ID)
 	if err != nil {
-		log.Error().Caller().Err(err).Msg("failed to delete baseline")
+		log.Error().Caller().Err(err).Msg("failed to delete alerts")
 		return status.Error(codes.Internal, "internal error")
 	}
 
@@ -135,7 +258,15 @@ func (s *Server) UpdateBaseline(stream proto.Fim_UpdateBaselineServer) error {
 		return status.Error(codes.Internal, "internal error")
 	}
 
+	err = s.repo.Endpoints().UpdateLastScan(stream.Context(), agent.ID, time.Now().Unix())
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to update last scan")
+		return status.Error(codes.Internal, "internal error")
+	}
+
 	log.Info().Msgf("'%s' updated its baseline", agent.Name)
+	metrics.BaselineUploadSize.WithLabelValues("update").Observe(float64(len(objs)))
+	metrics.BaselineUploadDuration.WithLabelValues("update").Observe(time.Since(start).Seconds())
 
 	return stream.SendAndClose(&proto.Empty{})
 }
@@ -150,6 +281,11 @@ func (s *Server) ReportFsStatus(stream proto.Fim_ReportFsStatusServer) error {
 	}
 
 	m := alert.NewManager(baseline, agent.ID)
+	// Only the comparison is timed. Waiting for the agent to send objects is excluded
+	var compareDuration time.Duration
+	var received int
+
+	_, receiveSpan := tracing.Start(stream.Context(), "ReportFsStatus.receive")
 
 	for {
 		fsObject, err := stream.Recv()
@@ -158,8 +294,10 @@ func (s *Server) ReportFsStatus(stream proto.Fim_ReportFsStatusServer) error {
 		}
 		if err != nil {
 			log.Error().Caller().Err(err).Msg("failed to read from stream")
+			receiveSpan.End()
 			return err
 		}
+		received++
 
 		obj := models.FsObject{
 			Path:     fsObject.Path,
@@ -170,19 +308,39 @@ func (s *Server) ReportFsStatus(stream proto.Fim_ReportFsStatusServer) error {
 			Gid:      fsObject.Gid,
 			Mode:     fsObject.Mode,
 		}
+		compareStart := time.Now()
 		m.CheckForAlert(obj)
+		compareDuration += time.Since(compareStart)
 	}
 
+	receiveSpan.SetAttributes(
+		attribute.Int("fim.objects", received),
+		attribute.Int64("fim.compare_duration_ms", compareDuration.Milliseconds()),
+	)
+	receiveSpan.End()
+
+	_, resultSpan := tracing.Start(stream.Context(), "alert.Manager.Result")
+	compareStart := time.Now()
 	alerts := m.Result()
+	compareDuration += time.Since(compareStart)
+	resultSpan.SetAttributes(attribute.Int("fim.alerts", len(alerts)))
+	resultSpan.End()
+	metrics.CompareDuration.Observe(compareDuration.Seconds())
 
 	for _, al := range alerts {
-		err = createAlertIfNotDuplicate(stream.Context(), s.repo, al, agent.ID)
+		err = s.createAlertIfNotDuplicate(stream.Context(), al, agent)
 		if err != nil {
 			log.Error().Caller().Err(err).Msg("failed to create alert")
 			return status.Error(codes.Internal, "internal error")
 		}
 	}
 
+	err = s.repo.Endpoints().UpdateLastScan(stream.Context(), agent.ID, time.Now().Unix())
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to update last scan")
+		return status.Error(codes.Internal, "internal error")
+	}
+
 	return stream.SendAndClose(&proto.Empty{})
 }
 
@@ -217,6 +375,7 @@ func (s *Server) ReportFsEvent(ctx context.Context, event *proto.Event) (*proto.
 
 	al := models.Alert{
 		Kind:     event.Kind,
+		Severity: alert.SeverityOf(event.Kind),
 		IssuedAt: event.IssuedAt,
 		Path:     event.FsObject.Path,
 		Modified: event.FsObject.Modified,
@@ -224,10 +383,13 @@ func (s *Server) ReportFsEvent(ctx context.Context, event *proto.Event) (*proto.
 	}
 
 	if al.Kind == KindChange {
-		al.Difference = alert.GetDifference(baseObj, evtObject)
+		al.Difference, al.Differences = alert.GetDifference(baseObj, evtObject)
+		alert.ApplyTimestampAnomaly(&al, baseObj, evtObject, time.Now().Unix())
+	} else if al.Kind == KindCreate {
+		alert.ApplyTimestampAnomaly(&al, models.FsObject{}, evtObject, time.Now().Unix())
 	}
 
-	err = createAlertIfNotDuplicate(ctx, s.repo, al, agent.ID)
+	err = s.createAlertIfNotDuplicate(ctx, al, agent)
 	if err != nil {
 		log.Error().Caller().Err(err).Msg("failed to create alert")
 		return nil, status.Error(codes.Internal, "internal error")
@@ -236,25 +398,40 @@ func (s *Server) ReportFsEvent(ctx context.Context, event *proto.Event) (*proto.
 	return &proto.Empty{}, nil
 }
 
-func createAlertIfNotDuplicate(ctx context.Context, repo Repository, al models.Alert, agentID uint64) error {
-	latest, err := repo.Alerts().GetLatestByPathAndAgent(ctx, al.Path, agentID)
-	if repo.IsEmptyResultSetError(err) {
+func (s *Server) createAlertIfNotDuplicate(ctx context.Context, al models.Alert, agent models.Endpoint) error {
+	latest, err := s.repo.Alerts().GetLatestByPathAndAgent(ctx, al.Path, agent.ID)
+	if s.repo.IsEmptyResultSetError(err) {
 		// no previous alert exists for this path
-		return repo.Alerts().Create(ctx, al)
+		return s.createAlert(ctx, al, agent)
 	}
 	if err != nil {
 		return err
 	}
 
 	if al.Kind != latest.Kind {
-		return repo.Alerts().Create(ctx, al)
+		return s.createAlert(ctx, al, agent)
 	} else {
 		if al.Kind == KindCreate && al.Modified > latest.Modified {
-			return repo.Alerts().Create(ctx, al)
-		} else if al.Kind == KindChange && al.Difference != latest.Difference {
-			return repo.Alerts().Create(ctx, al)
+			return s.createAlert(ctx, al, agent)
+		} else if (al.Kind == KindChange || al.Kind == alert.KindTimestomp) && al.Difference != latest.Difference {
+			return s.createAlert(ctx, al, agent)
 		}
 	}
 
 	return nil
 }
+
+func (s *Server) createAlert(ctx context.Context, al models.Alert, agent models.Endpoint) error {
+	id, err := s.repo.Alerts().Create(ctx, al, func(stored models.Alert) ([]notifier.Message, error) {
+		return s.notifier.AlertMessages(stored, agent.Name)
+	})
+	if err != nil {
+		return err
+	}
+	al.ID = id
+	metrics.AlertsCreated.WithLabelValues(al.Kind).Inc()
+
+	s.forwarder.ForwardAlert(al, agent.Name)
+
+	return nil
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"time"
 
 	"github.com/Leantar/fimproto/proto"
 	"github.com/Leantar/fimserver/models"
@@ -10,6 +11,19 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// Calls of these RPCs change an agent. They discard the agent's pending approvals, which were given for the agent as it
+// was. With exclude_last_changer, whoever made the last one can't approve its baseline update.
+var agentChangingRPCs = []string{
+	"CreateAgentEndpoint",
+	"CreateEnrollmentToken",
+	"UpdateEndpointWatchedPaths",
+	"UpdateEndpointCredentials",
+	"DisableEndpoint",
+	"EnableEndpoint",
+}
+
+// CreateBaselineUpdateApproval records the approval of the caller. The agent is allowed to update its baseline once
+// enough distinct approvers approved it.
 func (s *Server) CreateBaselineUpdateApproval(ctx context.Context, endpointName *proto.EndpointName) (*proto.Empty, error) {
 	approver := ctx.Value(endpointKey("endpoint")).(models.Endpoint)
 
@@ -26,14 +40,116 @@ func (s *Server) CreateBaselineUpdateApproval(ctx context.Context, endpointName
 		return nil, status.Error(codes.AlreadyExists, "agent already has permission to update baseline")
 	}
 
-	agent.BaselineIsCurrent = false
-	err = s.repo.Endpoints().Update(ctx, agent)
+	lastChanger, err := s.lastChanger(ctx, agent)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to get last change of agent")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+	if lastChanger == approver.Name {
+		return nil, status.Error(codes.PermissionDenied, "the last one to change the agent can't approve its baseline update")
+	}
+
+	approvals, err := s.repo.BaselineApprovals().GetByAgent(ctx, agent.ID)
 	if err != nil {
-		log.Error().Caller().Err(err).Msg("failed to update agent")
+		log.Error().Caller().Err(err).Msg("failed to get baseline approvals")
 		return nil, status.Error(codes.Internal, "internal error")
 	}
 
+	for _, a := range approvals {
+		if a.Approver == approver.Name {
+			return nil, status.Error(codes.AlreadyExists, "baseline update was already approved by the caller")
+		}
+	}
+
+	quorum := s.baselineApprovalQuorum()
+	approvers, err := s.repo.BaselineApprovals().Approve(ctx, models.BaselineApproval{
+		AgentID:   agent.ID,
+		Approver:  approver.Name,
+		CreatedAt: time.Now().Unix(),
+	}, lastChanger, quorum)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to create baseline approval")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	s.forwarder.ForwardAction(approver.Name, "CreateBaselineUpdateApproval", agent.Name)
+
+	if approvers < quorum {
+		log.Info().Msgf("'%s' approved the baseline update of agent '%s', %d of %d approvals",
+			approver.Name, agent.Name, approvers, quorum)
+		return &proto.Empty{}, nil
+	}
+
 	log.Info().Caller().Msgf("'%s' allowed agent '%s' to update it's baseline", approver.Name, agent.Name)
 
 	return &proto.Empty{}, nil
 }
+
+// GetPendingBaselineApprovals lists the agents that were approved by fewer approvers than required
+func (s *Server) GetPendingBaselineApprovals(_ *proto.Empty, stream proto.Fim_GetPendingBaselineApprovalsServer) error {
+	approvals, err := s.repo.BaselineApprovals().GetAll(stream.Context())
+	if err != nil {
+		if s.repo.IsEmptyResultSetError(err) {
+			return status.Error(codes.NotFound, "no pending baseline approvals were found")
+		}
+		log.Error().Caller().Err(err).Msg("failed to get baseline approvals")
+		return status.Error(codes.Internal, "internal error")
+	}
+
+	// Approvals are ordered by agent, so every agent's approvals follow each other
+	var pending []*proto.PendingBaselineApproval
+	var agentID uint64
+	for _, a := range approvals {
+		if len(pending) == 0 || a.AgentID != agentID {
+			agent, err := s.repo.Endpoints().GetByID(stream.Context(), a.AgentID)
+			if err != nil {
+				log.Error().Caller().Err(err).Msg("failed to get agent")
+				return status.Error(codes.Internal, "internal error")
+			}
+
+			agentID = a.AgentID
+			pending = append(pending, &proto.PendingBaselineApproval{
+				AgentName:         agent.Name,
+				RequiredApprovals: uint32(s.baselineApprovalQuorum()),
+				RequestedAt:       a.CreatedAt,
+			})
+		}
+
+		p := pending[len(pending)-1]
+		p.Approvers = append(p.Approvers, a.Approver)
+	}
+
+	for _, p := range pending {
+		err := stream.Send(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) baselineApprovalQuorum() int {
+	if s.conf.BaselineApprovalQuorum > 1 {
+		return int(s.conf.BaselineApprovalQuorum)
+	}
+
+	return 1
+}
+
+// lastChanger returns the name of whoever last changed the agent, if they are excluded from approving it
+func (s *Server) lastChanger(ctx context.Context, agent models.Endpoint) (string, error) {
+	if !s.conf.ExcludeLastChanger {
+		return "", nil
+	}
+
+	change, err := s.repo.Audit().GetLatestByTarget(ctx, agent.Name, agentChangingRPCs)
+	if err != nil {
+		if s.repo.IsEmptyResultSetError(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return change.Actor, nil
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/Leantar/fimproto/proto"
+	"github.com/Leantar/fimserver/models"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// approvalTestRepo keeps an agent and its approvals in memory. Approve counts approvers like
+// PgBaselineApprovalRepository.Approve.
+type approvalTestRepo struct {
+	Repository
+	agent       models.Endpoint
+	approvals   []models.BaselineApproval
+	lastChanger string
+}
+
+func (r *approvalTestRepo) Endpoints() EndpointRepository { return approvalTestEndpoints{r: r} }
+func (r *approvalTestRepo) BaselineApprovals() BaselineApprovalRepository {
+	return approvalTestApprovals{r: r}
+}
+func (r *approvalTestRepo) Audit() AuditRepository               { return approvalTestAudit{r: r} }
+func (r *approvalTestRepo) IsEmptyResultSetError(err error) bool { return err == errTestNotFound }
+
+var errTestNotFound = errors.New("not found")
+
+type approvalTestEndpoints struct {
+	EndpointRepository
+	r *approvalTestRepo
+}
+
+func (e approvalTestEndpoints) GetByName(_ context.Context, name string) (models.Endpoint, error) {
+	if name != e.r.agent.Name {
+		return models.Endpoint{}, errTestNotFound
+	}
+	return e.r.agent, nil
+}
+
+func (e approvalTestEndpoints) GetByID(_ context.Context, id uint64) (models.Endpoint, error) {
+	if id != e.r.agent.ID {
+		return models.Endpoint{}, errTestNotFound
+	}
+	return e.r.agent, nil
+}
+
+type approvalTestApprovals struct {
+	BaselineApprovalRepository
+	r *approvalTestRepo
+}
+
+func (a approvalTestApprovals) Approve(_ context.Context, approval models.BaselineApproval, excluded string, quorum int) (int, error) {
+	a.r.approvals = append(a.r.approvals, approval)
+
+	approvers := 0
+	for _, ap := range a.r.approvals {
+		if ap.Approver != excluded {
+			approvers++
+		}
+	}
+
+	if approvers >= quorum {
+		a.r.agent.BaselineIsCurrent = false
+		a.r.approvals = nil
+	}
+
+	return approvers, nil
+}
+
+func (a approvalTestApprovals) GetByAgent(context.Context, uint64) ([]models.BaselineApproval, error) {
+	return a.r.approvals, nil
+}
+
+func (a approvalTestApprovals) GetAll(context.Context) ([]models.BaselineApproval, error) {
+	if len(a.r.approvals) == 0 {
+		return nil, errTestNotFound
+	}
+	return a.r.approvals, nil
+}
+
+type approvalTestAudit struct {
+	AuditRepository
+	r *approvalTestRepo
+}
+
+func (a approvalTestAudit) GetLatestByTarget(context.Context, string, []string) (models.AuditEntry, error) {
+	if a.r.lastChanger == "" {
+		return models.AuditEntry{}, errTestNotFound
+	}
+	return models.AuditEntry{Actor: a.r.lastChanger}, nil
+}
+
+type approvalTestForwarder struct {
+	Forwarder
+}
+
+func (approvalTestForwarder) ForwardAction(string, string, string) {}
+
+func approve(s *Server, approver string) error {
+	ctx := context.WithValue(context.Background(), endpointKey("endpoint"), models.Endpoint{Name: approver})
+	_, err := s.CreateBaselineUpdateApproval(ctx, &proto.EndpointName{Name: "agent1"})
+	return err
+}
+
+func TestBaselineApprovalQuorum(t *testing.T) {
+	repo := &approvalTestRepo{
+		agent:       models.Endpoint{ID: 1, Name: "agent1", Kind: "agent", HasBaseline: true, BaselineIsCurrent: true},
+		lastChanger: "admin",
+	}
+	s := &Server{repo: repo, forwarder: approvalTestForwarder{}, conf: Config{BaselineApprovalQuorum: 2, ExcludeLastChanger: true}}
+
+	if code := status.Code(approve(s, "admin")); code != codes.PermissionDenied {
+		t.Errorf("approval of the last changer returned %s, want %s", code, codes.PermissionDenied)
+	}
+
+	if err := approve(s, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if !repo.agent.BaselineIsCurrent {
+		t.Fatal("one approval reached a quorum of two")
+	}
+
+	if code := status.Code(approve(s, "alice")); code != codes.AlreadyExists {
+		t.Errorf("second approval of the same approver returned %s, want %s", code, codes.AlreadyExists)
+	}
+
+	if err := approve(s, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if repo.agent.BaselineIsCurrent {
+		t.Fatal("two approvals didn't reach a quorum of two")
+	}
+
+	if code := status.Code(approve(s, "carol")); code != codes.AlreadyExists {
+		t.Errorf("approval after the quorum returned %s, want %s", code, codes.AlreadyExists)
+	}
+}
+
+func TestBaselineApprovalQuorumExcludesLastChanger(t *testing.T) {
+	// admin approved before changing the agent. Their approval doesn't count anymore
+	repo := &approvalTestRepo{
+		agent:       models.Endpoint{ID: 1, Name: "agent1", Kind: "agent", HasBaseline: true, BaselineIsCurrent: true},
+		approvals:   []models.BaselineApproval{{AgentID: 1, Approver: "admin"}},
+		lastChanger: "admin",
+	}
+	s := &Server{repo: repo, forwarder: approvalTestForwarder{}, conf: Config{BaselineApprovalQuorum: 2, ExcludeLastChanger: true}}
+
+	if err := approve(s, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if !repo.agent.BaselineIsCurrent {
+		t.Error("approval of the last changer was counted")
+	}
+}
+
+func TestBaselineApprovalQuorumDefault(t *testing.T) {
+	for _, quorum := range []int64{-1, 0, 1} {
+		s := &Server{conf: Config{BaselineApprovalQuorum: quorum}}
+		if got := s.baselineApprovalQuorum(); got != 1 {
+			t.Errorf("quorum %d resolved to %d, want 1", quorum, got)
+		}
+	}
+}
+
+type pendingApprovalTestStream struct {
+	proto.Fim_GetPendingBaselineApprovalsServer
+	sent []*proto.PendingBaselineApproval
+}
+
+func (p *pendingApprovalTestStream) Context() context.Context { return context.Background() }
+
+func (p *pendingApprovalTestStream) Send(approval *proto.PendingBaselineApproval) error {
+	p.sent = append(p.sent, approval)
+	return nil
+}
+
+func TestGetPendingBaselineApprovals(t *testing.T) {
+	repo := &approvalTestRepo{
+		agent: models.Endpoint{ID: 1, Name: "agent1", Kind: "agent"},
+		approvals: []models.BaselineApproval{
+			{AgentID: 1, Approver: "alice", CreatedAt: 10},
+			{AgentID: 1, Approver: "bob", CreatedAt: 20},
+		},
+	}
+	s := &Server{repo: repo, conf: Config{BaselineApprovalQuorum: 3}}
+
+	stream := &pendingApprovalTestStream{}
+	err := s.GetPendingBaselineApprovals(&proto.Empty{}, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stream.sent) != 1 {
+		t.Fatalf("sent %d pending approvals, want 1", len(stream.sent))
+	}
+	got := stream.sent[0]
+	if got.AgentName != "agent1" || got.RequiredApprovals != 3 || got.RequestedAt != 10 || !reflect.DeepEqual(got.Approvers, []string{"alice", "bob"}) {
+		t.Errorf("pending approval = %+v", got)
+	}
+}
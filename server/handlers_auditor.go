@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"strconv"
+
+	"github.com/Leantar/fimproto/proto"
+	"github.com/Leantar/fimserver/models"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+// QueryAuditLog returns the newest audit entries matching the query first
+func (s *Server) QueryAuditLog(ctx context.Context, query *proto.AuditQuery) (*proto.AuditPage, error) {
+	pageSize, err := resolvePageSize(query.PageSize, defaultAuditPageSize, maxAuditPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var beforeID uint64
+	if query.PageToken != "" {
+		id, err := decodeAuditPageToken(query.PageToken)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid page token")
+		}
+		beforeID = id
+	}
+
+	filter := models.AuditFilter{
+		Actor:  query.Actor,
+		Action: query.Action,
+		Target: query.Target,
+		Result: query.Result,
+		From:   query.From,
+		Until:  query.Until,
+	}
+
+	// One more entry is requested to find out whether there is a next page
+	entries, err := s.repo.Audit().GetPage(ctx, filter, beforeID, pageSize+1)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to get audit entries")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	page := &proto.AuditPage{Entries: make([]*proto.AuditEntry, 0, len(entries))}
+
+	if len(entries) > pageSize {
+		entries = entries[:pageSize]
+		page.NextPageToken = encodeAuditPageToken(entries[len(entries)-1].ID)
+	}
+
+	for _, e := range entries {
+		page.Entries = append(page.Entries, &proto.AuditEntry{
+			Actor:         e.Actor,
+			Action:        e.Action,
+			Target:        e.Target,
+			Parameters:    e.Parameters,
+			Result:        e.Result,
+			RemoteAddress: e.RemoteAddress,
+			CreatedAt:     e.CreatedAt,
+		})
+	}
+
+	return page, nil
+}
+
+func encodeAuditPageToken(id uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(id, 10)))
+}
+
+func decodeAuditPageToken(token string) (uint64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(string(raw), 10, 64)
+}
+
+// VerifyChain reports every break in the chain of alerts and audit entries
+func (s *Server) VerifyChain(ctx context.Context, _ *proto.Empty) (*proto.ChainReport, error) {
+	report, err := CheckChain(ctx, s.repo, s.conf)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to verify chain")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	resp := &proto.ChainReport{
+		Links:               report.Links,
+		Checkpoints:         report.Checkpoints,
+		UncheckpointedLinks: report.UncheckpointedLinks,
+		Breaks:              make([]*proto.ChainBreak, 0, len(report.Breaks)),
+	}
+	for _, b := range report.Breaks {
+		resp.Breaks = append(resp.Breaks, &proto.ChainBreak{LinkId: b.LinkID, Source: b.Source, RowId: b.RowID, Reason: b.Reason})
+	}
+
+	return resp, nil
+}
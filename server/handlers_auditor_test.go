@@ -0,0 +1,29 @@
+package server
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestAuditPageToken(t *testing.T) {
+	for _, id := range []uint64{0, 1, 18446744073709551615} {
+		got, err := decodeAuditPageToken(encodeAuditPageToken(id))
+		if err != nil {
+			t.Errorf("decodeAuditPageToken(encodeAuditPageToken(%d)) failed: %v", id, err)
+			continue
+		}
+		if got != id {
+			t.Errorf("decodeAuditPageToken(encodeAuditPageToken(%d)) = %d", id, got)
+		}
+	}
+
+	for _, token := range []string{
+		"not base64!",
+		base64.RawURLEncoding.EncodeToString([]byte("-1")),
+		base64.RawURLEncoding.EncodeToString([]byte("1650000000.42")),
+	} {
+		if _, err := decodeAuditPageToken(token); err == nil {
+			t.Errorf("decodeAuditPageToken(%q) didn't fail", token)
+		}
+	}
+}
@@ -1,31 +1,58 @@
 package server
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/Leantar/fimproto/proto"
+	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/risk"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+const (
+	subscriptionBatchSize    = 500
+	subscriptionPollInterval = 30 * time.Second
+	defaultAlertPageSize     = 100
+	maxAlertPageSize         = 1000
+)
+
 func (s *Server) GetAgents(_ *proto.Empty, stream proto.Fim_GetAgentsServer) error {
-	agents, err := s.repo.Endpoints().GetAgents(stream.Context())
+	agents, err := s.getRatedAgents(stream.Context())
 	if err != nil {
-		if s.repo.IsEmptyResultSetError(err) {
-			return status.Error(codes.NotFound, "no agents were found")
-		}
-		log.Error().Caller().Err(err).Msg("failed to get agents")
-		return status.Error(codes.Internal, "internal error")
+		return err
 	}
 
-	for _, a := range agents {
-		agent := proto.Agent{
-			Name:              a.Name,
-			HasBaseline:       a.HasBaseline,
-			BaselineIsCurrent: a.BaselineIsCurrent,
-			WatchedPaths:      a.WatchedPaths,
+	for _, agent := range agents {
+		err := stream.Send(agent)
+		if err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
+
+func (s *Server) GetAgentsByRisk(_ *proto.Empty, stream proto.Fim_GetAgentsByRiskServer) error {
+	agents, err := s.getRatedAgents(stream.Context())
+	if err != nil {
+		return err
+	}
 
-		err := stream.Send(&agent)
+	sort.SliceStable(agents, func(i, j int) bool {
+		return agents[i].RiskScore > agents[j].RiskScore
+	})
+
+	for _, agent := range agents {
+		err := stream.Send(agent)
 		if err != nil {
 			return err
 		}
@@ -54,14 +81,36 @@ func (s *Server) GetAlertsByAgent(endpointName *proto.EndpointName, stream proto
 	}
 
 	for _, a := range alerts {
-		alert := proto.Alert{
-			Kind:       a.Kind,
-			Difference: a.Difference,
-			Path:       a.Path,
-			IssuedAt:   a.IssuedAt,
+		err := stream.Send(toProtoAlert(a, agent.Name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) GetHostFactsHistory(endpointName *proto.EndpointName, stream proto.Fim_GetHostFactsHistoryServer) error {
+	agent, err := s.repo.Endpoints().GetByName(stream.Context(), endpointName.Name)
+	if err != nil {
+		if s.repo.IsEmptyResultSetError(err) {
+			return status.Error(codes.NotFound, "no agent was found")
+		}
+		log.Error().Caller().Err(err).Msg("failed to get agent")
+		return status.Error(codes.Internal, "internal error")
+	}
+
+	history, err := s.repo.HostFacts().GetHistoryByAgent(stream.Context(), agent.ID)
+	if err != nil {
+		if s.repo.IsEmptyResultSetError(err) {
+			return status.Error(codes.NotFound, "no host facts were found")
 		}
+		log.Error().Caller().Err(err).Msg("failed to get host facts")
+		return status.Error(codes.Internal, "internal error")
+	}
 
-		err := stream.Send(&alert)
+	for _, facts := range history {
+		err := stream.Send(toProtoHostFacts(facts))
 		if err != nil {
 			return err
 		}
@@ -69,3 +118,289 @@ func (s *Server) GetAlertsByAgent(endpointName *proto.EndpointName, stream proto
 
 	return nil
 }
+
+func (s *Server) SubscribeAlerts(sub *proto.AlertSubscription, stream proto.Fim_SubscribeAlertsServer) error {
+	ctx := stream.Context()
+
+	filter := models.AlertFilter{
+		Kinds:      sub.Kinds,
+		Severities: sub.Severities,
+		AfterID:    sub.LastSeenId,
+	}
+
+	agentIDs, agentNames, err := s.getAgentIDs(ctx, sub.AgentNames)
+	if err != nil {
+		return err
+	}
+	filter.AgentIDs = agentIDs
+
+	// Without a last seen alert only alerts that are created from now on are sent
+	if filter.AfterID == 0 {
+		latest, err := s.repo.Alerts().GetLatestID(ctx)
+		if err != nil {
+			log.Error().Caller().Err(err).Msg("failed to get latest alert id")
+			return status.Error(codes.Internal, "internal error")
+		}
+		filter.AfterID = latest
+	}
+
+	signal := s.alerts.subscribe()
+	defer s.alerts.unsubscribe(signal)
+
+	// Notifications are only a hint, so pending alerts are also checked periodically
+	ticker := time.NewTicker(subscriptionPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			alerts, err := s.repo.Alerts().GetByFilter(ctx, filter, subscriptionBatchSize)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				log.Error().Caller().Err(err).Msg("failed to get alerts")
+				return status.Error(codes.Internal, "internal error")
+			}
+
+			for _, a := range alerts {
+				name, err := s.getAgentName(ctx, agentNames, a.AgentID)
+				if err != nil {
+					return err
+				}
+
+				err = stream.Send(toProtoAlert(a, name))
+				if err != nil {
+					return err
+				}
+
+				filter.AfterID = a.ID
+			}
+
+			if len(alerts) < subscriptionBatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-signal:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) QueryAlerts(ctx context.Context, query *proto.AlertQuery) (*proto.AlertPage, error) {
+	pageSize, err := resolvePageSize(query.PageSize, defaultAlertPageSize, maxAlertPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor *models.AlertCursor
+	if query.PageToken != "" {
+		c, err := decodePageToken(query.PageToken)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid page token")
+		}
+		cursor = &c
+	}
+
+	agentIDs, agentNames, err := s.getAgentIDs(ctx, query.AgentNames)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := models.AlertFilter{
+		AgentIDs:    agentIDs,
+		Kinds:       query.Kinds,
+		Severities:  query.Severities,
+		PathPrefix:  query.PathPrefix,
+		PathGlob:    query.PathGlob,
+		IssuedFrom:  query.IssuedFrom,
+		IssuedUntil: query.IssuedUntil,
+	}
+
+	// One more alert is requested to find out whether there is a next page
+	alerts, err := s.repo.Alerts().GetPage(ctx, filter, cursor, query.Descending, pageSize+1)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to get alerts")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	page := &proto.AlertPage{Alerts: make([]*proto.Alert, 0, len(alerts))}
+
+	if len(alerts) > pageSize {
+		alerts = alerts[:pageSize]
+		last := alerts[len(alerts)-1]
+		page.NextPageToken = encodePageToken(models.AlertCursor{IssuedAt: last.IssuedAt, ID: last.ID})
+	}
+
+	for _, a := range alerts {
+		name, err := s.getAgentName(ctx, agentNames, a.AgentID)
+		if err != nil {
+			return nil, err
+		}
+
+		page.Alerts = append(page.Alerts, toProtoAlert(a, name))
+	}
+
+	return page, nil
+}
+
+// getAgentIDs looks up the named agents. The returned map of IDs to names is meant to be extended by getAgentName.
+func (s *Server) getAgentIDs(ctx context.Context, names []string) ([]uint64, map[uint64]string, error) {
+	ids := make([]uint64, 0, len(names))
+	agentNames := make(map[uint64]string)
+
+	for _, name := range names {
+		agent, err := s.repo.Endpoints().GetByName(ctx, name)
+		if err != nil {
+			if s.repo.IsEmptyResultSetError(err) {
+				return nil, nil, status.Errorf(codes.NotFound, "agent '%s' was not found", name)
+			}
+			log.Error().Caller().Err(err).Msg("failed to get agent")
+			return nil, nil, status.Error(codes.Internal, "internal error")
+		}
+
+		ids = append(ids, agent.ID)
+		agentNames[agent.ID] = agent.Name
+	}
+
+	return ids, agentNames, nil
+}
+
+// getAgentName returns the name of the agent with the given ID and caches it in agentNames
+func (s *Server) getAgentName(ctx context.Context, agentNames map[uint64]string, id uint64) (string, error) {
+	name, ok := agentNames[id]
+	if ok {
+		return name, nil
+	}
+
+	agent, err := s.repo.Endpoints().GetByID(ctx, id)
+	if err != nil && !s.repo.IsEmptyResultSetError(err) {
+		log.Error().Caller().Err(err).Msg("failed to get agent")
+		return "", status.Error(codes.Internal, "internal error")
+	}
+
+	agentNames[id] = agent.Name
+
+	return agent.Name, nil
+}
+
+func toProtoAlert(a models.Alert, agentName string) *proto.Alert {
+	return &proto.Alert{
+		Kind:       a.Kind,
+		Difference: a.Difference,
+		Path:       a.Path,
+		IssuedAt:   a.IssuedAt,
+		Id:         a.ID,
+		Severity:   a.Severity,
+		AgentName:  agentName,
+	}
+}
+
+func toProtoHostFacts(f models.HostFacts) *proto.HostFacts {
+	return &proto.HostFacts{
+		Hostname:     f.Hostname,
+		OsRelease:    f.OsRelease,
+		Kernel:       f.Kernel,
+		AgentVersion: f.AgentVersion,
+		IpAddresses:  f.IPAddresses,
+		ReportedAt:   f.ReportedAt,
+	}
+}
+
+// resolvePageSize returns the default for an unset page size and rejects sizes above the maximum instead of silently
+// returning fewer entries than requested
+func resolvePageSize(requested uint32, defaultSize, maxSize int) (int, error) {
+	if requested == 0 {
+		return defaultSize, nil
+	}
+	if requested > uint32(maxSize) {
+		return 0, status.Errorf(codes.InvalidArgument, "page_size must not exceed %d", maxSize)
+	}
+
+	return int(requested), nil
+}
+
+// Page tokens are opaque to clients. They encode the cursor as "issued_at.id"
+func encodePageToken(c models.AlertCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", c.IssuedAt, c.ID)))
+}
+
+func decodePageToken(token string) (models.AlertCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return models.AlertCursor{}, err
+	}
+
+	parts := strings.SplitN(string(raw), ".", 2)
+	if len(parts) != 2 {
+		return models.AlertCursor{}, errors.New("malformed page token")
+	}
+
+	issuedAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return models.AlertCursor{}, err
+	}
+
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return models.AlertCursor{}, err
+	}
+
+	return models.AlertCursor{IssuedAt: issuedAt, ID: id}, nil
+}
+
+// getRatedAgents returns all agents together with their risk score
+func (s *Server) getRatedAgents(ctx context.Context) ([]*proto.Agent, error) {
+	agents, err := s.repo.Endpoints().GetAgents(ctx)
+	if err != nil {
+		if s.repo.IsEmptyResultSetError(err) {
+			return nil, status.Error(codes.NotFound, "no agents were found")
+		}
+		log.Error().Caller().Err(err).Msg("failed to get agents")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	counts, err := s.repo.Alerts().CountOpenBySeverity(ctx)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to count alerts")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	facts, err := s.repo.HostFacts().GetLatest(ctx)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to get host facts")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	pending, err := s.repo.BaselineApprovals().GetPendingAgentIDs(ctx)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to get baseline approvals")
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	now := time.Now().Unix()
+	rated := make([]*proto.Agent, len(agents))
+
+	for i, a := range agents {
+		rated[i] = &proto.Agent{
+			Name:              a.Name,
+			HasBaseline:       a.HasBaseline,
+			BaselineIsCurrent: a.BaselineIsCurrent,
+			WatchedPaths:      a.WatchedPaths,
+			LastScan:          a.LastScan,
+			LastSeen:          a.LastSeen,
+			RemoteAddress:     a.RemoteAddress,
+			Disabled:          a.Disabled,
+			RiskScore:         risk.Score(a, counts[a.ID], pending[a.ID], now),
+		}
+
+		if f, ok := facts[a.ID]; ok {
+			rated[i].HostFacts = toProtoHostFacts(f)
+		}
+	}
+
+	return rated, nil
+}
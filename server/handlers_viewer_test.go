@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/Leantar/fimserver/models"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPageToken(t *testing.T) {
+	for _, c := range []models.AlertCursor{
+		{IssuedAt: 0, ID: 0},
+		{IssuedAt: 1650000000, ID: 42},
+		{IssuedAt: -1, ID: 18446744073709551615},
+	} {
+		got, err := decodePageToken(encodePageToken(c))
+		if err != nil {
+			t.Errorf("decodePageToken(encodePageToken(%+v)) failed: %v", c, err)
+			continue
+		}
+		if got != c {
+			t.Errorf("decodePageToken(encodePageToken(%+v)) = %+v", c, got)
+		}
+	}
+}
+
+func TestDecodePageTokenRejectsMalformedTokens(t *testing.T) {
+	encode := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+
+	for _, token := range []string{
+		"not base64!",
+		encode("42"),
+		encode("a.42"),
+		encode("1650000000.b"),
+		encode("1650000000.-1"),
+		encode("1650000000.42.7"),
+	} {
+		if _, err := decodePageToken(token); err == nil {
+			t.Errorf("decodePageToken(%q) didn't fail", token)
+		}
+	}
+}
+
+func TestResolvePageSize(t *testing.T) {
+	tests := []struct {
+		requested uint32
+		want      int
+		code      codes.Code
+	}{
+		{requested: 0, want: 100, code: codes.OK},
+		{requested: 1, want: 1, code: codes.OK},
+		{requested: 1000, want: 1000, code: codes.OK},
+		{requested: 1001, code: codes.InvalidArgument},
+		{requested: 4294967295, code: codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		got, err := resolvePageSize(tt.requested, 100, 1000)
+		if status.Code(err) != tt.code {
+			t.Errorf("resolvePageSize(%d) error = %v, want code %s", tt.requested, err, tt.code)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("resolvePageSize(%d) = %d, want %d", tt.requested, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Leantar/fimserver/models"
+	"github.com/Leantar/fimserver/modules/alert"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Calls within this interval from the same address only update last_seen once
+	lastSeenInterval    = 10 * time.Second
+	silentCheckInterval = 30 * time.Second
+)
+
+// updateLastSeen records an authenticated call of an agent. If the update fails, the returned endpoint keeps its old
+// last_seen, so the agent's next call tries again instead of waiting for lastSeenInterval.
+func (s *Server) updateLastSeen(ctx context.Context, agent models.Endpoint, remoteAddr string) models.Endpoint {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err == nil {
+		remoteAddr = host
+	}
+
+	now := time.Now().Unix()
+	if !agent.IsSilent && agent.RemoteAddress == remoteAddr && now-agent.LastSeen < int64(lastSeenInterval.Seconds()) {
+		return agent
+	}
+
+	err = s.repo.Endpoints().UpdateLastSeen(ctx, agent.ID, now, remoteAddr)
+	if err != nil {
+		log.Error().Caller().Err(err).Msg("failed to update last seen")
+		return agent
+	}
+
+	if agent.IsSilent {
+		log.Info().Msgf("silent agent '%s' is back from '%s'", agent.Name, remoteAddr)
+	}
+
+	agent.LastSeen = now
+	agent.RemoteAddress = remoteAddr
+	agent.IsSilent = false
+
+	return agent
+}
+
+// monitorSilentAgents raises an alert for every agent that hasn't called the server within the configured threshold
+func (s *Server) monitorSilentAgents(ctx context.Context) {
+	ticker := time.NewTicker(silentCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now().Unix()
+
+		agents, err := s.repo.Endpoints().MarkSilent(ctx, now-s.conf.SilentAgentAfter)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error().Caller().Err(err).Msg("failed to mark silent agents")
+			}
+			continue
+		}
+
+		for _, agent := range agents {
+			log.Warn().Msgf("agent '%s' went silent", agent.Name)
+
+			al := models.Alert{
+				Kind:       alert.KindSilent,
+				Severity:   alert.SeverityOf(alert.KindSilent),
+				Difference: fmt.Sprintf("last seen: %d from %s", agent.LastSeen, agent.RemoteAddress),
+				IssuedAt:   now,
+				Modified:   agent.LastSeen,
+				AgentID:    agent.ID,
+			}
+
+			err = s.createAlert(ctx, al, agent)
+			if err != nil {
+				log.Error().Caller().Err(err).Msg("failed to create alert")
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/url"
+	"time"
+)
+
+// Tolerates clocks of agents that are slightly behind
+const issuedCertBackdate = 5 * time.Minute
+
+// issuer signs with the key of the CA. It's only loaded if ca_key_file is configured.
+type issuer struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// loadIssuer loads the first certificate of caPath and its key
+func loadIssuer(caPath, keyPath string) (*issuer, error) {
+	pair, err := tls.LoadX509KeyPair(caPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported ca key type")
+	}
+
+	return &issuer{cert: cert, key: key}, nil
+}
+
+// issueClientCertificate signs a client certificate for the endpoint name and its URI identity, if it has one.
+// The certificate never outlives the CA.
+func (i *issuer) issueClientCertificate(name, uriIdentity string, pub crypto.PublicKey, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+	// Serials must be positive
+	serial.Add(serial, big.NewInt(1))
+
+	now := time.Now()
+	notAfter := now.Add(validity)
+	if notAfter.After(i.cert.NotAfter) {
+		notAfter = i.cert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-issuedCertBackdate),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	if uriIdentity != "" {
+		uri, err := url.Parse(uriIdentity)
+		if err != nil {
+			return nil, err
+		}
+		template.URIs = []*url.URL{uri}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, i.cert, pub, i.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+func (s *Server) issuesCertificates() bool {
+	return s.conf.CaKeyFile != ""
+}
+
+func (s *Server) currentIssuer() *issuer {
+	s.issuerMu.RLock()
+	defer s.issuerMu.RUnlock()
+
+	return s.issuer
+}
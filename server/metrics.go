@@ -0,0 +1,29 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Leantar/fimserver/modules/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+func (s *Server) UnaryMetricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	resp, err = handler(ctx, req)
+	countRPC(info.FullMethod, err)
+
+	return resp, err
+}
+
+func (s *Server) StreamMetricsInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := handler(srv, stream)
+	countRPC(info.FullMethod, err)
+
+	return err
+}
+
+func countRPC(fullMethod string, err error) {
+	method := strings.TrimPrefix(fullMethod, "/fim.Fim/")
+	metrics.RPCs.WithLabelValues(method, status.Code(err).String()).Inc()
+}
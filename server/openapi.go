@@ -0,0 +1,212 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// openAPIDocument describes the REST gateway. It is generated from the route table, so it can't drift from the served routes.
+func openAPIDocument() map[string]interface{} {
+	paths := make(map[string]map[string]interface{})
+	schemas := make(map[string]interface{})
+
+	for _, rt := range routes {
+		op := map[string]interface{}{
+			"operationId": rt.rpc,
+			"summary":     rt.summary,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "OK",
+					"content":     responseContent(rt, schemas),
+				},
+				"default": map[string]interface{}{
+					"description": "Error",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"},
+						},
+					},
+				},
+			},
+		}
+
+		var params []interface{}
+		for _, seg := range strings.Split(rt.pattern, "/") {
+			if strings.HasPrefix(seg, "{") {
+				params = append(params, map[string]interface{}{
+					"name":     strings.Trim(seg, "{}"),
+					"in":       "path",
+					"required": true,
+					"schema":   map[string]interface{}{"type": "string"},
+				})
+			}
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+
+		if rt.request != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": schemaRef(reflect.TypeOf(rt.request), schemas),
+					},
+				},
+			}
+		}
+
+		if paths[rt.pattern] == nil {
+			paths[rt.pattern] = make(map[string]interface{})
+		}
+		paths[rt.pattern][strings.ToLower(rt.method)] = op
+	}
+
+	paths["/v1/openapi.json"] = map[string]interface{}{
+		strings.ToLower(http.MethodGet): map[string]interface{}{
+			"operationId": "GetOpenAPIDocument",
+			"summary":     "This document",
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{"description": "OK"},
+			},
+		},
+	}
+
+	paths["/v1/session"] = map[string]interface{}{
+		strings.ToLower(http.MethodGet): map[string]interface{}{
+			"operationId": "GetSession",
+			"summary":     "The authenticated endpoint and the RPCs it may call",
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "OK",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": schemaRef(reflect.TypeOf(session{}), schemas),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	schemas["Error"] = map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"error": map[string]interface{}{"type": "string"},
+		},
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "fimserver",
+			"version": "v1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"mutualTLS": map[string]interface{}{"type": "mutualTLS"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"mutualTLS": []interface{}{}}},
+	}
+}
+
+func responseContent(rt route, schemas map[string]interface{}) map[string]interface{} {
+	if rt.response == nil {
+		return map[string]interface{}{}
+	}
+
+	schema := schemaRef(reflect.TypeOf(rt.response), schemas)
+	mediaType := "application/json"
+
+	if rt.list {
+		schema = map[string]interface{}{"type": "array", "items": schema}
+	} else if rt.stream {
+		mediaType = "application/x-ndjson"
+	}
+
+	return map[string]interface{}{
+		mediaType: map[string]interface{}{"schema": schema},
+	}
+}
+
+// schemaRef returns a JSON schema for t. Structs are added to schemas and referenced by name.
+func schemaRef(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint, reflect.Uint64:
+		// protojson encodes 64 bit integers as strings, because JavaScript numbers can't hold all of them
+		return map[string]interface{}{"type": "string", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaRef(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaRef(t.Elem(), schemas)}
+	case reflect.Struct:
+		if _, ok := schemas[t.Name()]; !ok {
+			// Register the name first to terminate recursive types
+			schemas[t.Name()] = nil
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	props := make(map[string]interface{})
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+
+		if f.Anonymous {
+			// Embedded structs are flattened by encoding/json
+			t := f.Type
+			for t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+			if t.Kind() == reflect.Struct {
+				for name, prop := range structSchema(t, schemas)["properties"].(map[string]interface{}) {
+					props[name] = prop
+				}
+				continue
+			}
+		}
+
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			tagName := strings.Split(tag, ",")[0]
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+
+		props[name] = schemaRef(f.Type, schemas)
+	}
+
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+	}
+}
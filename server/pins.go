@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+
+	"github.com/Leantar/fimserver/models"
+)
+
+// certFingerprintPin is the pin of this exact certificate
+func certFingerprintPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// publicKeyPin stays the same for certificates renewed with the same key
+func publicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// matchesPins reports whether the certificate or its public key is pinned for the endpoint
+func matchesPins(endpoint models.Endpoint, cert *x509.Certificate) bool {
+	fingerprint := certFingerprintPin(cert)
+	key := publicKeyPin(cert)
+
+	for _, pin := range endpoint.CertPins {
+		if pin == fingerprint || pin == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// endpointForCertificate identifies the endpoint by the SAN URIs of the certificate, or by its CommonName if it has none.
+// Endpoints with a URI identity can't be reached through the CommonName.
+func (s *Server) endpointForCertificate(ctx context.Context, cert *x509.Certificate) (models.Endpoint, error) {
+	if len(cert.URIs) != 0 {
+		for _, uri := range cert.URIs {
+			endpoint, err := s.repo.Endpoints().GetByURIIdentity(ctx, uri.String())
+			if err == nil {
+				return endpoint, nil
+			}
+			if !s.repo.IsEmptyResultSetError(err) {
+				return models.Endpoint{}, err
+			}
+		}
+
+		return models.Endpoint{}, errors.New("no endpoint for the uri identities of the certificate")
+	}
+
+	endpoint, err := s.repo.Endpoints().GetByName(ctx, cert.Subject.CommonName)
+	if err != nil {
+		return models.Endpoint{}, err
+	}
+
+	if endpoint.URIIdentity != "" {
+		return models.Endpoint{}, errors.New("endpoint must authenticate with its uri identity")
+	}
+
+	return endpoint, nil
+}
+
+// checkPins rejects certificates that don't match the pins of the endpoint
+func (s *Server) checkPins(endpoint models.Endpoint, cert *x509.Certificate) error {
+	if len(endpoint.CertPins) == 0 {
+		if s.conf.RequireCertPins {
+			s.forwarder.ForwardRejection(endpoint.Name, "endpoint has no certificate pins")
+			return errors.New("endpoint has no certificate pins")
+		}
+		return nil
+	}
+
+	if !matchesPins(endpoint, cert) {
+		s.forwarder.ForwardRejection(endpoint.Name, "certificate doesn't match the pins")
+		return errors.New("certificate doesn't match the pins")
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Leantar/fimserver/models"
+)
+
+// newPinTestCertificate issues a certificate with a new key for name and the uris, signed by iss
+func newPinTestCertificate(t *testing.T, iss *issuer, name string, uris ...string) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = append(template.URIs, u)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, iss.cert, &newTestKey(t).PublicKey, iss.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestMatchesPins(t *testing.T) {
+	iss, _, _ := newTestCA(t, t.TempDir(), "ca")
+	cert := newPinTestCertificate(t, iss, "agent1")
+	other := newPinTestCertificate(t, iss, "agent1")
+
+	tests := []struct {
+		name string
+		pins []string
+		want bool
+	}{
+		{name: "fingerprint", pins: []string{certFingerprintPin(cert)}, want: true},
+		{name: "public key", pins: []string{publicKeyPin(cert)}, want: true},
+		{name: "one of several", pins: []string{publicKeyPin(other), certFingerprintPin(cert)}, want: true},
+		{name: "other certificate", pins: []string{certFingerprintPin(other), publicKeyPin(other)}},
+		{name: "no pins"},
+	}
+
+	for _, tt := range tests {
+		if got := matchesPins(models.Endpoint{CertPins: tt.pins}, cert); got != tt.want {
+			t.Errorf("%s: matchesPins() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPins(t *testing.T) {
+	iss, _, _ := newTestCA(t, t.TempDir(), "ca")
+	cert := newPinTestCertificate(t, iss, "agent1")
+
+	forwarder := &authTestForwarder{}
+	s := &Server{forwarder: forwarder}
+
+	if err := s.checkPins(models.Endpoint{Name: "agent1"}, cert); err != nil {
+		t.Errorf("endpoint without pins was rejected: %v", err)
+	}
+	if err := s.checkPins(models.Endpoint{Name: "agent1", CertPins: []string{publicKeyPin(cert)}}, cert); err != nil {
+		t.Errorf("pinned certificate was rejected: %v", err)
+	}
+	if err := s.checkPins(models.Endpoint{Name: "agent1", CertPins: []string{certFingerprintPin(iss.cert)}}, cert); err == nil {
+		t.Error("certificate that doesn't match the pins was accepted")
+	}
+
+	s.conf.RequireCertPins = true
+	if err := s.checkPins(models.Endpoint{Name: "agent1"}, cert); err == nil {
+		t.Error("endpoint without pins was accepted although pins are required")
+	}
+
+	want := []string{"agent1: certificate doesn't match the pins", "agent1: endpoint has no certificate pins"}
+	if len(forwarder.rejections) != len(want) || forwarder.rejections[0] != want[0] || forwarder.rejections[1] != want[1] {
+		t.Errorf("forwarded rejections = %v, want %v", forwarder.rejections, want)
+	}
+}
+
+func TestEndpointForCertificate(t *testing.T) {
+	iss, _, _ := newTestCA(t, t.TempDir(), "ca")
+
+	repo := &enrollTestRepo{endpoints: []models.Endpoint{
+		{ID: 1, Name: "web01"},
+		{ID: 2, Name: "db01", URIIdentity: "spiffe://example.org/agent/db01"},
+	}}
+	s := &Server{repo: repo}
+
+	tests := []struct {
+		name   string
+		cert   *x509.Certificate
+		wantID uint64
+	}{
+		{name: "common name", cert: newPinTestCertificate(t, iss, "web01"), wantID: 1},
+		{name: "uri identity", cert: newPinTestCertificate(t, iss, "web01", "spiffe://example.org/agent/db01"), wantID: 2},
+		{
+			name:   "second uri",
+			cert:   newPinTestCertificate(t, iss, "", "spiffe://example.org/agent/unknown", "spiffe://example.org/agent/db01"),
+			wantID: 2,
+		},
+		// Endpoints with a uri identity can't be reached through their name
+		{name: "name of uri endpoint", cert: newPinTestCertificate(t, iss, "db01")},
+		// A certificate with uris is never matched by its name
+		{name: "unknown uri", cert: newPinTestCertificate(t, iss, "web01", "spiffe://example.org/agent/web01")},
+		{name: "unknown name", cert: newPinTestCertificate(t, iss, "mail01")},
+	}
+
+	for _, tt := range tests {
+		endpoint, err := s.endpointForCertificate(context.Background(), tt.cert)
+		if tt.wantID == 0 {
+			if err == nil {
+				t.Errorf("%s: certificate identified '%s'", tt.name, endpoint.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: endpointForCertificate() returned %v", tt.name, err)
+		} else if endpoint.ID != tt.wantID {
+			t.Errorf("%s: certificate identified endpoint %d, want %d", tt.name, endpoint.ID, tt.wantID)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"github.com/Leantar/fimserver/models"
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/util"
+)
+
+// The RPCs that manage the policy
+var policyRPCs = []string{"GetPolicyRules", "AddPolicyRule", "RemovePolicyRule"}
+
+// lostPolicyRPCs returns the policyRPCs that the endpoint may call now but not after removing the rule. The removal is
+// evaluated on a copy of the policy, so the policy in effect is never changed by the check.
+func (s *Server) lostPolicyRPCs(endpoint models.Endpoint, rule []string) ([]string, error) {
+	m, err := model.NewModelFromString(policyModel)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range s.enforcer.GetPolicy() {
+		if !util.ArrayEquals(r, rule) {
+			m.AddPolicy("p", "p", r)
+		}
+	}
+
+	e, err := casbin.NewEnforcer(m)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := newCheckableEndpoint(endpoint)
+	lost := make([]string, 0)
+	for _, rpc := range policyRPCs {
+		allowed, err := s.enforcer.Enforce(sub, rpc)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			continue
+		}
+
+		allowed, err = e.Enforce(sub, rpc)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			lost = append(lost, rpc)
+		}
+	}
+
+	return lost, nil
+}
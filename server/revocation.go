@@ -0,0 +1,325 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Leantar/fimserver/modules/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultCrlRefreshInterval = 300 * time.Second
+	// The published CRL is renewed on every refresh, so it only runs out if the server stops
+	crlValidity = 7 * 24 * time.Hour
+)
+
+// revocationList holds the serials of all revoked client certificates, both from the CRL files and from the database
+type revocationList struct {
+	mu     sync.RWMutex
+	crls   map[string]map[string]bool
+	stored map[string]bool
+	// Serializes writes of the published CRL
+	publish sync.Mutex
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		crls:   make(map[string]map[string]bool),
+		stored: make(map[string]bool),
+	}
+}
+
+func (r *revocationList) isRevoked(serial *big.Int) bool {
+	key := serialKey(serial)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.stored[key] {
+		return true
+	}
+	for _, serials := range r.crls {
+		if serials[key] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setCRL replaces the serials previously loaded from the CRL at path
+func (r *revocationList) setCRL(path string, serials map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.crls[path] = serials
+}
+
+// addStored adds revocations from the database. They are never lifted, so serials are only added.
+func (r *revocationList) addStored(serials ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, serial := range serials {
+		r.stored[serial] = true
+	}
+}
+
+func serialKey(serial *big.Int) string {
+	return serial.Text(16)
+}
+
+// parseSerial accepts hex serials the way openssl prints them, optionally separated by colons
+func parseSerial(s string) (*big.Int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.ReplaceAll(strings.TrimPrefix(s, "0x"), ":", "")
+
+	serial, ok := new(big.Int).SetString(s, 16)
+	if !ok || serial.Sign() <= 0 {
+		return nil, errors.New("serial must be a positive hex number")
+	}
+
+	return serial, nil
+}
+
+// verifyPeerCertificate runs after the client certificate was verified against ca_file
+func (s *Server) verifyPeerCertificate(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	// Only happens when enrollment is enabled and the client didn't present a certificate. Authentication rejects those calls.
+	if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+		return nil
+	}
+
+	err := s.checkRevocation(verifiedChains[0][0])
+	if err != nil {
+		metrics.AuthenticationFailures.Inc()
+		return err
+	}
+
+	return nil
+}
+
+// checkRevocation is also done for every call, because revoking a certificate doesn't close established connections
+func (s *Server) checkRevocation(cert *x509.Certificate) error {
+	if !s.revoked.isRevoked(cert.SerialNumber) {
+		return nil
+	}
+
+	log.Warn().Msgf("rejected revoked certificate '%s' of '%s'", serialKey(cert.SerialNumber), cert.Subject.CommonName)
+	s.forwarder.ForwardRejection(cert.Subject.CommonName, "certificate is revoked")
+
+	return errors.New("certificate is revoked")
+}
+
+// setupRevocations loads the CRLs and revocations before the server accepts connections. Unlike a refresh, it fails on errors.
+func (s *Server) setupRevocations(ctx context.Context) error {
+	for _, path := range s.conf.CrlFiles {
+		serials, err := loadCRL(path, s.conf.CaFile)
+		if err != nil {
+			return fmt.Errorf("crl '%s': %w", path, err)
+		}
+		s.revoked.setCRL(path, serials)
+	}
+
+	err := s.loadStoredRevocations(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !s.publishesCRL() {
+		return nil
+	}
+
+	return s.publishCRL(ctx)
+}
+
+// refreshRevocations periodically reloads the CRLs and picks up revocations made by other server instances.
+// A CRL that fails to load keeps its previous serials in effect.
+func (s *Server) refreshRevocations(ctx context.Context) {
+	interval := defaultCrlRefreshInterval
+	if s.conf.CrlRefreshInterval != 0 {
+		interval = time.Duration(s.conf.CrlRefreshInterval) * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, path := range s.conf.CrlFiles {
+			serials, err := loadCRL(path, s.conf.CaFile)
+			if err != nil {
+				log.Error().Caller().Err(err).Msgf("failed to reload crl '%s'", path)
+				continue
+			}
+			s.revoked.setCRL(path, serials)
+		}
+
+		err := s.loadStoredRevocations(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error().Caller().Err(err).Msg("failed to load revocations")
+			}
+			continue
+		}
+
+		if s.publishesCRL() {
+			err = s.publishCRL(ctx)
+			if err != nil {
+				log.Error().Caller().Err(err).Msg("failed to publish crl")
+			}
+		}
+	}
+}
+
+func (s *Server) loadStoredRevocations(ctx context.Context) error {
+	revs, err := s.repo.Revocations().GetAll(ctx)
+	if err != nil && !s.repo.IsEmptyResultSetError(err) {
+		return err
+	}
+
+	serials := make([]string, len(revs))
+	for i, rev := range revs {
+		serials[i] = rev.Serial
+	}
+	s.revoked.addStored(serials...)
+
+	return nil
+}
+
+func (s *Server) publishesCRL() bool {
+	return s.conf.CaKeyFile != "" && s.conf.CrlFile != ""
+}
+
+// publishCRL writes all revocations stored in the database to crl_file, signed by the CA
+func (s *Server) publishCRL(ctx context.Context) error {
+	s.revoked.publish.Lock()
+	defer s.revoked.publish.Unlock()
+
+	revs, err := s.repo.Revocations().GetAll(ctx)
+	if err != nil && !s.repo.IsEmptyResultSetError(err) {
+		return err
+	}
+
+	revoked := make([]pkix.RevokedCertificate, 0, len(revs))
+	for _, rev := range revs {
+		serial, err := parseSerial(rev.Serial)
+		if err != nil {
+			log.Error().Caller().Err(err).Msgf("skipping invalid serial '%s'", rev.Serial)
+			continue
+		}
+		revoked = append(revoked, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: time.Unix(rev.RevokedAt, 0),
+		})
+	}
+
+	iss := s.currentIssuer()
+	now := time.Now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificates: revoked,
+		Number:              big.NewInt(now.UnixNano()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(crlValidity),
+	}, iss.cert, iss.key)
+	if err != nil {
+		return err
+	}
+
+	// Written to a temporary file first, so that readers never see a partial CRL
+	tmp := s.conf.CrlFile + ".tmp"
+	err = ioutil.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.conf.CrlFile)
+}
+
+// loadCRL returns the revoked serials of the CRL at path, which must be signed by a certificate in caPath
+func loadCRL(path, caPath string) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	crl, err := x509.ParseCRL(data)
+	if err != nil {
+		return nil, err
+	}
+
+	cas, err := loadCertificates(caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := false
+	for _, ca := range cas {
+		if ca.CheckCRLSignature(crl) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return nil, errors.New("crl isn't signed by the ca")
+	}
+
+	if crl.HasExpired(time.Now()) {
+		// The revocations are still applied, because a stale CRL is better than none
+		log.Warn().Msgf("crl '%s' has expired", path)
+	}
+
+	serials := make(map[string]bool, len(crl.TBSCertList.RevokedCertificates))
+	for _, rc := range crl.TBSCertList.RevokedCertificates {
+		serials[serialKey(rc.SerialNumber)] = true
+	}
+
+	return serials, nil
+}
+
+func loadCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+
+	return certs, nil
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Leantar/fimserver/models"
+)
+
+// newTestCA writes a self-signed CA and its key to dir and returns them as an issuer
+func newTestCA(t *testing.T, dir, name string) (iss *issuer, certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:              []string{"localhost"},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath = filepath.Join(dir, name+".pem")
+	keyPath = filepath.Join(dir, name+".key")
+	writeTestPEM(t, certPath, "CERTIFICATE", der)
+	writeTestPEM(t, keyPath, "PRIVATE KEY", keyDer)
+
+	return &issuer{cert: cert, key: key}, certPath, keyPath
+}
+
+func writeTestPEM(t *testing.T, path, blockType string, der []byte) {
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestCRL writes a CRL of serials signed by iss to path
+func writeTestCRL(t *testing.T, path string, iss *issuer, serials ...int64) {
+	revoked := make([]pkix.RevokedCertificate, len(serials))
+	for i, serial := range serials {
+		revoked[i] = pkix.RevokedCertificate{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()}
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificates: revoked,
+		Number:              big.NewInt(1),
+		ThisUpdate:          time.Now(),
+		NextUpdate:          time.Now().Add(time.Hour),
+	}, iss.cert, iss.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestPEM(t, path, "X509 CRL", der)
+}
+
+// revocationTestRepo serves the stored revocations
+type revocationTestRepo struct {
+	Repository
+	revs []models.Revocation
+}
+
+func (r *revocationTestRepo) Revocations() RevocationRepository {
+	return revocationTestRevocations{r: r}
+}
+func (r *revocationTestRepo) IsEmptyResultSetError(err error) bool {
+	return err == errTestNotFound
+}
+
+type revocationTestRevocations struct {
+	RevocationRepository
+	r *revocationTestRepo
+}
+
+func (r revocationTestRevocations) GetAll(context.Context) ([]models.Revocation, error) {
+	if len(r.r.revs) == 0 {
+		return nil, errTestNotFound
+	}
+	return r.r.revs, nil
+}
+
+func TestParseSerial(t *testing.T) {
+	tests := map[string]int64{
+		"1f":       0x1f,
+		"0x1F":     0x1f,
+		"01:2A:ff": 0x12aff,
+		" ab\n":    0xab,
+	}
+	for in, want := range tests {
+		serial, err := parseSerial(in)
+		if err != nil {
+			t.Errorf("parseSerial(%q) returned %v", in, err)
+			continue
+		}
+		if serial.Int64() != want {
+			t.Errorf("parseSerial(%q) = %s, want %x", in, serialKey(serial), want)
+		}
+	}
+
+	for _, in := range []string{"", "0", "00:00", "-1", "xyz", "0x"} {
+		if _, err := parseSerial(in); err == nil {
+			t.Errorf("parseSerial(%q) was accepted", in)
+		}
+	}
+
+	// Stored serials are keyed without leading zeros, however they were entered
+	serial, err := parseSerial("00:0A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := serialKey(serial); key != "a" {
+		t.Errorf("serialKey() = %s, want a", key)
+	}
+}
+
+func TestRevocationList(t *testing.T) {
+	r := newRevocationList()
+	r.setCRL("a.crl", map[string]bool{"1": true})
+	r.addStored("2")
+
+	for serial, want := range map[int64]bool{1: true, 2: true, 3: false} {
+		if got := r.isRevoked(big.NewInt(serial)); got != want {
+			t.Errorf("isRevoked(%d) = %t, want %t", serial, got, want)
+		}
+	}
+
+	// A reloaded CRL replaces the serials it had before, while stored revocations stay
+	r.setCRL("a.crl", map[string]bool{})
+	r.addStored()
+	if r.isRevoked(big.NewInt(1)) {
+		t.Error("serial removed from the crl is still revoked")
+	}
+	if !r.isRevoked(big.NewInt(2)) {
+		t.Error("stored revocation was lifted")
+	}
+}
+
+func TestLoadCRL(t *testing.T) {
+	dir := t.TempDir()
+	ca, caPath, _ := newTestCA(t, dir, "ca")
+	other, _, _ := newTestCA(t, dir, "other")
+
+	crlPath := filepath.Join(dir, "ca.crl")
+	writeTestCRL(t, crlPath, ca, 10, 255)
+
+	serials, err := loadCRL(crlPath, caPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{"a": true, "ff": true}; !reflect.DeepEqual(serials, want) {
+		t.Errorf("loadCRL() = %v, want %v", serials, want)
+	}
+
+	writeTestCRL(t, crlPath, other, 10)
+	if _, err := loadCRL(crlPath, caPath); err == nil {
+		t.Error("crl of another ca was accepted")
+	}
+
+	if _, err := loadCRL(filepath.Join(dir, "missing.crl"), caPath); err == nil {
+		t.Error("missing crl was accepted")
+	}
+}
+
+func TestPublishCRL(t *testing.T) {
+	dir := t.TempDir()
+	ca, caPath, keyPath := newTestCA(t, dir, "ca")
+	crlPath := filepath.Join(dir, "published.crl")
+
+	repo := &revocationTestRepo{revs: []models.Revocation{{Serial: "1a"}, {Serial: "not hex"}, {Serial: "2b"}}}
+	s := &Server{
+		repo:    repo,
+		conf:    Config{CaFile: caPath, CaKeyFile: keyPath, CrlFile: crlPath},
+		issuer:  ca,
+		revoked: newRevocationList(),
+	}
+
+	if err := s.publishCRL(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The published CRL is signed by the CA, so other servers can load it
+	serials, err := loadCRL(crlPath, caPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{"1a": true, "2b": true}; !reflect.DeepEqual(serials, want) {
+		t.Errorf("published serials = %v, want %v", serials, want)
+	}
+
+	// Without revocations, an empty CRL is published
+	repo.revs = nil
+	if err := s.publishCRL(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	serials, err = loadCRL(crlPath, caPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serials) != 0 {
+		t.Errorf("published serials = %v, want none", serials)
+	}
+}
+
+func TestCheckRevocation(t *testing.T) {
+	forwarder := &authTestForwarder{}
+	s := &Server{forwarder: forwarder, revoked: newRevocationList()}
+	s.revoked.addStored("2a")
+
+	revoked := &x509.Certificate{SerialNumber: big.NewInt(0x2a), Subject: pkix.Name{CommonName: "agent1"}}
+	if err := s.checkRevocation(revoked); err == nil {
+		t.Error("revoked certificate was accepted")
+	}
+	if err := s.verifyPeerCertificate(nil, [][]*x509.Certificate{{revoked}}); err == nil {
+		t.Error("revoked certificate passed the handshake")
+	}
+
+	valid := &x509.Certificate{SerialNumber: big.NewInt(0x2b), Subject: pkix.Name{CommonName: "agent1"}}
+	if err := s.checkRevocation(valid); err != nil {
+		t.Errorf("valid certificate was rejected: %v", err)
+	}
+
+	if want := []string{"agent1: certificate is revoked", "agent1: certificate is revoked"}; !reflect.DeepEqual(forwarder.rejections, want) {
+		t.Errorf("forwarded rejections = %v, want %v", forwarder.rejections, want)
+	}
+}
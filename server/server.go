@@ -3,29 +3,39 @@ package server
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"errors"
 	"github.com/Leantar/fimproto/proto"
 	"github.com/Leantar/fimserver/models"
 	casbinadapter "github.com/Leantar/fimserver/modules/casbin"
+	"github.com/Leantar/fimserver/modules/notifier"
 	"github.com/casbin/casbin/v2"
 	"github.com/casbin/casbin/v2/model"
 	middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpcValidator "github.com/grpc-ecosystem/go-grpc-middleware/validator"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
-	"io/ioutil"
 	"net"
-	"path/filepath"
 	"strconv"
+	"sync"
 )
 
 type EndpointRepository interface {
 	Create(ctx context.Context, ep models.Endpoint) error
 	GetByName(ctx context.Context, name string) (models.Endpoint, error)
+	GetByID(ctx context.Context, id uint64) (models.Endpoint, error)
+	GetByURIIdentity(ctx context.Context, uri string) (models.Endpoint, error)
 	GetAgents(ctx context.Context) ([]models.Endpoint, error)
+	GetClients(ctx context.Context) ([]models.Endpoint, error)
+	CountByBaselineState(ctx context.Context) (map[string]uint64, error)
 	Update(ctx context.Context, ep models.Endpoint) error
+	UpdateWatchedPaths(ctx context.Context, id uint64, watchedPaths []string) error
+	UpdateLastScan(ctx context.Context, id uint64, lastScan int64) error
+	UpdateRoles(ctx context.Context, id uint64, roles []string) error
+	UpdateCredentials(ctx context.Context, id uint64, certPins []string, uriIdentity string) error
+	UpdateDisabled(ctx context.Context, id uint64, disabled bool) error
+	UpdateLastSeen(ctx context.Context, id uint64, lastSeen int64, remoteAddress string) error
+	MarkSilent(ctx context.Context, seenBefore int64) ([]models.Endpoint, error)
 	Delete(ctx context.Context, name string) error
 }
 
@@ -37,10 +47,56 @@ type BaselineFsObjectRepository interface {
 }
 
 type AlertRepository interface {
-	Create(ctx context.Context, alert models.Alert) error
+	Create(ctx context.Context, alert models.Alert, messages func(models.Alert) ([]notifier.Message, error)) (uint64, error)
 	GetAllByAgent(ctx context.Context, agentID uint64) ([]models.Alert, error)
+	GetByFilter(ctx context.Context, filter models.AlertFilter, limit int) ([]models.Alert, error)
+	GetPage(ctx context.Context, filter models.AlertFilter, cursor *models.AlertCursor, descending bool, limit int) ([]models.Alert, error)
+	GetLatestID(ctx context.Context) (uint64, error)
 	GetLatestByPathAndAgent(ctx context.Context, path string, agentID uint64) (models.Alert, error)
-	DeleteAll(ctx context.Context, agentID uint64) error
+	CountOpenBySeverity(ctx context.Context) (map[uint64]map[string]uint64, error)
+	GetByIDs(ctx context.Context, ids []uint64) ([]models.Alert, error)
+	DeleteAll(ctx context.Context, agentID uint64, sign func(models.ChainLink) (models.ChainCheckpoint, error)) error
+}
+
+type HostFactsRepository interface {
+	Create(ctx context.Context, facts models.HostFacts) error
+	GetLatestByAgent(ctx context.Context, agentID uint64) (models.HostFacts, error)
+	GetLatest(ctx context.Context) (map[uint64]models.HostFacts, error)
+	GetHistoryByAgent(ctx context.Context, agentID uint64) ([]models.HostFacts, error)
+}
+
+type BaselineApprovalRepository interface {
+	Approve(ctx context.Context, approval models.BaselineApproval, excluded string, quorum int) (int, error)
+	GetByAgent(ctx context.Context, agentID uint64) ([]models.BaselineApproval, error)
+	GetAll(ctx context.Context) ([]models.BaselineApproval, error)
+	GetPendingAgentIDs(ctx context.Context) (map[uint64]bool, error)
+	DeleteByAgent(ctx context.Context, agentID uint64) error
+}
+
+type AuditRepository interface {
+	Create(ctx context.Context, entry models.AuditEntry) error
+	GetPage(ctx context.Context, filter models.AuditFilter, beforeID uint64, limit int) ([]models.AuditEntry, error)
+	GetLatestByTarget(ctx context.Context, target string, actions []string) (models.AuditEntry, error)
+	GetByIDs(ctx context.Context, ids []uint64) ([]models.AuditEntry, error)
+}
+
+type ChainRepository interface {
+	GetLinks(ctx context.Context, afterID uint64, limit int) ([]models.ChainLink, error)
+	GetLatestLink(ctx context.Context) (models.ChainLink, error)
+	GetUnchained(ctx context.Context) ([]models.ChainLink, error)
+	CreateCheckpoint(ctx context.Context, cp models.ChainCheckpoint) error
+	GetCheckpoints(ctx context.Context) ([]models.ChainCheckpoint, error)
+	GetLatestCheckpoint(ctx context.Context) (models.ChainCheckpoint, error)
+}
+
+type EnrollmentTokenRepository interface {
+	Replace(ctx context.Context, token models.EnrollmentToken) error
+	Consume(ctx context.Context, tokenHash string) (models.EnrollmentToken, error)
+}
+
+type RevocationRepository interface {
+	Create(ctx context.Context, rev models.Revocation) error
+	GetAll(ctx context.Context) ([]models.Revocation, error)
 }
 
 type Repository interface {
@@ -48,7 +104,25 @@ type Repository interface {
 	Endpoints() EndpointRepository
 	BaselineFsObjects() BaselineFsObjectRepository
 	Alerts() AlertRepository
+	HostFacts() HostFactsRepository
+	BaselineApprovals() BaselineApprovalRepository
+	Audit() AuditRepository
+	Chain() ChainRepository
+	EnrollmentTokens() EnrollmentTokenRepository
+	Revocations() RevocationRepository
 	Rules() casbinadapter.RuleRepository
+	ListenForAlerts(ctx context.Context) (<-chan struct{}, error)
+	ListenForRuleChanges(ctx context.Context) (<-chan struct{}, error)
+}
+
+type Notifier interface {
+	AlertMessages(al models.Alert, agentName string) ([]notifier.Message, error)
+}
+
+type Forwarder interface {
+	ForwardAlert(al models.Alert, agentName string)
+	ForwardAction(actor, action, target string)
+	ForwardRejection(endpoint, reason string)
 }
 
 type Config struct {
@@ -57,19 +131,60 @@ type Config struct {
 	CertFile    string `yaml:"cert_file"`
 	CertKeyFile string `yaml:"cert_key_file"`
 	CaFile      string `yaml:"ca_file"`
+	// The REST gateway shares host and certificates with the gRPC listener. It is disabled if no port is set
+	GatewayPort int64 `yaml:"gateway_port"`
+	// Raise an alert for agents that didn't call the server for this many seconds. Disabled if 0
+	SilentAgentAfter int64 `yaml:"silent_agent_after"`
+	// CRLs issued by the CA. Client certificates they list are rejected
+	CrlFiles []string `yaml:"crl_files"`
+	// Seconds between reloading the CRLs and the revocations from the database. Defaults to 300
+	CrlRefreshInterval int64 `yaml:"crl_refresh_interval"`
+	// Key of the first certificate in ca_file. Enables agent enrollment and, together with crl_file, the published CRL
+	CaKeyFile string `yaml:"ca_key_file"`
+	// Certificates revoked with RevokeCertificate are published here, signed with ca_key_file
+	CrlFile string `yaml:"crl_file"`
+	// Seconds until an enrollment token expires. Defaults to 86400
+	EnrollmentTokenValidity int64 `yaml:"enrollment_token_validity"`
+	// Seconds until a certificate issued to an agent expires. Defaults to 604800
+	IssuedCertValidity int64 `yaml:"issued_cert_validity"`
+	// Reject endpoints without certificate pins
+	RequireCertPins bool `yaml:"require_cert_pins"`
+	// Number of distinct approvers that must approve a baseline update. Defaults to 1
+	BaselineApprovalQuorum int64 `yaml:"baseline_approval_quorum"`
+	// Don't count the approval of whoever last changed the agent
+	ExcludeLastChanger bool `yaml:"exclude_last_changer"`
+	// Seconds between signing the head of the alert and audit chain. Defaults to 300
+	ChainCheckpointInterval int64 `yaml:"chain_checkpoint_interval"`
+	// Public key pins of previous server certificates, so that their checkpoints stay valid after rotating the key
+	ChainSignerPins []string `yaml:"chain_signer_pins"`
 }
 
 type Server struct {
 	proto.UnimplementedFimServer
-	srv      *grpc.Server
-	repo     Repository
-	enforcer *casbin.Enforcer
-	conf     Config
+	srv       *grpc.Server
+	repo      Repository
+	enforcer  *casbin.SyncedEnforcer
+	policyMu  sync.Mutex
+	watcher   *casbinadapter.Watcher
+	notifier  Notifier
+	forwarder Forwarder
+	alerts    *alertHub
+	certs     *certStore
+	revoked   *revocationList
+	issuerMu  sync.RWMutex
+	issuer    *issuer
+	gateway   *gateway
+	// The interceptors of every call, through gRPC or the gateway
+	streamChain grpc.StreamServerInterceptor
+	unaryChain  grpc.UnaryServerInterceptor
+	// ctx is canceled by Stop. It's created by New, so that Stop and Run don't race for it
+	ctx    context.Context
+	cancel context.CancelFunc
+	conf   Config
 }
 
-func New(repo Repository, config Config) *Server {
-	a := casbinadapter.NewAdapter(repo.Rules())
-	m, err := model.NewModelFromString(`[request_definition]
+// policyModel matches endpoints against the subject rules of the policy rules for an RPC
+const policyModel = `[request_definition]
 r = sub, obj
 
 [policy_definition]
@@ -79,21 +194,53 @@ p = sub_rule, obj
 e = some(where (p.eft == allow))
 
 [matchers]
-m = eval(p.sub_rule) && r.obj == p.obj`)
+m = eval(p.sub_rule) && r.obj == p.obj`
+
+func New(repo Repository, notifier Notifier, forwarder Forwarder, config Config) *Server {
+	a := casbinadapter.NewAdapter(repo.Rules())
+	m, err := model.NewModelFromString(policyModel)
 	if err != nil {
 		log.Fatal().Caller().Err(err).Msg("failed to create casbin model")
 	}
 
-	e, err := casbin.NewEnforcer(m, a)
+	// The policy can be changed at runtime, so the enforcer must be safe for concurrent use
+	e, err := casbin.NewSyncedEnforcer(m, a)
 	if err != nil {
 		log.Fatal().Caller().Err(err).Msg("failed to create casbin enforcer")
 	}
 
-	return &Server{
-		repo:     repo,
-		enforcer: e,
-		conf:     config,
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Server{
+		repo:      repo,
+		enforcer:  e,
+		notifier:  notifier,
+		forwarder: forwarder,
+		alerts:    newAlertHub(),
+		revoked:   newRevocationList(),
+		ctx:       ctx,
+		cancel:    cancel,
+		conf:      config,
 	}
+
+	s.streamChain = middleware.ChainStreamServer(
+		otelgrpc.StreamServerInterceptor(),
+		s.StreamMetricsInterceptor,
+		s.StreamAuthenticationInterceptor,
+		s.StreamAuditInterceptor,
+		s.StreamAuthorizationInterceptor,
+		grpcValidator.StreamServerInterceptor(),
+	)
+	s.unaryChain = middleware.ChainUnaryServer(
+		otelgrpc.UnaryServerInterceptor(),
+		s.UnaryMetricsInterceptor,
+		s.UnaryAuthenticationInterceptor,
+		s.UnaryAuditInterceptor,
+		s.UnaryAuthorizationInterceptor,
+		grpcValidator.UnaryServerInterceptor(),
+	)
+
+	return s
 }
 
 func (s *Server) Run() error {
@@ -104,78 +251,93 @@ func (s *Server) Run() error {
 		return err
 	}
 
-	creds, err := createGrpcCredentials(s.conf.CertFile, s.conf.CertKeyFile, s.conf.CaFile)
+	ctx := s.ctx
+
+	signals, err := s.repo.ListenForAlerts(ctx)
 	if err != nil {
 		return err
 	}
+	go s.alerts.run(signals)
 
-	srv := grpc.NewServer(
-		grpc.StreamInterceptor(
-			middleware.ChainStreamServer(
-				s.StreamAuthenticationInterceptor,
-				s.StreamAuthorizationInterceptor,
-				grpcValidator.StreamServerInterceptor(),
-			),
-		),
-		grpc.UnaryInterceptor(
-			middleware.ChainUnaryServer(
-				s.UnaryAuthenticationInterceptor,
-				s.UnaryAuthorizationInterceptor,
-				grpcValidator.UnaryServerInterceptor(),
-			),
-		),
-		grpc.Creds(creds),
-	)
-
-	s.srv = srv
-
-	proto.RegisterFimServer(srv, s)
-
-	log.Info().Msgf("starting to listen on: %s", address)
-	return srv.Serve(listener)
-}
-
-func (s *Server) Stop() {
-	log.Info().Msg("shutting down")
-	s.srv.Stop()
-}
-
-func createGrpcCredentials(certPath, keyPath, caPath string) (credentials.TransportCredentials, error) {
-	certPath, err := filepath.Abs(certPath)
+	ruleChanges, err := s.repo.ListenForRuleChanges(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	keyPath, err = filepath.Abs(keyPath)
+	s.watcher = casbinadapter.NewWatcher(ruleChanges)
+	err = s.enforcer.SetWatcher(s.watcher)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	// Replaces the default callback, which ignores errors
+	_ = s.watcher.SetUpdateCallback(func(string) {
+		if err := s.enforcer.LoadPolicy(); err != nil {
+			log.Error().Caller().Err(err).Msg("failed to reload casbin policy")
+			return
+		}
+		log.Info().Msg("reloaded casbin policy")
+	})
 
-	caPath, err = filepath.Abs(caPath)
-	if err != nil {
-		return nil, err
+	if s.conf.SilentAgentAfter != 0 {
+		go s.monitorSilentAgents(ctx)
+	}
+
+	// Agents without a certificate must be able to connect to enroll. All other calls still require one.
+	clientAuth := tls.RequireAndVerifyClientCert
+	if s.issuesCertificates() {
+		clientAuth = tls.VerifyClientCertIfGiven
+
+		s.issuer, err = loadIssuer(s.conf.CaFile, s.conf.CaKeyFile)
+		if err != nil {
+			return err
+		}
 	}
 
-	srvCert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	s.certs, err = newCertStore(s.conf.CertFile, s.conf.CertKeyFile, s.conf.CaFile, clientAuth, s.verifyPeerCertificate)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	go s.watchCertificates(ctx)
+	tlsConfig := s.certs.tlsConfig()
 
-	caBytes, err := ioutil.ReadFile(caPath)
+	err = s.setupRevocations(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	go s.refreshRevocations(ctx)
+	go s.writeCheckpoints(ctx)
 
-	pool := x509.NewCertPool()
-	ok := pool.AppendCertsFromPEM(caBytes)
-	if !ok {
-		return nil, errors.New("couldn't parse ca.cert")
+	if s.conf.GatewayPort != 0 {
+		s.gateway = s.newGateway(tlsConfig)
+		go func() {
+			if err := s.gateway.run(); err != nil {
+				log.Fatal().Caller().Err(err).Msg("gateway failed to run")
+			}
+		}()
 	}
 
-	return credentials.NewTLS(&tls.Config{
-		Certificates: []tls.Certificate{srvCert},
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		ClientCAs:    pool,
-		MinVersion:   tls.VersionTLS13,
-	}), nil
+	srv := grpc.NewServer(
+		grpc.StreamInterceptor(s.streamChain),
+		grpc.UnaryInterceptor(s.unaryChain),
+		grpc.Creds(credentials.NewTLS(tlsConfig)),
+	)
+
+	s.srv = srv
+
+	proto.RegisterFimServer(srv, s)
+
+	log.Info().Msgf("starting to listen on: %s", address)
+	return srv.Serve(listener)
+}
+
+func (s *Server) Stop() {
+	log.Info().Msg("shutting down")
+	s.cancel()
+	if s.watcher != nil {
+		s.watcher.Close()
+	}
+	if s.gateway != nil {
+		s.gateway.stop()
+	}
+	s.srv.Stop()
 }
@@ -0,0 +1,51 @@
+package server
+
+import "sync"
+
+// alertHub wakes up all alert subscribers whenever new alerts may be available
+type alertHub struct {
+	mu          sync.Mutex
+	subscribers map[chan struct{}]struct{}
+}
+
+func newAlertHub() *alertHub {
+	return &alertHub{
+		subscribers: make(map[chan struct{}]struct{}),
+	}
+}
+
+func (h *alertHub) run(signals <-chan struct{}) {
+	for range signals {
+		h.broadcast()
+	}
+}
+
+func (h *alertHub) subscribe() chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// A single buffered signal is enough because subscribers always fetch all pending alerts
+	ch := make(chan struct{}, 1)
+	h.subscribers[ch] = struct{}{}
+
+	return ch
+}
+
+func (h *alertHub) unsubscribe(ch chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subscribers, ch)
+}
+
+func (h *alertHub) broadcast() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,349 @@
+'use strict';
+
+// The dashboard talks to the REST gateway it is served from. The browser authenticates with its client
+// certificate, and /v1/session tells which RPCs the casbin policy grants, so only usable controls are shown.
+
+const state = {
+    session: null,
+    agents: [],
+    alerts: [],
+    nextPageToken: '',
+    agent: null,
+};
+
+const alertPageSize = 200;
+
+function can(rpc) {
+    return state.session.rpcs.includes(rpc);
+}
+
+async function api(method, path, body) {
+    // The gateway rejects calls that change state without this header, unless they have a JSON body
+    const init = {method: method, headers: {'X-Requested-With': 'fimserver'}};
+    if (body !== undefined) {
+        init.headers['Content-Type'] = 'application/json';
+        init.body = JSON.stringify(body);
+    }
+
+    const resp = await fetch(path, init);
+    const result = await resp.json();
+    if (!resp.ok) {
+        throw new Error(result.error || resp.statusText);
+    }
+
+    return result;
+}
+
+function showError(err) {
+    const el = document.getElementById('error');
+    el.textContent = err ? err.message : '';
+    el.hidden = !err;
+}
+
+function el(tag, text, className) {
+    const e = document.createElement(tag);
+    if (text !== undefined) {
+        e.textContent = text;
+    }
+    if (className) {
+        e.className = className;
+    }
+
+    return e;
+}
+
+function formatTime(seconds) {
+    if (!seconds) {
+        return 'never';
+    }
+
+    return new Date(seconds * 1000).toLocaleString();
+}
+
+function baselineState(agent) {
+    if (!agent.has_baseline) {
+        return ['missing', 'state-missing'];
+    }
+    if (!agent.baseline_is_current) {
+        return ['update approved', 'state-pending'];
+    }
+
+    return ['current', 'state-current'];
+}
+
+async function loadAgents() {
+    const path = can('GetAgentsByRisk') ? '/v1/agents/ranking' : '/v1/agents';
+    state.agents = await api('GET', path);
+    renderAgents();
+}
+
+function renderAgents() {
+    const tbody = document.querySelector('#agents tbody');
+    tbody.replaceChildren();
+
+    for (const agent of state.agents) {
+        const tr = el('tr');
+        if (can('GetAlertsByAgent')) {
+            tr.className = 'selectable';
+            if (state.agent === agent.name) {
+                tr.classList.add('selected');
+            }
+            tr.addEventListener('click', () => selectAgent(agent.name));
+        }
+
+        if (agent.disabled) {
+            tr.classList.add('disabled');
+        }
+
+        const [baseline, baselineClass] = baselineState(agent);
+        const facts = agent.host_facts || {};
+        tr.append(
+            el('td', agent.name),
+            el('td', [facts.hostname, facts.os_release, facts.kernel].filter(Boolean).join(', ')),
+            el('td', facts.agent_version || ''),
+            el('td', baseline, baselineClass),
+            el('td', formatTime(agent.last_scan)),
+            el('td', agent.last_seen ? `${formatTime(agent.last_seen)} from ${agent.remote_address}` : 'never'),
+            el('td', String(agent.risk_score || 0)),
+            el('td', (agent.watched_paths || []).join(', ')),
+            actionCell(agent),
+        );
+        tbody.append(tr);
+    }
+}
+
+function actionCell(agent) {
+    const td = el('td');
+
+    if (can('CreateBaselineUpdateApproval') && agent.has_baseline && agent.baseline_is_current) {
+        td.append(actionButton('Approve baseline update', async () => {
+            await api('POST', `/v1/agents/${encodeURIComponent(agent.name)}/baseline-approval`);
+            await loadAgents();
+        }));
+    }
+
+    td.append(...toggleButtons(agent, loadAgents));
+
+    if (can('DeleteEndpoint')) {
+        td.append(actionButton('Delete', async () => {
+            if (!confirm(`Delete agent '${agent.name}' with its baseline and alerts?`)) {
+                return;
+            }
+            await api('DELETE', `/v1/endpoints/${encodeURIComponent(agent.name)}`);
+            if (state.agent === agent.name) {
+                state.agent = null;
+                document.getElementById('alerts').hidden = true;
+            }
+            await loadAgents();
+        }));
+    }
+
+    return td;
+}
+
+// toggleButtons returns the button to disable or enable an endpoint, if allowed
+function toggleButtons(endpoint, reload) {
+    const rpc = endpoint.disabled ? 'EnableEndpoint' : 'DisableEndpoint';
+    if (!can(rpc) || endpoint.name === state.session.name) {
+        return [];
+    }
+
+    const action = endpoint.disabled ? 'enable' : 'disable';
+    return [actionButton(endpoint.disabled ? 'Enable' : 'Disable', async () => {
+        await api('POST', `/v1/endpoints/${encodeURIComponent(endpoint.name)}/${action}`);
+        await reload();
+    })];
+}
+
+async function loadClients() {
+    const clients = await api('GET', '/v1/clients');
+    const tbody = document.querySelector('#clients tbody');
+    tbody.replaceChildren();
+
+    for (const client of clients) {
+        const roles = el('input');
+        roles.value = (client.roles || []).join(', ');
+
+        const tr = el('tr');
+        const rolesCell = el('td');
+        const actions = el('td');
+
+        if (can('UpdateClientEndpointRoles') && client.name !== state.session.name) {
+            rolesCell.append(roles);
+            actions.append(actionButton('Save roles', async () => {
+                const body = {roles: roles.value.split(',').map((r) => r.trim()).filter(Boolean)};
+                await api('PUT', `/v1/clients/${encodeURIComponent(client.name)}/roles`, body);
+                await loadClients();
+            }));
+        } else {
+            rolesCell.textContent = roles.value;
+        }
+        actions.append(...toggleButtons(client, loadClients));
+
+        tr.append(
+            el('td', client.name),
+            rolesCell,
+            el('td', client.disabled ? 'disabled' : 'enabled', client.disabled ? 'state-missing' : 'state-current'),
+            actions,
+        );
+        tbody.append(tr);
+    }
+}
+
+function actionButton(label, action) {
+    const button = el('button', label);
+    button.addEventListener('click', async (event) => {
+        // Don't select the agent's row
+        event.stopPropagation();
+        button.disabled = true;
+        try {
+            await action();
+            showError(null);
+        } catch (err) {
+            showError(err);
+        } finally {
+            button.disabled = false;
+        }
+    });
+
+    return button;
+}
+
+async function selectAgent(name) {
+    state.agent = name;
+    renderAgents();
+
+    document.getElementById('alerts-agent').textContent = name;
+    document.getElementById('alerts').hidden = false;
+    await loadAlerts(false);
+}
+
+// Alerts are filtered and paged by the server if QueryAlerts is allowed. Otherwise all alerts of the agent are
+// fetched and filtered here.
+async function loadAlerts(more) {
+    const filter = document.getElementById('alert-filter').elements;
+
+    try {
+        if (can('QueryAlerts')) {
+            const params = new URLSearchParams({agent: state.agent, order: 'desc', page_size: alertPageSize});
+            if (filter.kind.value) {
+                params.set('kind', filter.kind.value);
+            }
+            if (filter.severity.value) {
+                params.set('severity', filter.severity.value);
+            }
+            if (/[*?]/.test(filter.path.value)) {
+                params.set('path_glob', filter.path.value);
+            } else if (filter.path.value) {
+                params.set('path_prefix', filter.path.value);
+            }
+            if (more) {
+                params.set('page_token', state.nextPageToken);
+            }
+
+            const page = await api('GET', `/v1/alerts?${params}`);
+            state.alerts = more ? state.alerts.concat(page.alerts) : page.alerts;
+            state.nextPageToken = page.next_page_token || '';
+        } else {
+            state.alerts = await api('GET', `/v1/agents/${encodeURIComponent(state.agent)}/alerts`);
+            state.alerts.sort((a, b) => (b.issued_at || 0) - (a.issued_at || 0));
+            state.nextPageToken = '';
+        }
+        showError(null);
+    } catch (err) {
+        state.alerts = [];
+        state.nextPageToken = '';
+        showError(err);
+    }
+
+    renderAlerts();
+}
+
+function matchesFilter(alert) {
+    if (can('QueryAlerts')) {
+        return true;
+    }
+
+    const filter = document.getElementById('alert-filter').elements;
+
+    return (!filter.kind.value || alert.kind === filter.kind.value) &&
+        (!filter.severity.value || alert.severity === filter.severity.value) &&
+        (!filter.path.value || (alert.path || '').startsWith(filter.path.value));
+}
+
+function renderAlerts() {
+    const tbody = document.querySelector('#alerts tbody');
+    tbody.replaceChildren();
+
+    for (const alert of state.alerts.filter(matchesFilter)) {
+        const tr = el('tr');
+        tr.append(
+            el('td', formatTime(alert.issued_at)),
+            el('td', alert.kind),
+            el('td', alert.severity, `severity-${alert.severity}`),
+            el('td', alert.path),
+            differencesCell(alert),
+        );
+        tbody.append(tr);
+    }
+
+    document.getElementById('alerts-more').hidden = !state.nextPageToken;
+}
+
+function differencesCell(alert) {
+    const td = el('td');
+    if (!alert.differences || alert.differences.length === 0) {
+        td.textContent = alert.difference || '';
+        return td;
+    }
+
+    const table = el('table', undefined, 'differences');
+    for (const diff of alert.differences) {
+        const tr = el('tr');
+        const change = el('td');
+        if (diff.before) {
+            change.append(el('code', diff.before), ' → ');
+        }
+        change.append(el('code', diff.after));
+        tr.append(el('td', diff.field), change);
+        table.append(tr);
+    }
+    td.append(table);
+
+    return td;
+}
+
+async function init() {
+    try {
+        state.session = await api('GET', '/v1/session');
+        document.getElementById('session').textContent =
+            `${state.session.name} (${state.session.roles.join(', ') || state.session.kind})`;
+
+        if (can('GetAgents') || can('GetAgentsByRisk')) {
+            document.getElementById('agents').hidden = false;
+            await loadAgents();
+        }
+
+        if (can('GetClientEndpoints')) {
+            document.getElementById('clients').hidden = false;
+            await loadClients();
+        }
+    } catch (err) {
+        showError(err);
+    }
+
+    let filterTimeout;
+    document.getElementById('alert-filter').addEventListener('input', () => {
+        if (!can('QueryAlerts')) {
+            renderAlerts();
+            return;
+        }
+        // Don't query on every keystroke
+        clearTimeout(filterTimeout);
+        filterTimeout = setTimeout(() => loadAlerts(false), 300);
+    });
+    document.getElementById('alert-filter').addEventListener('submit', (event) => event.preventDefault());
+    document.getElementById('alerts-more').addEventListener('click', () => loadAlerts(true));
+}
+
+init();